@@ -0,0 +1,35 @@
+package main
+
+import (
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/knight42/krelay/pkg/kube"
+)
+
+// clusterKey identifies the cluster of a target by the kubeconfig and the
+// context set in the targets file. The zero value is the cluster given on the
+// command line.
+type clusterKey struct {
+	kubeconfig string
+	context    string
+}
+
+// cluster holds what the targets in one cluster share: the clients and the
+// session with the krelay-server their forwarders go through.
+type cluster struct {
+	kf *kube.Flags
+	cs kubernetes.Interface
+	// sess is created once the first target of the cluster is listening.
+	sess *session
+}
+
+func newCluster(kf *kube.Flags, key clusterKey) (*cluster, error) {
+	if key != (clusterKey{}) {
+		kf = kf.WithCluster(key.kubeconfig, key.context)
+	}
+	cs, err := kf.ToClientSet()
+	if err != nil {
+		return nil, err
+	}
+	return &cluster{kf: kf, cs: cs}, nil
+}
@@ -2,23 +2,51 @@ package main
 
 import (
 	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"net"
+	"net/netip"
 	"os"
 	"os/signal"
-	"time"
+	"slices"
 
 	"github.com/spf13/cobra"
-	"k8s.io/streaming/pkg/httpstream"
 
 	"github.com/knight42/krelay/pkg/kube"
 	slogutil "github.com/knight42/krelay/pkg/slog"
 	"github.com/knight42/krelay/pkg/xnet"
 )
 
+const (
+	socks5CmdConnect      = 1
+	socks5CmdBind         = 2
+	socks5CmdUDPAssociate = 3
+)
+
+const (
+	socks5RepSucceeded            = 0
+	socks5RepServerFailure        = 1
+	socks5RepNotAllowed           = 2
+	socks5RepHostUnreachable      = 4
+	socks5RepCmdNotSupported      = 7
+	socks5RepAddrTypeNotSupported = 8
+)
+
+const (
+	socks5MethodNoAuth       = 0
+	socks5MethodUserPass     = 2
+	socks5MethodNoAcceptable = 0xff
+)
+
+var errSOCKS5AddrType = errors.New("unsupported address type")
+
 // socks5Handshake was excerpted from https://github.com/shadowsocks/go-shadowsocks2/blob/e1fe9ea737409e4d71efaa65e3caefa42a8fc188/socks/socks.go
-func socks5Handshake(clientConn net.Conn) (ap xnet.AddrPort, err error) {
+// It returns the command and the destination requested by the client, the
+// reply is up to the caller.
+func socks5Handshake(clientConn net.Conn, auth *proxyAuth) (cmd byte, ap xnet.AddrPort, err error) {
 	// maxAddrLen is the maximum size of SOCKS address in bytes.
 	const maxAddrLen = 256
 	br := bytesReader{
@@ -35,26 +63,50 @@ func socks5Handshake(clientConn net.Conn) (ap xnet.AddrPort, err error) {
 	}
 
 	nmethods := data[1]
-	_, err = br.ReadBytes(int(nmethods))
+	methods, err := br.ReadBytes(int(nmethods))
 	if err != nil {
 		return
 	}
 
+	method := byte(socks5MethodNoAuth)
+	if auth != nil {
+		method = socks5MethodUserPass
+	}
+	if !slices.Contains(methods, method) {
+		// X'FF' No acceptable methods
+		_, _ = clientConn.Write([]byte{5, socks5MethodNoAcceptable})
+		return cmd, ap, fmt.Errorf("client does not offer method %d", method)
+	}
+
 	// write VER METHOD
-	// VERSION 5, METHOD 0 (no authentication)
-	_, err = clientConn.Write([]byte{5, 0})
+	_, err = clientConn.Write([]byte{5, method})
 	if err != nil {
 		return
 	}
+	if auth != nil {
+		err = socks5Authenticate(clientConn, &br, auth)
+		if err != nil {
+			return
+		}
+	}
 
-	// read VER CMD RSV ATYP DST.ADDR DST.PORT
+	// read VER CMD RSV
 	data, err = br.ReadBytes(3)
 	if err != nil {
 		return
 	}
-	cmd := data[1]
+	cmd = data[1]
+
+	// read ATYP DST.ADDR DST.PORT
+	ap, err = readSOCKS5AddrPort(&br)
+	if errors.Is(err, errSOCKS5AddrType) {
+		_ = writeSOCKS5Reply(clientConn, socks5RepAddrTypeNotSupported, netip.AddrPort{})
+	}
+	return cmd, ap, err
+}
 
-	data, err = br.ReadBytes(1) // read 1st byte for address type
+func readSOCKS5AddrPort(br *bytesReader) (ap xnet.AddrPort, err error) {
+	data, err := br.ReadBytes(1) // read 1st byte for address type
 	if err != nil {
 		return
 	}
@@ -84,58 +136,102 @@ func socks5Handshake(clientConn net.Conn) (ap xnet.AddrPort, err error) {
 		addr = xnet.AddrFromBytes(xnet.AddrTypeHost, copyBuffer(data))
 
 	default:
-		// X'08' Address type not supported
-		_, _ = clientConn.Write([]byte{5, 8, 0, 1, 0, 0, 0, 0, 0, 0})
-		return ap, fmt.Errorf("unsupported address type: %d", adrType)
+		return ap, fmt.Errorf("%w: %d", errSOCKS5AddrType, adrType)
 	}
 
 	port, err := br.ReadUint16() // read DST.PORT
 	if err != nil {
 		return
 	}
+	return xnet.AddrPortFrom(addr, port), nil
+}
 
-	switch cmd {
-	case 1: // CONNECT
-		_, err = clientConn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
-		if err != nil {
-			return
-		}
-
-	default:
-		// X'07' Command not supported
-		_, _ = clientConn.Write([]byte{5, 7, 0, 1, 0, 0, 0, 0, 0, 0})
-		return ap, fmt.Errorf("unsupported command: %d", cmd)
+// socks5Authenticate runs the username/password subnegotiation of RFC 1929.
+func socks5Authenticate(clientConn net.Conn, br *bytesReader, auth *proxyAuth) error {
+	// read VER ULEN UNAME PLEN PASSWD
+	data, err := br.ReadBytes(1)
+	if err != nil {
+		return err
+	}
+	if data[0] != 1 {
+		return fmt.Errorf("unsupported auth version: %d", data[0])
+	}
+	data, err = br.ReadString()
+	if err != nil {
+		return err
+	}
+	user := string(data)
+	data, err = br.ReadString()
+	if err != nil {
+		return err
 	}
+	if !auth.verify(user, string(data)) {
+		// STATUS other than X'00' means failure, and the connection must be closed.
+		_, _ = clientConn.Write([]byte{1, 1})
+		return fmt.Errorf("authentication failed for user %q", user)
+	}
+	_, err = clientConn.Write([]byte{1, 0})
+	return err
+}
 
-	return xnet.AddrPortFrom(addr, port), nil
+// writeSOCKS5Reply writes VER REP RSV ATYP BND.ADDR BND.PORT. A zero bnd is
+// written as 0.0.0.0:0.
+func writeSOCKS5Reply(w io.Writer, rep byte, bnd netip.AddrPort) error {
+	ip := bnd.Addr().Unmap()
+	if !ip.IsValid() {
+		ip = netip.IPv4Unspecified()
+	}
+	atyp := byte(1)
+	if ip.Is6() {
+		atyp = 4
+	}
+	b := append([]byte{5, rep, 0, atyp}, ip.AsSlice()...)
+	b = binary.BigEndian.AppendUint16(b, bnd.Port())
+	_, err := w.Write(b)
+	return err
 }
 
-func handleSOCKS5Conn(clientConn net.Conn, serverConn httpstream.Connection) {
-	ap, err := socks5Handshake(clientConn)
+func handleSOCKS5Conn(clientConn net.Conn, serverConn serverConn, auth *proxyAuth) {
+	cmd, ap, err := socks5Handshake(clientConn, auth)
 	if err != nil {
 		_ = clientConn.Close()
 		slog.Error("Fail to handle SOCKS5 handshake", slogutil.Error(err))
 		return
 	}
 
-	handleTCPConn(clientConn, serverConn, ap)
-}
-
-func runSOCKS5Server(l net.Listener, streamConn httpstream.Connection) {
-	slog.Info("SOCKS5 server is running", slog.String("address", l.Addr().String()))
-	for {
-		select {
-		case <-streamConn.CloseChan():
+	switch cmd {
+	case socks5CmdConnect:
+		err = writeSOCKS5Reply(clientConn, socks5RepSucceeded, netip.AddrPort{})
+		if err != nil {
+			_ = clientConn.Close()
 			return
-		default:
 		}
+		handleTCPConn(clientConn, serverConn, ap, nil)
+
+	case socks5CmdBind:
+		handleSOCKS5Bind(clientConn, serverConn, ap)
 
+	case socks5CmdUDPAssociate:
+		handleSOCKS5UDPAssociate(clientConn, serverConn)
+
+	default:
+		_ = writeSOCKS5Reply(clientConn, socks5RepCmdNotSupported, netip.AddrPort{})
+		_ = clientConn.Close()
+		slog.Error("Fail to handle SOCKS5 handshake", slogutil.Error(fmt.Errorf("unsupported command: %d", cmd)))
+	}
+}
+
+func runProxyServer(l net.Listener, sess *session, auth *proxyAuth) {
+	slog.Info("SOCKS5 and HTTP proxy is running", slog.String("address", l.Addr().String()))
+	for {
 		c, err := l.Accept()
 		if err != nil {
-			slog.Error("Fail to accept tcp connection", slogutil.Error(err))
+			if !xnet.IsClosedConnectionError(err) {
+				slog.Error("Fail to accept tcp connection", slogutil.Error(err))
+			}
 			return
 		}
-		go handleSOCKS5Conn(c, streamConn)
+		go handleProxyConn(c, sess.ServerConn(), auth)
 	}
 }
 
@@ -143,32 +239,34 @@ type proxyOptions struct {
 	kf *kube.Flags
 
 	listenAddr string
+	authPairs  []string
+	authFile   string
 }
 
 func (o *proxyOptions) Run(ctx context.Context, _ []string) error {
+	auth, err := newProxyAuth(o.authPairs, o.authFile)
+	if err != nil {
+		return err
+	}
+
 	l, err := net.Listen("tcp", o.listenAddr)
 	if err != nil {
 		return err
 	}
 	defer l.Close()
+	if auth == nil && !l.Addr().(*net.TCPAddr).IP.IsLoopback() {
+		slog.Warn("No authentication is configured, anyone who can reach the proxy can access the cluster", slog.String("address", l.Addr().String()))
+	}
 
-	createdJob, err := o.kf.RunServerJob(ctx)
+	sess, err := newSession(ctx, o.kf)
 	if err != nil {
 		return err
 	}
+	defer sess.Close()
 
-	defer createdJob.Close()
-
-	streamConn := createdJob.StreamConn()
-	go sendHeartbeats(streamConn, 5*time.Second)
-	go runSOCKS5Server(l, streamConn)
-
-	select {
-	case <-streamConn.CloseChan():
-		slog.Info("Lost connection to krelay-server pod")
-	case <-ctx.Done():
-	}
+	go runProxyServer(l, sess, auth)
 
+	sess.run(ctx)
 	return nil
 }
 
@@ -178,7 +276,7 @@ func newProxyCommand(kf *kube.Flags) *cobra.Command {
 	}
 	cmd := &cobra.Command{
 		Use:   "proxy",
-		Short: "Run a SOCKS5 proxy server",
+		Short: "Run a SOCKS5 and HTTP proxy server",
 		RunE: func(cmd *cobra.Command, args []string) error {
 			ctx, cancel := signal.NotifyContext(cmd.Context(), os.Interrupt)
 			defer cancel()
@@ -187,6 +285,8 @@ func newProxyCommand(kf *kube.Flags) *cobra.Command {
 	}
 	flags := cmd.Flags()
 
-	flags.StringVarP(&o.listenAddr, "listen", "l", "127.0.0.1:1080", "SOCKS5 proxy listen address")
+	flags.StringVarP(&o.listenAddr, "listen", "l", "127.0.0.1:1080", "Proxy listen address, serving both SOCKS5 and HTTP")
+	flags.StringSliceVar(&o.authPairs, "auth", nil, "Require the username/password authentication with these user:password pairs.")
+	flags.StringVar(&o.authFile, "auth-file", "", "An htpasswd-style file with one user:password per line. Passwords may be plain text or {SHA} digests.")
 	return cmd
 }
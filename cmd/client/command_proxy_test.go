@@ -0,0 +1,94 @@
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSOCKS5Handshake(t *testing.T) {
+	auth := &proxyAuth{users: map[string]string{"alice": "s3cr3t"}}
+	connectRequest := []byte{5, 1, 0, 1, 10, 0, 0, 1, 0, 80}
+	userPass := func(user, password string) []byte {
+		b := append([]byte{1, byte(len(user))}, user...)
+		b = append(b, byte(len(password)))
+		return append(b, password...)
+	}
+	concat := func(bs ...[]byte) []byte {
+		var ret []byte
+		for _, b := range bs {
+			ret = append(ret, b...)
+		}
+		return ret
+	}
+
+	testCases := map[string]struct {
+		auth   *proxyAuth
+		input  []byte
+		expect []byte
+
+		expectErr string
+	}{
+		"no auth": {
+			input:  concat([]byte{5, 1, 0}, connectRequest),
+			expect: []byte{5, 0},
+		},
+		"no auth not offered": {
+			input:     []byte{5, 1, 2},
+			expect:    []byte{5, 0xff},
+			expectErr: "does not offer method 0",
+		},
+		"user/pass not offered": {
+			auth:      auth,
+			input:     []byte{5, 1, 0},
+			expect:    []byte{5, 0xff},
+			expectErr: "does not offer method 2",
+		},
+		"user/pass": {
+			auth:   auth,
+			input:  concat([]byte{5, 2, 0, 2}, userPass("alice", "s3cr3t"), connectRequest),
+			expect: []byte{5, 2, 1, 0},
+		},
+		"wrong password": {
+			auth:      auth,
+			input:     concat([]byte{5, 1, 2}, userPass("alice", "wrong")),
+			expect:    []byte{5, 2, 1, 1},
+			expectErr: "authentication failed",
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			r := require.New(t)
+			client, server := net.Pipe()
+			defer client.Close()
+
+			type result struct {
+				cmd  byte
+				addr string
+				err  error
+			}
+			done := make(chan result, 1)
+			go func() {
+				defer server.Close()
+				cmd, ap, err := socks5Handshake(server, tc.auth)
+				done <- result{cmd: cmd, addr: ap.String(), err: err}
+			}()
+			go func() {
+				_, _ = client.Write(tc.input)
+			}()
+
+			got, _ := io.ReadAll(client)
+			res := <-done
+			r.Equal(tc.expect, got)
+			if len(tc.expectErr) > 0 {
+				r.ErrorContains(res.err, tc.expectErr)
+				return
+			}
+			r.NoError(res.err)
+			r.Equal(byte(socks5CmdConnect), res.cmd)
+			r.Equal("10.0.0.1:80", res.addr)
+		})
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	"github.com/knight42/krelay/pkg/constants"
+	"github.com/knight42/krelay/pkg/kube"
+	slogutil "github.com/knight42/krelay/pkg/slog"
+	"github.com/knight42/krelay/pkg/xio"
+	"github.com/knight42/krelay/pkg/xnet"
+)
+
+// reverseSpec exposes localAddr on remotePort of krelay-server.
+type reverseSpec struct {
+	remotePort uint16
+	localAddr  string
+}
+
+// parseReverseSpec parses REMOTE_PORT[:[LOCAL_HOST:]LOCAL_PORT]. The local
+// port defaults to the remote port, and the local host to 127.0.0.1.
+func parseReverseSpec(s string) (reverseSpec, error) {
+	remotePortStr, local, hasLocal := strings.Cut(s, ":")
+	remotePort, err := strconv.ParseUint(remotePortStr, 10, 16)
+	if err != nil || remotePort == 0 {
+		return reverseSpec{}, fmt.Errorf("invalid remote port: %q", remotePortStr)
+	}
+	if !hasLocal {
+		local = remotePortStr
+	}
+
+	host, portStr := "127.0.0.1", local
+	if strings.Contains(local, ":") {
+		host, portStr, err = net.SplitHostPort(local)
+		if err != nil {
+			return reverseSpec{}, fmt.Errorf("invalid local address: %q", local)
+		}
+	}
+	localPort, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil || localPort == 0 {
+		return reverseSpec{}, fmt.Errorf("invalid local port: %q", portStr)
+	}
+	return reverseSpec{
+		remotePort: uint16(remotePort),
+		localAddr:  net.JoinHostPort(host, portStr),
+	}, nil
+}
+
+type reverseForwarder struct {
+	reverseSpec
+	// svc is nil if no Service is requested.
+	svc *kube.ReverseService
+}
+
+// run keeps the listener in krelay-server open, re-creating it after the
+// connection is re-established, until ctx is done.
+func (r *reverseForwarder) run(ctx context.Context, sess *session) {
+	newBackoff := func() wait.Backoff {
+		return wait.Backoff{
+			Duration: time.Second,
+			Factor:   2,
+			Jitter:   0.1,
+			Steps:    math.MaxInt32,
+			Cap:      30 * time.Second,
+		}
+	}
+	backoff := newBackoff()
+	for {
+		listened, err := r.listen(ctx, sess.ServerConn())
+		if ctx.Err() != nil {
+			return
+		}
+		if listened {
+			backoff = newBackoff()
+		}
+		delay := backoff.Step()
+		slog.Warn("Reverse listener stopped. Will retry.", slogutil.Uint16(constants.LogFieldRemotePort, r.remotePort), slogutil.Error(err), slog.Duration("after", delay))
+
+		t := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// listen asks krelay-server to listen on the remote port, and accepts the
+// inbound connections it announces. It reports whether the server was
+// listening before the error happened.
+func (r *reverseForwarder) listen(ctx context.Context, serverConn serverConn) (bool, error) {
+	requestID := xnet.NewRequestID()
+	l := slog.With(slog.String(constants.LogFieldRequestID, requestID), slogutil.Uint16(constants.LogFieldRemotePort, r.remotePort))
+
+	dataStream, errorChan, err := createStream(serverConn, requestID)
+	if err != nil {
+		return false, err
+	}
+
+	hdr := serverConn.newHeader(requestID, xnet.ProtocolReverseListen, xnet.AddrPortFrom(xnet.Addr{}, r.remotePort))
+	_, err = xio.WriteFull(dataStream, hdr.Marshal())
+	if err != nil {
+		return false, fmt.Errorf("write header: %w", err)
+	}
+	bindAddr, err := readBindReply(dataStream)
+	if err != nil {
+		return false, fmt.Errorf("listen: %w", err)
+	}
+	key, err := xnet.ReadListenerKey(dataStream)
+	if err != nil {
+		return false, fmt.Errorf("listen: %w", err)
+	}
+	l.Info("Forwarding from the cluster",
+		slog.String("address", bindAddr.String()),
+		slog.String(constants.LogFieldLocalAddr, r.localAddr),
+	)
+	if r.svc != nil {
+		err = r.svc.Apply(ctx, bindAddr.Addr())
+		if err != nil {
+			l.Error("Fail to update service", slogutil.Error(err))
+		}
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-stop:
+		}
+		// krelay-server stops listening when the stream is closed.
+		_ = dataStream.Close()
+	}()
+
+	for {
+		reqID, err := xnet.ReadRequestID(dataStream)
+		if err != nil {
+			if streamErr := <-errorChan; streamErr != nil {
+				err = errors.Join(err, streamErr)
+			}
+			return true, err
+		}
+		go r.accept(serverConn, reqID, key)
+	}
+}
+
+// accept claims the inbound connection announced as reqID by the listener with
+// the given key, and relays it to the local address.
+func (r *reverseForwarder) accept(serverConn serverConn, reqID, key string) {
+	l := slog.With(slog.String(constants.LogFieldRequestID, reqID))
+	defer l.Debug("accept exit")
+
+	dataStream, errorChan, err := createStream(serverConn, reqID)
+	if err != nil {
+		l.Error("Fail to create stream", slogutil.Error(err))
+		return
+	}
+
+	hdr := serverConn.newHeader(reqID, xnet.ProtocolReverseAccept, xnet.AddrPortFrom(xnet.AddrFromHost(key), 0))
+	_, err = xio.WriteFull(dataStream, hdr.Marshal())
+	if err != nil {
+		l.Error("Fail to write header", slogutil.Error(err))
+		return
+	}
+
+	var ack xnet.Acknowledgement
+	err = ack.FromReader(dataStream)
+	if err != nil {
+		l.Error("Fail to receive ack", slogutil.Error(err))
+		return
+	}
+	if ack.Code != xnet.AckCodeOK {
+		l.Error("Fail to accept inbound connection", slogutil.Error(ack.Code))
+		return
+	}
+
+	localConn, err := net.Dial(constants.ProtocolTCP, r.localAddr)
+	if err != nil {
+		l.Error("Fail to connect to local address", slog.String(constants.LogFieldLocalAddr, r.localAddr), slogutil.Error(err))
+		_ = dataStream.Reset()
+		return
+	}
+	defer localConn.Close()
+	l.Info("Handling inbound connection", slog.String(constants.LogFieldLocalAddr, r.localAddr))
+
+	pipeStream(l, localConn, dataStream, errorChan)
+}
+
+type reverseOptions struct {
+	kf *kube.Flags
+
+	service string
+}
+
+func (o *reverseOptions) Run(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return errors.New("at least one port is required")
+	}
+	specs := make([]reverseSpec, 0, len(args))
+	ports := make([]int32, 0, len(args))
+	for _, arg := range args {
+		spec, err := parseReverseSpec(arg)
+		if err != nil {
+			return err
+		}
+		specs = append(specs, spec)
+		ports = append(ports, int32(spec.remotePort))
+	}
+
+	var svc *kube.ReverseService
+	if len(o.service) > 0 {
+		var err error
+		svc, err = o.kf.NewReverseService(o.service, ports)
+		if err != nil {
+			return err
+		}
+		defer svc.Close()
+	}
+
+	sess, err := newSession(ctx, o.kf)
+	if err != nil {
+		return err
+	}
+	defer sess.Close()
+
+	for _, spec := range specs {
+		fwd := &reverseForwarder{reverseSpec: spec, svc: svc}
+		go fwd.run(ctx, sess)
+	}
+
+	sess.run(ctx)
+	return nil
+}
+
+func newReverseCommand(kf *kube.Flags) *cobra.Command {
+	o := reverseOptions{
+		kf: kf,
+	}
+	cmd := &cobra.Command{
+		Use:   "reverse [options] REMOTE_PORT[:[LOCAL_HOST:]LOCAL_PORT] [...]",
+		Short: "Expose local ports inside the cluster",
+		Long: `Make krelay-server listen on REMOTE_PORT, and forward every connection it accepts to LOCAL_HOST:LOCAL_PORT.
+
+LOCAL_HOST defaults to 127.0.0.1 and LOCAL_PORT defaults to REMOTE_PORT. Pods can reach the ports via the krelay-server pod IP,
+or via the Service created with --service.`,
+		Example: `  # Let pods reach the local port 3000 via port 8080 of the krelay-server pod
+  kubectl relay reverse 8080:3000
+
+  # Create the Service "webhook" in front of port 8443 of the krelay-server pod
+  kubectl relay reverse --service webhook 8443:localhost:8443`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, cancel := signal.NotifyContext(cmd.Context(), os.Interrupt)
+			defer cancel()
+			return o.Run(ctx, args)
+		},
+	}
+	flags := cmd.Flags()
+	flags.StringVar(&o.service, "service", "", "Create a temporary Service with this name in front of the remote ports, in the namespace of krelay-server.")
+	return cmd
+}
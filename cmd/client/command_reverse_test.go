@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseReverseSpec(t *testing.T) {
+	testCases := map[string]struct {
+		input     string
+		expect    reverseSpec
+		expectErr string
+	}{
+		"same port": {
+			input:  "8080",
+			expect: reverseSpec{remotePort: 8080, localAddr: "127.0.0.1:8080"},
+		},
+		"local port": {
+			input:  "8080:3000",
+			expect: reverseSpec{remotePort: 8080, localAddr: "127.0.0.1:3000"},
+		},
+		"local host and port": {
+			input:  "8080:localhost:3000",
+			expect: reverseSpec{remotePort: 8080, localAddr: "localhost:3000"},
+		},
+		"local ipv6": {
+			input:  "8080:[::1]:3000",
+			expect: reverseSpec{remotePort: 8080, localAddr: "[::1]:3000"},
+		},
+		"invalid remote port": {
+			input:     "http:3000",
+			expectErr: "invalid remote port",
+		},
+		"invalid local port": {
+			input:     "8080:localhost:0",
+			expectErr: "invalid local port",
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			got, err := parseReverseSpec(tc.input)
+			if len(tc.expectErr) > 0 {
+				require.ErrorContains(t, err, tc.expectErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expect, got)
+		})
+	}
+}
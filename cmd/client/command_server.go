@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	k8serr "k8s.io/apimachinery/pkg/api/errors"
+
+	"github.com/knight42/krelay/pkg/kube"
+)
+
+type serverInstallOptions struct {
+	kf *kube.Flags
+
+	dryRun bool
+	opts   kube.InstallOptions
+}
+
+func newServerCommand(kf *kube.Flags) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "server",
+		Short: "Manage a persistent krelay-server",
+		Long: fmt.Sprintf(`Manage a krelay-server Deployment that clients attach to with "--server-mode=%s" instead of creating a Job.
+
+The server is installed into the namespace of the krelay-server pod, which is "default" unless it is changed by --patch or --patch-file.`, kube.ServerModeExisting),
+	}
+	cmd.AddCommand(
+		newServerInstallCommand(kf),
+		newServerUninstallCommand(kf),
+		newServerStatusCommand(kf),
+	)
+	return cmd
+}
+
+func newServerInstallCommand(kf *kube.Flags) *cobra.Command {
+	o := serverInstallOptions{kf: kf}
+	cmd := &cobra.Command{
+		Use:   "install",
+		Short: "Install krelay-server as a Deployment",
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			objs, err := o.kf.BuildServerInstallation(o.opts)
+			if err != nil {
+				return err
+			}
+			if o.dryRun {
+				return kube.PrintServerInstallation(cmd.OutOrStdout(), objs)
+			}
+			return o.kf.InstallServer(cmd.Context(), objs)
+		},
+	}
+	flags := cmd.Flags()
+	flags.BoolVar(&o.dryRun, "dry-run", false, "Print the objects that would be applied without applying them.")
+	flags.Int32Var(&o.opts.Replicas, "replicas", 1, "Number of krelay-server replicas.")
+	flags.StringSliceVar(&o.opts.Users, "grant-user", nil, "Users allowed to connect to krelay-server. Can be repeated.")
+	flags.StringSliceVar(&o.opts.Groups, "grant-group", nil, "Groups allowed to connect to krelay-server. Can be repeated.")
+	return cmd
+}
+
+func newServerUninstallCommand(kf *kube.Flags) *cobra.Command {
+	return &cobra.Command{
+		Use:   "uninstall",
+		Short: "Remove the krelay-server Deployment and its RBAC",
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			return kf.UninstallServer(cmd.Context())
+		},
+	}
+}
+
+func newServerStatusCommand(kf *kube.Flags) *cobra.Command {
+	return &cobra.Command{
+		Use:   "status",
+		Short: "Show the status of the installed krelay-server",
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			status, err := kf.GetServerStatus(cmd.Context())
+			if err != nil {
+				if k8serr.IsNotFound(err) {
+					return fmt.Errorf("krelay-server is not installed")
+				}
+				return err
+			}
+
+			out := cmd.OutOrStdout()
+			_, _ = fmt.Fprintf(out, "Namespace: %s\nImage:     %s\nReady:     %d/%d\n\n", status.Namespace, status.Image, status.ReadyReplicas, status.Replicas)
+			w := tabwriter.NewWriter(out, 0, 4, 3, ' ', 0)
+			_, _ = fmt.Fprintln(w, "POD\tPHASE\tREADY\tAGE")
+			for _, p := range status.Pods {
+				_, _ = fmt.Fprintf(w, "%s\t%s\t%t\t%s\n", p.Name, p.Phase, p.Ready, p.Age.Round(time.Second))
+			}
+			return w.Flush()
+		},
+	}
+}
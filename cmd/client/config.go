@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"go.yaml.in/yaml/v3"
+
+	"github.com/knight42/krelay/pkg/constants"
+	"github.com/knight42/krelay/pkg/remoteaddr"
+)
+
+const (
+	relayConfigAPIVersion = "krelay/v1"
+	relayConfigKind       = "RelayConfig"
+)
+
+// relayConfig is the structured form of a targets file in YAML or JSON, e.g.
+//
+//	apiVersion: krelay/v1
+//	kind: RelayConfig
+//	targets:
+//	- name: web
+//	  resource: svc/web
+//	  namespace: shop
+//	  lb: round-robin
+//	  timeouts:
+//	    connect: 5s
+//	    idle: 30m
+//	  retry:
+//	    attempts: 3
+//	    backoff: 500ms
+//	  ports:
+//	  - local: 8080
+//	    remote: http
+//	  - local: 9090
+//	    remote: 9090
+//	    address: 0.0.0.0
+//	- resource: host/dns.example.com
+//	  ports:
+//	  - local: 10053
+//	    remote: 53
+//	    protocol: udp
+type relayConfig struct {
+	APIVersion string         `yaml:"apiVersion"`
+	Kind       string         `yaml:"kind"`
+	Targets    []targetConfig `yaml:"targets"`
+}
+
+type targetConfig struct {
+	// Name identifies the target in the logs, it defaults to the resource.
+	Name string `yaml:"name"`
+	// Resource is TYPE/NAME as on the command line.
+	Resource   string `yaml:"resource"`
+	Namespace  string `yaml:"namespace"`
+	Context    string `yaml:"context"`
+	Kubeconfig string `yaml:"kubeconfig"`
+	// Address is the local listen address of the ports without their own.
+	Address string `yaml:"address"`
+	AllPods bool   `yaml:"allPods"`
+	Host    string `yaml:"host"`
+	Path    string `yaml:"path"`
+	// LB and Readiness override --lb and --readiness for this target.
+	LB        string         `yaml:"lb"`
+	Readiness string         `yaml:"readiness"`
+	Timeouts  timeoutsConfig `yaml:"timeouts"`
+	Retry     retryConfig    `yaml:"retry"`
+	Ports     []portConfig   `yaml:"ports"`
+}
+
+type timeoutsConfig struct {
+	// Connect limits opening a connection, from creating the stream until
+	// krelay-server has connected to the destination.
+	Connect time.Duration `yaml:"connect"`
+	// Idle closes connections and UDP flows without traffic for this long.
+	Idle time.Duration `yaml:"idle"`
+}
+
+type retryConfig struct {
+	// Attempts is the number of times opening a TCP connection is tried,
+	// resolving the destination again each time. It defaults to 1.
+	Attempts int `yaml:"attempts"`
+	// Backoff is the delay before the second attempt, doubled after each
+	// further one. It defaults to 1s.
+	Backoff time.Duration `yaml:"backoff"`
+}
+
+type portConfig struct {
+	// Local is the local port, it defaults to the remote port.
+	Local string `yaml:"local"`
+	// Remote is the number or the name of the remote port. It may be omitted
+	// for route targets to forward to the backend port of the rule.
+	Remote   string `yaml:"remote"`
+	Protocol string `yaml:"protocol"`
+	Address  string `yaml:"address"`
+	// NodePort forwards to the NodePort of a Service port instead.
+	NodePort bool `yaml:"nodePort"`
+}
+
+// arg returns the port in the syntax of the command line.
+func (p *portConfig) arg() (string, error) {
+	if strings.ContainsAny(p.Local+p.Remote, ":@") {
+		return "", fmt.Errorf("invalid port: local %q, remote %q", p.Local, p.Remote)
+	}
+	var ret string
+	switch {
+	case len(p.Local) > 0 && len(p.Remote) > 0:
+		ret = p.Local + ":" + p.Remote
+	case len(p.Local) > 0:
+		ret = p.Local
+	case len(p.Remote) > 0:
+		ret = p.Remote
+	default:
+		return "", errors.New("local or remote port is required")
+	}
+	if len(p.Protocol) > 0 {
+		switch p.Protocol {
+		case constants.ProtocolTCP, constants.ProtocolUDP:
+		default:
+			return "", fmt.Errorf("unknown protocol: %q", p.Protocol)
+		}
+		ret += "@" + p.Protocol
+	}
+	if p.NodePort {
+		ret = nodePortPrefix + ret
+	}
+	return ret, nil
+}
+
+// isRelayConfig reports whether the targets file is a relayConfig rather than
+// one target per line.
+func isRelayConfig(data []byte) bool {
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "//") || strings.HasPrefix(line, "#") {
+			continue
+		}
+		for _, prefix := range []string{"{", "---", "apiVersion:", "kind:", "targets:"} {
+			if strings.HasPrefix(line, prefix) {
+				return true
+			}
+		}
+		return false
+	}
+	return false
+}
+
+// loadTargets reads a targets file in either format.
+func loadTargets(r io.Reader, defaultNamespace string) ([]target, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if isRelayConfig(data) {
+		return parseRelayConfig(data, defaultNamespace)
+	}
+	return parseTargetsFile(bytes.NewReader(data), defaultNamespace)
+}
+
+// configError is an error at a position of the config.
+func configError(node *yaml.Node, format string, args ...any) error {
+	return fmt.Errorf("line %d, column %d: %s", node.Line, node.Column, fmt.Sprintf(format, args...))
+}
+
+// parseRelayConfig decodes and validates a relayConfig. Every port address
+// results in its own target, since a target listens on a single address.
+func parseRelayConfig(data []byte, defaultNamespace string) ([]target, error) {
+	var cfg relayConfig
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	err := dec.Decode(&cfg)
+	if err != nil {
+		return nil, fmt.Errorf("parse config: %w", err)
+	}
+
+	// Decode it again as nodes to report the position of invalid values.
+	var doc yaml.Node
+	err = yaml.Unmarshal(data, &doc)
+	if err != nil {
+		return nil, fmt.Errorf("parse config: %w", err)
+	}
+	root := &doc
+	if root.Kind == yaml.DocumentNode && len(root.Content) > 0 {
+		root = resolveAlias(root.Content[0])
+	}
+
+	if cfg.APIVersion != relayConfigAPIVersion {
+		return nil, configError(valueNode(root, "apiVersion"), "unsupported apiVersion %q, expect %q", cfg.APIVersion, relayConfigAPIVersion)
+	}
+	if cfg.Kind != relayConfigKind {
+		return nil, configError(valueNode(root, "kind"), "unsupported kind %q, expect %q", cfg.Kind, relayConfigKind)
+	}
+	targetsNode := valueNode(root, "targets")
+	if len(cfg.Targets) == 0 {
+		return nil, configError(targetsNode, "no targets")
+	}
+
+	names := map[string]int{}
+	var ret []target
+	for i, tc := range cfg.Targets {
+		tn := itemNode(targetsNode, i)
+		if len(tc.Resource) == 0 {
+			return nil, configError(tn, "targets[%d]: resource is required", i)
+		}
+		if len(tc.Name) > 0 {
+			if prev, ok := names[tc.Name]; ok {
+				return nil, configError(valueNode(tn, "name"), "targets[%d]: name %q is already used by targets[%d]", i, tc.Name, prev)
+			}
+			names[tc.Name] = i
+		}
+		if len(tc.LB) > 0 {
+			if _, err := remoteaddr.ParseLBPolicy(tc.LB); err != nil {
+				return nil, configError(valueNode(tn, "lb"), "targets[%d]: %v", i, err)
+			}
+		}
+		if len(tc.Readiness) > 0 {
+			if _, err := remoteaddr.ParseReadiness(tc.Readiness); err != nil {
+				return nil, configError(valueNode(tn, "readiness"), "targets[%d]: %v", i, err)
+			}
+		}
+		if len(tc.Address) > 0 && net.ParseIP(tc.Address) == nil {
+			return nil, configError(valueNode(tn, "address"), "targets[%d]: invalid address: %q", i, tc.Address)
+		}
+		timeoutsNode := valueNode(tn, "timeouts")
+		if tc.Timeouts.Connect < 0 {
+			return nil, configError(valueNode(timeoutsNode, "connect"), "targets[%d]: negative connect timeout", i)
+		}
+		if tc.Timeouts.Idle < 0 {
+			return nil, configError(valueNode(timeoutsNode, "idle"), "targets[%d]: negative idle timeout", i)
+		}
+		retryNode := valueNode(tn, "retry")
+		if tc.Retry.Attempts < 0 {
+			return nil, configError(valueNode(retryNode, "attempts"), "targets[%d]: negative retry attempts", i)
+		}
+		if tc.Retry.Backoff < 0 {
+			return nil, configError(valueNode(retryNode, "backoff"), "targets[%d]: negative retry backoff", i)
+		}
+		if len(tc.Ports) == 0 {
+			return nil, configError(tn, "targets[%d]: no ports", i)
+		}
+
+		namespace := tc.Namespace
+		if len(namespace) == 0 && len(tc.Kubeconfig) == 0 && len(tc.Context) == 0 {
+			namespace = defaultNamespace
+		}
+		byAddr := map[string]*target{}
+		var addrs []string
+		portsNode := valueNode(tn, "ports")
+		for j := range tc.Ports {
+			pc := &tc.Ports[j]
+			pn := itemNode(portsNode, j)
+			arg, err := pc.arg()
+			if err != nil {
+				return nil, configError(pn, "targets[%d].ports[%d]: %v", i, j, err)
+			}
+			addr := pc.Address
+			if len(addr) == 0 {
+				addr = tc.Address
+			}
+			if len(addr) == 0 {
+				addr = "127.0.0.1"
+			} else if net.ParseIP(addr) == nil {
+				return nil, configError(valueNode(pn, "address"), "targets[%d].ports[%d]: invalid address: %q", i, j, addr)
+			}
+
+			t, ok := byAddr[addr]
+			if !ok {
+				t = &target{
+					name:       tc.Name,
+					resource:   tc.Resource,
+					namespace:  namespace,
+					lisAddr:    addr,
+					allPods:    tc.AllPods,
+					host:       tc.Host,
+					path:       tc.Path,
+					kubeconfig: tc.Kubeconfig,
+					context:    tc.Context,
+					lb:         tc.LB,
+					readiness:  tc.Readiness,
+					opts: connOptions{
+						connectTimeout: tc.Timeouts.Connect,
+						idleTimeout:    tc.Timeouts.Idle,
+						attempts:       tc.Retry.Attempts,
+						backoff:        tc.Retry.Backoff,
+					},
+				}
+				byAddr[addr] = t
+				addrs = append(addrs, addr)
+			}
+			t.ports = append(t.ports, arg)
+		}
+
+		for _, addr := range addrs {
+			t := byAddr[addr]
+			err := validateFields(append([]string{t.resource}, t.ports...))
+			if err != nil {
+				return nil, configError(valueNode(tn, "resource"), "targets[%d]: %v", i, err)
+			}
+			ret = append(ret, *t)
+		}
+	}
+	return ret, nil
+}
+
+// valueNode returns the value of the key in a mapping node, or the mapping
+// itself if the key is absent, so that errors still point close to it.
+func valueNode(mapping *yaml.Node, key string) *yaml.Node {
+	mapping = resolveAlias(mapping)
+	if mapping.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(mapping.Content); i += 2 {
+			if mapping.Content[i].Value == key {
+				return resolveAlias(mapping.Content[i+1])
+			}
+		}
+	}
+	return mapping
+}
+
+// itemNode returns the i-th item of a sequence node, or the node itself if
+// it has no such item.
+func itemNode(seq *yaml.Node, i int) *yaml.Node {
+	seq = resolveAlias(seq)
+	if seq.Kind == yaml.SequenceNode && i < len(seq.Content) {
+		return resolveAlias(seq.Content[i])
+	}
+	return seq
+}
+
+// resolveAlias returns the node an alias refers to, errors then point at the
+// anchor.
+func resolveAlias(n *yaml.Node) *yaml.Node {
+	for n.Kind == yaml.AliasNode && n.Alias != nil {
+		n = n.Alias
+	}
+	return n
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadTargets(t *testing.T) {
+	testCases := map[string]struct {
+		input string
+
+		expect    []target
+		expectErr string
+	}{
+		"text": {
+			input: `
+# comment
+svc/web 8080:80
+`,
+			expect: []target{
+				{resource: "svc/web", ports: []string{"8080:80"}, namespace: "default", lisAddr: "127.0.0.1"},
+			},
+		},
+		"yaml": {
+			input: `
+# comment
+apiVersion: krelay/v1
+kind: RelayConfig
+targets:
+- name: web
+  resource: svc/web
+  lb: round-robin
+  ports:
+  - local: 8080
+    remote: http
+  - remote: 9090
+    address: 0.0.0.0
+  - local: 8443
+    remote: https
+- resource: svc/dns
+  context: staging
+  ports:
+  - local: 10053
+    remote: 53
+    protocol: udp
+  - local: 30053
+    remote: 53
+    nodePort: true
+`,
+			expect: []target{
+				{
+					name:      "web",
+					resource:  "svc/web",
+					ports:     []string{"8080:http", "8443:https"},
+					namespace: "default",
+					lisAddr:   "127.0.0.1",
+					lb:        "round-robin",
+				},
+				{
+					name:      "web",
+					resource:  "svc/web",
+					ports:     []string{"9090"},
+					namespace: "default",
+					lisAddr:   "0.0.0.0",
+					lb:        "round-robin",
+				},
+				{
+					resource: "svc/dns",
+					ports:    []string{"10053:53@udp", "nodeport:30053:53"},
+					lisAddr:  "127.0.0.1",
+					context:  "staging",
+				},
+			},
+		},
+		"timeouts and retry": {
+			input: `
+apiVersion: krelay/v1
+kind: RelayConfig
+targets:
+- resource: svc/web
+  timeouts: {connect: 5s, idle: 30m}
+  retry: {attempts: 3, backoff: 500ms}
+  ports: [{local: 8080}]
+`,
+			expect: []target{
+				{
+					resource:  "svc/web",
+					ports:     []string{"8080"},
+					namespace: "default",
+					lisAddr:   "127.0.0.1",
+					opts: connOptions{
+						connectTimeout: 5 * time.Second,
+						idleTimeout:    30 * time.Minute,
+						attempts:       3,
+						backoff:        500 * time.Millisecond,
+					},
+				},
+			},
+		},
+		"json": {
+			input: `{
+  "apiVersion": "krelay/v1",
+  "kind": "RelayConfig",
+  "targets": [
+    {"resource": "ingress/web", "host": "shop.example.com", "ports": [{"local": 8080}]}
+  ]
+}`,
+			expect: []target{
+				{resource: "ingress/web", ports: []string{"8080"}, namespace: "default", lisAddr: "127.0.0.1", host: "shop.example.com"},
+			},
+		},
+		"yaml aliases": {
+			input: `
+apiVersion: krelay/v1
+kind: RelayConfig
+targets:
+- &web
+  resource: svc/web
+  ports:
+  - &http {local: 8080, remote: http}
+- *web
+- resource: svc/api
+  ports: [*http]
+`,
+			expect: []target{
+				{resource: "svc/web", ports: []string{"8080:http"}, namespace: "default", lisAddr: "127.0.0.1"},
+				{resource: "svc/web", ports: []string{"8080:http"}, namespace: "default", lisAddr: "127.0.0.1"},
+				{resource: "svc/api", ports: []string{"8080:http"}, namespace: "default", lisAddr: "127.0.0.1"},
+			},
+		},
+
+		// invalid cases
+		"unknown field": {
+			input: `
+apiVersion: krelay/v1
+kind: RelayConfig
+targets:
+- resource: svc/web
+  timeout: 10s
+  ports:
+  - local: 8080
+`,
+			expectErr: "line 6: field timeout not found",
+		},
+		"unsupported version": {
+			input: `
+apiVersion: krelay/v2
+kind: RelayConfig
+`,
+			expectErr: `line 2, column 13: unsupported apiVersion "krelay/v2"`,
+		},
+		"duplicate name": {
+			input: `
+apiVersion: krelay/v1
+kind: RelayConfig
+targets:
+- name: web
+  resource: svc/web
+  ports: [{local: 8080}]
+- name: web
+  resource: svc/web
+  ports: [{local: 8081}]
+`,
+			expectErr: `line 8, column 9: targets[1]: name "web" is already used by targets[0]`,
+		},
+		"invalid lb": {
+			input: `
+apiVersion: krelay/v1
+kind: RelayConfig
+targets:
+- resource: svc/web
+  lb: fastest
+  ports: [{local: 8080}]
+`,
+			expectErr: "line 6, column 7: targets[0]: unknown",
+		},
+		"invalid protocol": {
+			input: `
+apiVersion: krelay/v1
+kind: RelayConfig
+targets:
+- resource: svc/web
+  ports:
+  - local: 8080
+  - local: 53
+    protocol: sctp
+`,
+			expectErr: `line 8, column 5: targets[0].ports[1]: unknown protocol: "sctp"`,
+		},
+		"invalid resource": {
+			input: `
+apiVersion: krelay/v1
+kind: RelayConfig
+targets:
+- resource: ip/1.2.3
+  ports: [{local: 8080}]
+`,
+			expectErr: `line 5, column 13: targets[0]: invalid IP address`,
+		},
+		"invalid aliased port": {
+			input: `
+apiVersion: krelay/v1
+kind: RelayConfig
+targets:
+- resource: svc/web
+  ports: [&udp {local: 53, protocol: sctp}]
+- resource: svc/dns
+  ports: [*udp]
+`,
+			expectErr: `line 6, column 11: targets[0].ports[0]: unknown protocol: "sctp"`,
+		},
+		"negative timeout": {
+			input: `
+apiVersion: krelay/v1
+kind: RelayConfig
+targets:
+- resource: svc/web
+  timeouts:
+    idle: -1s
+  ports: [{local: 8080}]
+`,
+			expectErr: "line 7, column 11: targets[0]: negative idle timeout",
+		},
+		"no ports": {
+			input: `
+apiVersion: krelay/v1
+kind: RelayConfig
+targets:
+- resource: svc/web
+`,
+			expectErr: "line 5, column 3: targets[0]: no ports",
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			got, err := loadTargets(strings.NewReader(tc.input), "default")
+			if len(tc.expectErr) == 0 {
+				require.NoError(t, err)
+				require.Equal(t, tc.expect, got)
+				return
+			}
+			require.ErrorContains(t, err, tc.expectErr)
+		})
+	}
+}
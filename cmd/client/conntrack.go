@@ -31,3 +31,13 @@ func (c *connTrack) Delete(key string) {
 	defer c.mu.Unlock()
 	delete(c.items, key)
 }
+
+// CloseAll closes every tracked channel and empties the table.
+func (c *connTrack) CloseAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, item := range c.items {
+		close(item)
+		delete(c.items, key)
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/knight42/krelay/pkg/constants"
+	slogutil "github.com/knight42/krelay/pkg/slog"
+)
+
+// targetStatus is a running target as reported by the control API.
+type targetStatus struct {
+	ID       int             `json:"id"`
+	Name     string          `json:"name"`
+	Resource string          `json:"resource"`
+	Manual   bool            `json:"manual"`
+	Forwards []forwardStatus `json:"forwards"`
+}
+
+type forwardStatus struct {
+	LocalAddr  string `json:"localAddr"`
+	Protocol   string `json:"protocol"`
+	RemotePort uint16 `json:"remotePort"`
+	// RemoteAddr is where the latest connection was forwarded to.
+	RemoteAddr  string `json:"remoteAddr,omitempty"`
+	ActiveConns int64  `json:"activeConns"`
+	TotalConns  uint64 `json:"totalConns"`
+}
+
+// serverStatus is the krelay-server of a cluster.
+type serverStatus struct {
+	Kubeconfig string `json:"kubeconfig,omitempty"`
+	Context    string `json:"context,omitempty"`
+	Namespace  string `json:"namespace"`
+	Job        string `json:"job,omitempty"`
+	Pod        string `json:"pod"`
+}
+
+func (rt *runningTarget) status() targetStatus {
+	ret := targetStatus{
+		ID:       rt.id,
+		Name:     cmp.Or(rt.spec.name, rt.spec.resource),
+		Resource: rt.spec.resource,
+		Manual:   rt.manual,
+		Forwards: []forwardStatus{},
+	}
+	for _, pf := range rt.forwarders {
+		localAddr := pf.localAddr()
+		if len(localAddr) == 0 {
+			continue
+		}
+		fs := forwardStatus{
+			LocalAddr:   localAddr,
+			Protocol:    pf.ports.Protocol,
+			RemotePort:  pf.ports.RemotePort,
+			ActiveConns: pf.activeConns.Load(),
+			TotalConns:  pf.totalConns.Load(),
+		}
+		if dst := pf.lastDst.Load(); dst != nil {
+			fs.RemoteAddr = dst.String()
+		}
+		ret.Forwards = append(ret.Forwards, fs)
+	}
+	return ret
+}
+
+// status returns the running targets in the order they were started.
+func (r *relay) status() []targetStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ret := make([]targetStatus, 0, len(r.running))
+	for _, rt := range r.running {
+		ret = append(ret, rt.status())
+	}
+	return ret
+}
+
+// servers returns the krelay-server of every cluster with a session.
+func (r *relay) servers() []serverStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ret := []serverStatus{}
+	for key, c := range r.clusters {
+		if c.sess == nil {
+			continue
+		}
+		ss := serverStatus{Kubeconfig: key.kubeconfig, Context: key.context}
+		ss.Namespace, ss.Job, ss.Pod = c.sess.serverPod()
+		ret = append(ret, ss)
+	}
+	return ret
+}
+
+// listenControl listens on "unix:PATH" or on a loopback "HOST:PORT", so that
+// only local clients can reach the control API.
+func listenControl(addr string) (net.Listener, error) {
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		// remove the socket left behind by a crashed client
+		if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			_ = os.Remove(path)
+		}
+		lis, err := net.Listen("unix", path)
+		if err != nil {
+			return nil, err
+		}
+		// only the user may reach the API, which has no token on sockets
+		err = os.Chmod(path, 0o600)
+		if err != nil {
+			_ = lis.Close()
+			return nil, err
+		}
+		return lis, nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, fmt.Errorf("control address is neither a loopback address nor a unix socket: %q", addr)
+	}
+	return net.Listen("tcp", addr)
+}
+
+// newControlToken returns the token of a control API listening on TCP: the one
+// in $KRELAY_CONTROL_TOKEN, or a generated one that is logged. The dashboard
+// hides the logs, so the variable is required with ui.
+func newControlToken(ui bool) (string, error) {
+	token := os.Getenv(constants.ControlTokenEnv)
+	if len(token) > 0 {
+		return token, nil
+	}
+	if ui {
+		return "", fmt.Errorf("--control on a TCP address requires $%s with --ui, which would hide the generated token", constants.ControlTokenEnv)
+	}
+	token = rand.Text()
+	slog.Info("Generated token of the control API", slog.String("token", token))
+	return token, nil
+}
+
+// controlHandler serves the control API of a relay:
+//
+//	GET    /forwards       lists the running targets and their forwards
+//	POST   /forwards       adds a target, e.g. {"target": "-n db svc/postgres 5432"}
+//	DELETE /forwards/{id}  removes a target
+//	GET    /servers        lists the krelay-server of every cluster
+//
+// A non-empty token is required as a bearer token, see controlGuard.
+func controlHandler(r *relay, defaultNamespace, token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /forwards", func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, http.StatusOK, r.status())
+	})
+	mux.HandleFunc("POST /forwards", func(w http.ResponseWriter, req *http.Request) {
+		var body struct {
+			// Target has the syntax of a line of the targets file.
+			Target string `json:"target"`
+		}
+		err := json.NewDecoder(req.Body).Decode(&body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("decode body: %w", err))
+			return
+		}
+		targets, err := parseTargetsFile(strings.NewReader(body.Target), defaultNamespace)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if len(targets) != 1 {
+			writeError(w, http.StatusBadRequest, errors.New("expect exactly one target"))
+			return
+		}
+		rt, err := r.add(targets[0])
+		if err != nil {
+			writeError(w, http.StatusUnprocessableEntity, err)
+			return
+		}
+		r.mu.Lock()
+		status := rt.status()
+		r.mu.Unlock()
+		writeJSON(w, http.StatusCreated, status)
+	})
+	mux.HandleFunc("DELETE /forwards/{id}", func(w http.ResponseWriter, req *http.Request) {
+		id, err := strconv.Atoi(req.PathValue("id"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid id: %q", req.PathValue("id")))
+			return
+		}
+		if !r.remove(id) {
+			writeError(w, http.StatusNotFound, fmt.Errorf("no target with id %d", id))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("GET /servers", func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, http.StatusOK, r.servers())
+	})
+	return controlGuard(mux, token)
+}
+
+// controlGuard protects the control API from web pages, which may send
+// "simple" cross-origin requests to loopback addresses, or reach them by DNS
+// rebinding: bodies have to be JSON, which such requests cannot send. With a
+// token, which is required on TCP, the Host has to be a loopback address too
+// and the token has to be sent as "Authorization: Bearer TOKEN". Unix sockets
+// rely on the permissions of the socket instead.
+func controlGuard(h http.Handler, token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if len(token) > 0 {
+			if !isLoopbackHost(req.Host) {
+				writeError(w, http.StatusForbidden, fmt.Errorf("host is not a loopback address: %q", req.Host))
+				return
+			}
+			got, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+				writeError(w, http.StatusUnauthorized, errors.New("missing or invalid token"))
+				return
+			}
+		}
+		if req.Method == http.MethodPost {
+			mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+			if mediaType != "application/json" {
+				writeError(w, http.StatusUnsupportedMediaType, errors.New("content type must be application/json"))
+				return
+			}
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+// isLoopbackHost reports whether the Host of a request is localhost or a
+// loopback address.
+func isLoopbackHost(hostPort string) bool {
+	host := hostPort
+	if h, _, err := net.SplitHostPort(hostPort); err == nil {
+		host = h
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip, err := netip.ParseAddr(strings.Trim(host, "[]"))
+	return err == nil && ip.IsLoopback()
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
+
+// serveHTTP serves h on lis until ctx is done, what names it in the logs. The
+// returned channel is closed once the server and its requests have finished.
+func serveHTTP(ctx context.Context, what string, lis net.Listener, h http.Handler) <-chan struct{} {
+	srv := &http.Server{Handler: h, ReadHeaderTimeout: 10 * time.Second}
+	done := make(chan struct{})
+	go func() {
+		slog.Info("Serving "+what, slog.String("address", lis.Addr().String()))
+		err := srv.Serve(lis)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Fail to serve "+what, slogutil.Error(err))
+		}
+	}()
+	context.AfterFunc(ctx, func() {
+		defer close(done)
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(shutdownCtx)
+	})
+	return done
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/knight42/krelay/pkg/constants"
+	"github.com/knight42/krelay/pkg/ports"
+	"github.com/knight42/krelay/pkg/remoteaddr"
+	"github.com/knight42/krelay/pkg/xnet"
+)
+
+func TestControlHandler(t *testing.T) {
+	addr, err := xnet.AddrFromIP("10.0.0.1")
+	require.NoError(t, err)
+	pf := &portForwarder{
+		addrGetter: remoteaddr.NewStaticAddr(addr),
+		ports:      ports.PortPair{LocalPort: 0, RemotePort: 80, Protocol: "tcp"},
+		listenAddr: "127.0.0.1",
+	}
+	require.NoError(t, pf.listen())
+	defer pf.close()
+	pf.connOpened("127.0.0.1:50000", xnet.AddrPortFrom(addr, 80))
+
+	r := newRelay(t.Context(), &Options{}, targetOptions{})
+	r.running = []*runningTarget{
+		{id: 1, spec: target{resource: "ip/10.0.0.1"}, forwarders: []*portForwarder{pf}, listening: true},
+	}
+	h := controlHandler(r, "default", "")
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := do(http.MethodGet, "/forwards", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var got []targetStatus
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &got))
+	require.Equal(t, []targetStatus{{
+		ID:       1,
+		Name:     "ip/10.0.0.1",
+		Resource: "ip/10.0.0.1",
+		Forwards: []forwardStatus{{
+			LocalAddr:   pf.localAddr(),
+			Protocol:    "tcp",
+			RemotePort:  80,
+			RemoteAddr:  "10.0.0.1:80",
+			ActiveConns: 1,
+			TotalConns:  1,
+		}},
+	}}, got)
+
+	rec = do(http.MethodPost, "/forwards", `{"target": "ip/1.2.3 8080"}`)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	require.Contains(t, rec.Body.String(), "invalid IP address")
+
+	rec = do(http.MethodGet, "/servers", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.JSONEq(t, `[]`, rec.Body.String())
+
+	rec = do(http.MethodDelete, "/forwards/2", "")
+	require.Equal(t, http.StatusNotFound, rec.Code)
+	rec = do(http.MethodDelete, "/forwards/1", "")
+	require.Equal(t, http.StatusNoContent, rec.Code)
+	require.Empty(t, r.running)
+
+	// the listener of the removed target is closed
+	_, err = net.Dial("tcp", got[0].Forwards[0].LocalAddr)
+	require.Error(t, err)
+}
+
+func TestControlGuard(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	testCases := map[string]struct {
+		token       string
+		host        string
+		auth        string
+		contentType string
+
+		expectCode int
+	}{
+		"unix socket": {
+			host:        "krelay",
+			contentType: "application/json",
+			expectCode:  http.StatusOK,
+		},
+		"form body": {
+			host:        "krelay",
+			contentType: "text/plain",
+			expectCode:  http.StatusUnsupportedMediaType,
+		},
+		"token": {
+			token:       "secret",
+			host:        "127.0.0.1:8080",
+			auth:        "Bearer secret",
+			contentType: "application/json; charset=utf-8",
+			expectCode:  http.StatusOK,
+		},
+		"missing token": {
+			token:       "secret",
+			host:        "localhost:8080",
+			contentType: "application/json",
+			expectCode:  http.StatusUnauthorized,
+		},
+		"rebound host": {
+			token:       "secret",
+			host:        "evil.example.com:8080",
+			auth:        "Bearer secret",
+			contentType: "application/json",
+			expectCode:  http.StatusForbidden,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/forwards", strings.NewReader("{}"))
+			req.Host = tc.host
+			req.Header.Set("Content-Type", tc.contentType)
+			if len(tc.auth) > 0 {
+				req.Header.Set("Authorization", tc.auth)
+			}
+			rec := httptest.NewRecorder()
+			controlGuard(ok, tc.token).ServeHTTP(rec, req)
+			require.Equal(t, tc.expectCode, rec.Code)
+		})
+	}
+}
+
+func TestListenControl(t *testing.T) {
+	_, err := listenControl("0.0.0.0:0")
+	require.ErrorContains(t, err, "neither a loopback address nor a unix socket")
+
+	lis, err := listenControl("127.0.0.1:0")
+	require.NoError(t, err)
+	_ = lis.Close()
+}
+
+func TestNewControlToken(t *testing.T) {
+	t.Setenv(constants.ControlTokenEnv, "")
+	token, err := newControlToken(false)
+	require.NoError(t, err)
+	require.NotEmpty(t, token)
+	_, err = newControlToken(true)
+	require.ErrorContains(t, err, constants.ControlTokenEnv)
+
+	t.Setenv(constants.ControlTokenEnv, "s3cr3t")
+	token, err = newControlToken(true)
+	require.NoError(t, err)
+	require.Equal(t, "s3cr3t", token)
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/mattn/go-runewidth"
+	"k8s.io/apimachinery/pkg/util/duration"
+	"k8s.io/klog/v2"
+
+	"github.com/knight42/krelay/pkg/remoteaddr"
+)
+
+const (
+	dashboardRefresh = time.Second
+	// dashboardLogLines is the number of log lines kept for the bottom pane.
+	dashboardLogLines = 200
+)
+
+// dashboard renders the forwards of a relay and their connections in the
+// terminal, see --ui.
+type dashboard struct {
+	r      *relay
+	screen tcell.Screen
+	logs   *logBuffer
+
+	forwards []*portForwarder
+	// selected is the row of forwards, or of conns if detail is set.
+	selected int
+	// detail is the forwarder whose connections are shown, or nil.
+	detail *portForwarder
+	conns  []*connStats
+	// searching is true while the user types the query of a search by
+	// request ID, started with '/'. status reports a search that failed.
+	searching bool
+	query     string
+	status    string
+
+	// rates are computed from the byte counts of the previous refresh.
+	lastBytes map[*portForwarder][2]uint64
+	lastTime  time.Time
+	rates     map[*portForwarder][2]float64
+}
+
+func newDashboard(r *relay, screen tcell.Screen) *dashboard {
+	return &dashboard{
+		r:         r,
+		screen:    screen,
+		logs:      &logBuffer{},
+		lastBytes: map[*portForwarder][2]uint64{},
+		rates:     map[*portForwarder][2]float64{},
+	}
+}
+
+// runDashboard takes over the terminal until ctx is done or the user quits.
+// The logs are shown in the bottom pane in the meantime.
+func runDashboard(ctx context.Context, r *relay) error {
+	screen, err := tcell.NewScreen()
+	if err != nil {
+		return err
+	}
+	err = screen.Init()
+	if err != nil {
+		return err
+	}
+	defer screen.Fini()
+
+	d := newDashboard(r, screen)
+	log.SetOutput(d.logs)
+	klog.LogToStderr(false)
+	klog.SetOutput(d.logs)
+	defer func() {
+		log.SetOutput(os.Stderr)
+		klog.SetOutput(os.Stderr)
+		klog.LogToStderr(true)
+	}()
+	return d.run(ctx)
+}
+
+func (d *dashboard) run(ctx context.Context) error {
+	events := make(chan tcell.Event)
+	quit := make(chan struct{})
+	defer close(quit)
+	go d.screen.ChannelEvents(events, quit)
+
+	ticker := time.NewTicker(dashboardRefresh)
+	defer ticker.Stop()
+	d.refresh(time.Now())
+	d.draw()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			d.refresh(time.Now())
+		case ev := <-events:
+			if !d.handle(ev) {
+				return nil
+			}
+		}
+		d.draw()
+	}
+}
+
+// handle reacts to an event, it returns false if the user quits.
+func (d *dashboard) handle(ev tcell.Event) bool {
+	switch ev := ev.(type) {
+	case *tcell.EventResize:
+		d.screen.Sync()
+	case *tcell.EventKey:
+		if d.searching {
+			d.handleSearch(ev)
+			return true
+		}
+		d.status = ""
+		rows := len(d.forwards)
+		if d.detail != nil {
+			rows = len(d.conns)
+		}
+		switch ev.Key() {
+		case tcell.KeyCtrlC:
+			return false
+		case tcell.KeyUp:
+			d.selected = max(d.selected-1, 0)
+		case tcell.KeyDown:
+			d.selected = max(min(d.selected+1, rows-1), 0)
+		case tcell.KeyEnter:
+			d.open()
+		case tcell.KeyEscape, tcell.KeyBackspace, tcell.KeyBackspace2:
+			d.back()
+		case tcell.KeyRune:
+			switch ev.Rune() {
+			case 'q':
+				return false
+			case 'k':
+				d.selected = max(d.selected-1, 0)
+			case 'j':
+				d.selected = max(min(d.selected+1, rows-1), 0)
+			case 'c':
+				d.open()
+			case '/':
+				d.searching = true
+				d.query = ""
+			}
+		}
+	}
+	return true
+}
+
+// handleSearch edits the query of a search by request ID, which runs on
+// enter.
+func (d *dashboard) handleSearch(ev *tcell.EventKey) {
+	switch ev.Key() {
+	case tcell.KeyEnter:
+		d.searching = false
+		d.find(d.query)
+	case tcell.KeyEscape, tcell.KeyCtrlC:
+		d.searching = false
+	case tcell.KeyBackspace, tcell.KeyBackspace2:
+		if len(d.query) > 0 {
+			d.query = d.query[:len(d.query)-1]
+		}
+	case tcell.KeyRune:
+		d.query += string(ev.Rune())
+	}
+}
+
+// find shows the connections of the forwarder holding the connection whose
+// request ID starts with query, with that connection selected.
+func (d *dashboard) find(query string) {
+	if len(query) == 0 {
+		return
+	}
+	for _, pf := range d.forwards {
+		conns := pf.conns.list()
+		idx := slices.IndexFunc(conns, func(st *connStats) bool {
+			return strings.HasPrefix(st.requestID, query)
+		})
+		if idx >= 0 {
+			d.detail = pf
+			d.conns = conns
+			d.selected = idx
+			return
+		}
+	}
+	d.status = fmt.Sprintf("no open connection with request ID %s", query)
+}
+
+// open shows the connections of the selected forwarder.
+func (d *dashboard) open() {
+	if d.detail != nil || d.selected >= len(d.forwards) {
+		return
+	}
+	d.detail = d.forwards[d.selected]
+	d.conns = d.detail.conns.list()
+	d.selected = 0
+}
+
+// back returns to the forwarders, with the one that was open selected.
+func (d *dashboard) back() {
+	if d.detail == nil {
+		return
+	}
+	d.selected = max(0, slices.Index(d.forwards, d.detail))
+	d.detail = nil
+	d.conns = nil
+}
+
+// refresh reads the forwarders of the relay and updates the rates.
+func (d *dashboard) refresh(now time.Time) {
+	var forwards []*portForwarder
+	d.r.mu.Lock()
+	for _, rt := range d.r.running {
+		for _, pf := range rt.forwarders {
+			if len(pf.localAddr()) > 0 {
+				forwards = append(forwards, pf)
+			}
+		}
+	}
+	d.r.mu.Unlock()
+
+	elapsed := now.Sub(d.lastTime).Seconds()
+	lastBytes := make(map[*portForwarder][2]uint64, len(forwards))
+	for _, pf := range forwards {
+		cur := [2]uint64{pf.bytesIn.Load(), pf.bytesOut.Load()}
+		lastBytes[pf] = cur
+		prev, ok := d.lastBytes[pf]
+		if !ok || elapsed <= 0 {
+			continue
+		}
+		d.rates[pf] = [2]float64{
+			float64(cur[0]-prev[0]) / elapsed,
+			float64(cur[1]-prev[1]) / elapsed,
+		}
+	}
+	for pf := range d.rates {
+		if _, ok := lastBytes[pf]; !ok {
+			delete(d.rates, pf)
+		}
+	}
+	d.lastBytes = lastBytes
+	d.lastTime = now
+	d.forwards = forwards
+
+	if d.detail != nil {
+		if slices.Index(forwards, d.detail) < 0 {
+			// the target has been removed
+			d.detail = nil
+			d.conns = nil
+			d.selected = 0
+		} else {
+			d.conns = d.detail.conns.list()
+		}
+	}
+	rows := len(d.forwards)
+	if d.detail != nil {
+		rows = len(d.conns)
+	}
+	d.selected = max(min(d.selected, rows-1), 0)
+}
+
+func (d *dashboard) draw() {
+	s := d.screen
+	s.Clear()
+	width, height := s.Size()
+	bold := tcell.StyleDefault.Bold(true)
+
+	var (
+		title  string
+		header []string
+		rows   [][]string
+	)
+	if d.detail == nil {
+		title = fmt.Sprintf("krelay - %d forwards  [enter] connections  [/] find request ID  [q] quit", len(d.forwards))
+		header = []string{"LOCAL", "TARGET", "REMOTE", "PROTO", "CONNS", "IN", "OUT", "IN/s", "OUT/s", "LAST ERROR"}
+		for _, pf := range d.forwards {
+			rows = append(rows, d.forwardRow(pf))
+		}
+	} else {
+		title = fmt.Sprintf("krelay - %s %s %s - %d connections  [esc] back  [/] find request ID  [q] quit",
+			d.detail.name, d.detail.localAddr(), d.detail.ports.Protocol, len(d.conns))
+		header = []string{"REQUEST ID", "CLIENT", "DESTINATION", "AGE", "IN", "OUT", "ERROR"}
+		now := time.Now()
+		for _, st := range d.conns {
+			rows = append(rows, connRow(st, now))
+		}
+	}
+
+	switch {
+	case d.searching:
+		title = "find request ID: /" + d.query
+	case len(d.status) > 0:
+		title = d.status
+	}
+	drawText(s, 0, 0, width, bold, title)
+	// the logs take the bottom third of the screen
+	logsHeight := height / 3
+	tableHeight := height - logsHeight - 1
+	widths := columnWidths(header, rows)
+	drawRow(s, 1, width, widths, bold.Reverse(true), header)
+	// scroll to keep the selected row visible
+	first := max(0, d.selected-(tableHeight-2)+1)
+	for i := first; i < len(rows) && 2+i-first < tableHeight; i++ {
+		style := tcell.StyleDefault
+		if i == d.selected {
+			style = style.Reverse(true)
+		}
+		drawRow(s, 2+i-first, width, widths, style, rows[i])
+	}
+
+	drawText(s, 0, tableHeight, width, bold, "LOGS")
+	lines := d.logs.last(logsHeight - 1)
+	for i, line := range lines {
+		drawText(s, 0, tableHeight+1+i, width, tcell.StyleDefault, line)
+	}
+	s.Show()
+}
+
+func (d *dashboard) forwardRow(pf *portForwarder) []string {
+	remote := "-"
+	if dst := pf.lastDst.Load(); dst != nil {
+		remote = dst.String()
+		if pod := remoteaddr.PodName(pf.addrGetter, dst.Addr()); len(pod) > 0 {
+			remote = pod + " (" + remote + ")"
+		}
+	}
+	lastErr := ""
+	if msg := pf.lastErr.Load(); msg != nil {
+		lastErr = *msg
+	}
+	rates := d.rates[pf]
+	return []string{
+		pf.localAddr(),
+		pf.name,
+		remote,
+		pf.ports.Protocol,
+		fmt.Sprintf("%d/%d", pf.activeConns.Load(), pf.totalConns.Load()),
+		formatBytes(float64(pf.bytesIn.Load())),
+		formatBytes(float64(pf.bytesOut.Load())),
+		formatBytes(rates[0]),
+		formatBytes(rates[1]),
+		lastErr,
+	}
+}
+
+func connRow(st *connStats, now time.Time) []string {
+	lastErr := ""
+	if msg := st.lastErr.Load(); msg != nil {
+		lastErr = *msg
+	}
+	return []string{
+		st.requestID,
+		st.clientAddr,
+		st.destination().String(),
+		duration.HumanDuration(now.Sub(st.started)),
+		formatBytes(float64(st.bytesIn.Load())),
+		formatBytes(float64(st.bytesOut.Load())),
+		lastErr,
+	}
+}
+
+// columnWidths fits the columns to their widest cell.
+func columnWidths(header []string, rows [][]string) []int {
+	widths := make([]int, len(header))
+	for i, h := range header {
+		widths[i] = runewidth.StringWidth(h)
+	}
+	for _, row := range rows {
+		for i, cell := range row {
+			widths[i] = max(widths[i], runewidth.StringWidth(cell))
+		}
+	}
+	return widths
+}
+
+func drawRow(s tcell.Screen, y, width int, widths []int, style tcell.Style, cells []string) {
+	x := 0
+	for i, cell := range cells {
+		if x >= width {
+			return
+		}
+		drawText(s, x, y, width, style, cell)
+		x += widths[i] + 2
+	}
+}
+
+// drawText draws text at (x, y), cutting it at the given width.
+func drawText(s tcell.Screen, x, y, width int, style tcell.Style, text string) {
+	for _, r := range text {
+		w := runewidth.RuneWidth(r)
+		if x+w > width {
+			return
+		}
+		s.SetContent(x, y, r, nil, style)
+		x += w
+	}
+}
+
+// formatBytes formats n bytes with a binary unit, e.g. 1.5KiB.
+func formatBytes(n float64) string {
+	const units = "KMGTPE"
+	if n < 1024 {
+		return fmt.Sprintf("%.0fB", n)
+	}
+	i := -1
+	for n >= 1024 && i < len(units)-1 {
+		n /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f%ciB", n, units[i])
+}
+
+// logBuffer keeps the last lines written to it.
+type logBuffer struct {
+	mu      sync.Mutex
+	lines   []string
+	partial string
+}
+
+var _ io.Writer = (*logBuffer)(nil)
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	lines := strings.Split(b.partial+string(p), "\n")
+	b.partial = lines[len(lines)-1]
+	b.lines = append(b.lines, lines[:len(lines)-1]...)
+	if len(b.lines) > dashboardLogLines {
+		b.lines = b.lines[len(b.lines)-dashboardLogLines:]
+	}
+	return len(p), nil
+}
+
+// last returns up to n of the latest lines.
+func (b *logBuffer) last(n int) []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if n <= 0 {
+		return nil
+	}
+	return append([]string(nil), b.lines[max(0, len(b.lines)-n):]...)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/stretchr/testify/require"
+
+	"github.com/knight42/krelay/pkg/ports"
+	"github.com/knight42/krelay/pkg/remoteaddr"
+	"github.com/knight42/krelay/pkg/xnet"
+)
+
+func screenText(s tcell.SimulationScreen) string {
+	cells, width, _ := s.GetContents()
+	var b strings.Builder
+	for i, c := range cells {
+		if len(c.Runes) > 0 {
+			b.WriteRune(c.Runes[0])
+		}
+		if (i+1)%width == 0 {
+			b.WriteByte('\n')
+		}
+	}
+	return b.String()
+}
+
+func TestDashboard(t *testing.T) {
+	r := require.New(t)
+	addr, err := xnet.AddrFromIP("10.0.0.1")
+	r.NoError(err)
+	pf := &portForwarder{
+		name:       "ip/10.0.0.1",
+		addrGetter: remoteaddr.NewStaticAddr(addr),
+		ports:      ports.PortPair{LocalPort: 0, RemotePort: 80, Protocol: "tcp"},
+		listenAddr: "127.0.0.1",
+	}
+	r.NoError(pf.listen())
+	defer pf.close()
+	st := pf.connOpened("127.0.0.1:50000", xnet.AddrPortFrom(addr, 80))
+	st.addIn(2048)
+	st.addOut(10)
+	st.fail(errors.New("connection reset"))
+
+	rl := newRelay(t.Context(), &Options{}, targetOptions{})
+	rl.running = []*runningTarget{
+		{id: 1, spec: target{resource: "ip/10.0.0.1"}, forwarders: []*portForwarder{pf}, listening: true},
+	}
+
+	screen := tcell.NewSimulationScreen("")
+	r.NoError(screen.Init())
+	defer screen.Fini()
+	screen.SetSize(160, 30)
+	d := newDashboard(rl, screen)
+	_, _ = d.logs.Write([]byte("first line\nsecond line\n"))
+
+	now := time.Now()
+	d.refresh(now)
+	st.addIn(1024)
+	d.refresh(now.Add(time.Second))
+	d.draw()
+	text := screenText(screen)
+	r.Contains(text, pf.localAddr())
+	r.Contains(text, "10.0.0.1:80")
+	r.Contains(text, "1/1")
+	r.Contains(text, "3.0KiB")
+	r.Contains(text, "1.0KiB")
+	r.Contains(text, "connection reset")
+	r.Contains(text, "second line")
+
+	r.True(d.handle(tcell.NewEventKey(tcell.KeyEnter, 0, tcell.ModNone)))
+	d.draw()
+	text = screenText(screen)
+	r.Contains(text, st.requestID)
+	r.Contains(text, "127.0.0.1:50000")
+
+	r.True(d.handle(tcell.NewEventKey(tcell.KeyEscape, 0, tcell.ModNone)))
+	r.Nil(d.detail)
+
+	// search by a prefix of the request ID
+	r.True(d.handle(tcell.NewEventKey(tcell.KeyRune, '/', tcell.ModNone)))
+	for _, c := range st.requestID[:4] + "x" {
+		r.True(d.handle(tcell.NewEventKey(tcell.KeyRune, c, tcell.ModNone)))
+	}
+	r.True(d.handle(tcell.NewEventKey(tcell.KeyBackspace2, 0, tcell.ModNone)))
+	d.draw()
+	r.Contains(screenText(screen), "/"+st.requestID[:4])
+	r.True(d.handle(tcell.NewEventKey(tcell.KeyEnter, 0, tcell.ModNone)))
+	r.Equal(pf, d.detail)
+	r.Equal(0, d.selected)
+
+	r.True(d.handle(tcell.NewEventKey(tcell.KeyEscape, 0, tcell.ModNone)))
+	r.True(d.handle(tcell.NewEventKey(tcell.KeyRune, '/', tcell.ModNone)))
+	r.True(d.handle(tcell.NewEventKey(tcell.KeyRune, '#', tcell.ModNone)))
+	r.True(d.handle(tcell.NewEventKey(tcell.KeyEnter, 0, tcell.ModNone)))
+	r.Nil(d.detail)
+	d.draw()
+	r.Contains(screenText(screen), "no open connection with request ID #")
+	r.False(d.handle(tcell.NewEventKey(tcell.KeyRune, 'q', tcell.ModNone)))
+}
+
+func TestFormatBytes(t *testing.T) {
+	testCases := map[string]struct {
+		n    float64
+		want string
+	}{
+		"bytes": {n: 1023, want: "1023B"},
+		"kib":   {n: 1536, want: "1.5KiB"},
+		"gib":   {n: 3 << 30, want: "3.0GiB"},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			require.Equal(t, tc.want, formatBytes(tc.n))
+		})
+	}
+}
@@ -5,10 +5,11 @@ import (
 	"log/slog"
 	"net"
 	"strconv"
-
-	"k8s.io/streaming/pkg/httpstream"
+	"sync/atomic"
+	"time"
 
 	"github.com/knight42/krelay/pkg/constants"
+	"github.com/knight42/krelay/pkg/metrics"
 	"github.com/knight42/krelay/pkg/ports"
 	"github.com/knight42/krelay/pkg/remoteaddr"
 	slogutil "github.com/knight42/krelay/pkg/slog"
@@ -16,12 +17,91 @@ import (
 )
 
 type portForwarder struct {
+	// name is the name of the target, used in the logs.
+	name       string
 	addrGetter remoteaddr.Getter
 	ports      ports.PortPair
 	listenAddr string
+	opts       connOptions
 
 	tcpListener net.Listener
 	udpListener net.PacketConn
+
+	// activeConns and totalConns count the TCP connections, or UDP flows,
+	// and lastDst is where the latest one was forwarded to.
+	activeConns atomic.Int64
+	totalConns  atomic.Uint64
+	lastDst     atomic.Pointer[xnet.AddrPort]
+	// bytesIn and bytesOut add up the bytes of all the connections.
+	bytesIn  atomic.Uint64
+	bytesOut atomic.Uint64
+	lastErr  atomic.Pointer[string]
+	conns    connTable
+
+	// metrics is set by listen.
+	metrics *metrics.Forward
+}
+
+// connOptions tune the connections of a forwarder, see the timeouts and
+// retry of a RelayConfig target.
+type connOptions struct {
+	// connectTimeout limits opening a connection, from creating the stream
+	// until the ack of krelay-server.
+	connectTimeout time.Duration
+	// idleTimeout closes connections, and UDP flows, without traffic for
+	// this long.
+	idleTimeout time.Duration
+	// attempts is the number of times opening a TCP connection is tried,
+	// waiting backoff before the second attempt and twice as long after
+	// each further one.
+	attempts int
+	backoff  time.Duration
+}
+
+// connOpened records a new connection from clientAddr to dst. connClosed has
+// to be called when it is closed.
+func (p *portForwarder) connOpened(clientAddr string, dst xnet.AddrPort) *connStats {
+	st := &connStats{
+		pf:         p,
+		requestID:  xnet.NewRequestID(),
+		clientAddr: clientAddr,
+		started:    time.Now(),
+	}
+	st.dst.Store(&dst)
+	p.conns.add(st)
+	p.activeConns.Add(1)
+	p.totalConns.Add(1)
+	p.lastDst.Store(&dst)
+	if p.metrics != nil {
+		p.metrics.Opened.Inc()
+	}
+	return st
+}
+
+func (p *portForwarder) connClosed(st *connStats) {
+	p.conns.remove(st)
+	p.activeConns.Add(-1)
+	if p.metrics != nil {
+		p.metrics.Closed.Inc()
+	}
+	remoteaddr.Done(p.addrGetter, st.destination().Addr())
+}
+
+// fail records the latest error of the forwarder.
+func (p *portForwarder) fail(err error) {
+	msg := err.Error()
+	p.lastErr.Store(&msg)
+}
+
+// localAddr returns the address the forwarder listens on.
+func (p *portForwarder) localAddr() string {
+	switch {
+	case p.tcpListener != nil:
+		return p.tcpListener.Addr().String()
+	case p.udpListener != nil:
+		return p.udpListener.LocalAddr().String()
+	}
+	return ""
 }
 
 func (p *portForwarder) listen() error {
@@ -42,10 +122,21 @@ func (p *portForwarder) listen() error {
 	default:
 		return fmt.Errorf("unknown protocol: %s", p.ports.Protocol)
 	}
+	p.metrics = metrics.NewForward(p.name, p.localAddr(), p.ports.Protocol)
 	return nil
 }
 
-func (p *portForwarder) run(streamConn httpstream.Connection) {
+// close stops accepting new connections and packets.
+func (p *portForwarder) close() {
+	if p.tcpListener != nil {
+		_ = p.tcpListener.Close()
+	}
+	if p.udpListener != nil {
+		_ = p.udpListener.Close()
+	}
+}
+
+func (p *portForwarder) run(sess *session) {
 	switch {
 	case p.tcpListener != nil:
 		lis := p.tcpListener
@@ -53,6 +144,7 @@ func (p *portForwarder) run(streamConn httpstream.Connection) {
 
 		localAddr := lis.Addr().String()
 		l := slog.With(
+			slog.String(constants.LogFieldTarget, p.name),
 			slog.String(constants.LogFieldProtocol, p.ports.Protocol),
 			slog.String(constants.LogFieldLocalAddr, localAddr),
 		)
@@ -61,25 +153,26 @@ func (p *portForwarder) run(streamConn httpstream.Connection) {
 		)
 
 		for {
-			select {
-			case <-streamConn.CloseChan():
-				return
-			default:
-			}
-
 			c, err := lis.Accept()
 			if err != nil {
-				l.Error("Fail to accept tcp connection", slogutil.Error(err))
+				if !xnet.IsClosedConnectionError(err) {
+					l.Error("Fail to accept tcp connection", slogutil.Error(err))
+				}
 				return
 			}
 
-			remoteAddr, err := p.addrGetter.Get()
+			dst, err := remoteaddr.GetAddrPort(p.addrGetter, p.ports.RemotePort, p.ports.Protocol)
 			if err != nil {
 				_ = c.Close()
+				p.fail(err)
 				l.Error("Fail to get remote address", slogutil.Error(err))
 				continue
 			}
-			go handleTCPConn(c, streamConn, xnet.AddrPortFrom(remoteAddr, p.ports.RemotePort))
+			st := p.connOpened(c.RemoteAddr().String(), dst)
+			go func() {
+				defer p.connClosed(st)
+				handleTCPConn(c, sess.ServerConn(), dst, st)
+			}()
 		}
 
 	case p.udpListener != nil:
@@ -89,6 +182,7 @@ func (p *portForwarder) run(streamConn httpstream.Connection) {
 		udpConn := &xnet.UDPConn{UDPConn: pc.(*net.UDPConn)}
 		localAddr := pc.LocalAddr().String()
 		l := slog.With(
+			slog.String(constants.LogFieldTarget, p.name),
 			slog.String(constants.LogFieldProtocol, p.ports.Protocol),
 			slog.String(constants.LogFieldLocalAddr, localAddr),
 		)
@@ -101,6 +195,7 @@ func (p *portForwarder) run(streamConn httpstream.Connection) {
 		go func() {
 			for key := range finish {
 				track.Delete(key)
+				p.metrics.ConntrackEntries.Dec()
 				l.Debug("Remove udp conn from conntrack table",
 					slog.String("key", key),
 				)
@@ -112,17 +207,13 @@ func (p *portForwarder) run(streamConn httpstream.Connection) {
 
 		buf := make([]byte, constants.UDPBufferSize)
 		for {
-			select {
-			case <-streamConn.CloseChan():
-				return
-			default:
-			}
-
 			n, cliAddr, err := udpConn.ReadFrom(buf)
 			if err != nil {
-				l.Error("Fail to read udp packet",
-					slogutil.Error(err),
-				)
+				if !xnet.IsClosedConnectionError(err) {
+					l.Error("Fail to read udp packet",
+						slogutil.Error(err),
+					)
+				}
 				return
 			}
 			data := make([]byte, n)
@@ -133,16 +224,23 @@ func (p *portForwarder) run(streamConn httpstream.Connection) {
 			var dataCh chan []byte
 			v, ok := track.Get(key)
 			if !ok {
-				dataCh = make(chan []byte)
-				track.Set(key, dataCh)
-				remoteAddr, err := p.addrGetter.Get()
+				dst, err := remoteaddr.GetAddrPort(p.addrGetter, p.ports.RemotePort, p.ports.Protocol)
 				if err != nil {
+					p.fail(err)
 					l.Error("Fail to get remote address",
 						slogutil.Error(err),
 					)
 					continue
 				}
-				go handleUDPConn(udpConn, cliAddr, dataCh, finish, streamConn, xnet.AddrPortFrom(remoteAddr, p.ports.RemotePort))
+				dataCh = make(chan []byte)
+				track.Set(key, dataCh)
+				p.metrics.ConntrackEntries.Inc()
+				st := p.connOpened(key, dst)
+				go func() {
+					handleUDPConn(udpConn, cliAddr, dataCh, sess.ServerConn(), dst, st)
+					p.connClosed(st)
+					finish <- key
+				}()
 			} else {
 				dataCh = v
 			}
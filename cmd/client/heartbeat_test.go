@@ -69,7 +69,7 @@ func TestSendHeartbeats_CloseChan(t *testing.T) {
 
 	done := make(chan struct{})
 	go func() {
-		sendHeartbeats(conn, 10*time.Millisecond)
+		sendHeartbeats(serverConn{Connection: conn}, 10*time.Millisecond)
 		close(done)
 	}()
 
@@ -86,7 +86,7 @@ func TestSendHeartbeats_SendsHeartbeats(t *testing.T) {
 
 	done := make(chan struct{})
 	go func() {
-		sendHeartbeats(conn, 10*time.Millisecond)
+		sendHeartbeats(serverConn{Connection: conn}, 10*time.Millisecond)
 		close(done)
 	}()
 
@@ -105,7 +105,7 @@ func TestSendHeartbeats_CreateStreamError(t *testing.T) {
 
 	done := make(chan struct{})
 	go func() {
-		sendHeartbeats(conn, 10*time.Millisecond)
+		sendHeartbeats(serverConn{Connection: conn}, 10*time.Millisecond)
 		close(done)
 	}()
 
@@ -122,7 +122,7 @@ func TestSendHeartbeats_WriteError(t *testing.T) {
 
 	done := make(chan struct{})
 	go func() {
-		sendHeartbeats(conn, 10*time.Millisecond)
+		sendHeartbeats(serverConn{Connection: conn}, 10*time.Millisecond)
 		close(done)
 	}()
 
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	slogutil "github.com/knight42/krelay/pkg/slog"
+	"github.com/knight42/krelay/pkg/xnet"
+)
+
+// bufferedConn reads from r before falling back to the underlying connection,
+// so that the bytes consumed by sniffing or parsing are not lost.
+type bufferedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// handleProxyConn serves SOCKS5 or HTTP on the same port, depending on the first
+// byte sent by the client.
+func handleProxyConn(clientConn net.Conn, serverConn serverConn, auth *proxyAuth) {
+	br := bufio.NewReader(clientConn)
+	first, err := br.Peek(1)
+	if err != nil {
+		_ = clientConn.Close()
+		return
+	}
+	conn := &bufferedConn{Conn: clientConn, r: br}
+	if first[0] == 5 {
+		handleSOCKS5Conn(conn, serverConn, auth)
+		return
+	}
+	handleHTTPProxyConn(conn, br, serverConn, auth)
+}
+
+// addrPortFromHostPort parses host:port, using defaultPort if the port is
+// missing. Hostnames are resolved by krelay-server.
+func addrPortFromHostPort(hostport string, defaultPort uint16) (xnet.AddrPort, error) {
+	host, portStr, err := net.SplitHostPort(hostport)
+	if err != nil {
+		if defaultPort == 0 {
+			return xnet.AddrPort{}, err
+		}
+		host = strings.Trim(hostport, "[]")
+		portStr = strconv.Itoa(int(defaultPort))
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return xnet.AddrPort{}, fmt.Errorf("invalid port: %q", portStr)
+	}
+	addr, err := xnet.AddrFromIP(host)
+	if err != nil {
+		addr = xnet.AddrFromHost(host)
+	}
+	return xnet.AddrPortFrom(addr, uint16(port)), nil
+}
+
+// authorizedHTTP checks the Proxy-Authorization header of req.
+func authorizedHTTP(req *http.Request, auth *proxyAuth) bool {
+	if auth == nil {
+		return true
+	}
+	scheme, encoded, ok := strings.Cut(req.Header.Get("Proxy-Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Basic") {
+		return false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return false
+	}
+	user, password, ok := strings.Cut(string(decoded), ":")
+	return ok && auth.verify(user, password)
+}
+
+func writeHTTPError(w io.Writer, code int, header http.Header) {
+	resp := &http.Response{
+		StatusCode: code,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     header,
+		Close:      true,
+	}
+	_ = resp.Write(w)
+}
+
+// handleHTTPProxyConn serves a CONNECT request, or forwards a request with an
+// absolute URI. Either way the connection is then relayed by handleTCPConn.
+func handleHTTPProxyConn(clientConn net.Conn, br *bufio.Reader, serverConn serverConn, auth *proxyAuth) {
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		_ = clientConn.Close()
+		slog.Error("Fail to read http request", slogutil.Error(err))
+		return
+	}
+
+	if !authorizedHTTP(req, auth) {
+		writeHTTPError(clientConn, http.StatusProxyAuthRequired, http.Header{
+			"Proxy-Authenticate": []string{`Basic realm="krelay"`},
+		})
+		_ = clientConn.Close()
+		slog.Error("Reject unauthorized http request", slog.String("clientAddr", clientConn.RemoteAddr().String()))
+		return
+	}
+
+	if req.Method == http.MethodConnect {
+		ap, err := addrPortFromHostPort(req.Host, 0)
+		if err != nil {
+			writeHTTPError(clientConn, http.StatusBadRequest, nil)
+			_ = clientConn.Close()
+			slog.Error("Invalid CONNECT request", slog.String("host", req.Host), slogutil.Error(err))
+			return
+		}
+		_, err = io.WriteString(clientConn, "HTTP/1.1 200 Connection established\r\n\r\n")
+		if err != nil {
+			_ = clientConn.Close()
+			return
+		}
+		handleTCPConn(clientConn, serverConn, ap, nil)
+		return
+	}
+
+	if req.URL.Scheme != "http" || len(req.URL.Host) == 0 {
+		writeHTTPError(clientConn, http.StatusBadRequest, nil)
+		_ = clientConn.Close()
+		slog.Error("Only absolute http URIs can be forwarded", slog.String("uri", req.RequestURI))
+		return
+	}
+	ap, err := addrPortFromHostPort(req.URL.Host, 80)
+	if err != nil {
+		writeHTTPError(clientConn, http.StatusBadRequest, nil)
+		_ = clientConn.Close()
+		slog.Error("Invalid request URI", slog.String("uri", req.RequestURI), slogutil.Error(err))
+		return
+	}
+
+	// Only one request is forwarded per connection, since the following ones
+	// may be sent to another host.
+	req.Header.Del("Proxy-Authorization")
+	req.Header.Del("Proxy-Connection")
+	req.Close = true
+	// Stream the rewritten request, including its body, ahead of whatever the
+	// client sends next.
+	pr, pw := io.Pipe()
+	go func() {
+		_ = pw.CloseWithError(req.Write(pw))
+	}()
+	handleTCPConn(&bufferedConn{Conn: clientConn, r: io.MultiReader(pr, br)}, serverConn, ap, nil)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAddrPortFromHostPort(t *testing.T) {
+	testCases := map[string]struct {
+		hostport    string
+		defaultPort uint16
+
+		expect    string
+		expectErr bool
+	}{
+		"host and port": {
+			hostport: "web.default.svc:8080",
+			expect:   "web.default.svc:8080",
+		},
+		"ipv6": {
+			hostport: "[fe80::1]:443",
+			expect:   "[fe80::1]:443",
+		},
+		"default port": {
+			hostport:    "web.default.svc",
+			defaultPort: 80,
+			expect:      "web.default.svc:80",
+		},
+		"ipv6 with default port": {
+			hostport:    "[fe80::1]",
+			defaultPort: 80,
+			expect:      "[fe80::1]:80",
+		},
+		"missing port": {
+			hostport:  "web.default.svc",
+			expectErr: true,
+		},
+		"invalid port": {
+			hostport:  "web.default.svc:http",
+			expectErr: true,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			ap, err := addrPortFromHostPort(tc.hostport, tc.defaultPort)
+			if tc.expectErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expect, ap.String())
+		})
+	}
+}
+
+func TestAuthorizedHTTP(t *testing.T) {
+	auth := &proxyAuth{users: map[string]string{"alice": "s3cr3t"}}
+	newRequest := func(user, password string) *http.Request {
+		req, _ := http.NewRequest(http.MethodConnect, "http://example.com:443", nil)
+		if len(user) > 0 {
+			req.SetBasicAuth(user, password)
+			req.Header.Set("Proxy-Authorization", req.Header.Get("Authorization"))
+		}
+		return req
+	}
+
+	r := require.New(t)
+	r.True(authorizedHTTP(newRequest("", ""), nil))
+	r.False(authorizedHTTP(newRequest("", ""), auth))
+	r.False(authorizedHTTP(newRequest("alice", "wrong"), auth))
+	r.True(authorizedHTTP(newRequest("alice", "s3cr3t"), auth))
+}
@@ -1,20 +1,27 @@
 package main
 
 import (
+	"cmp"
 	"context"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"log/slog"
+	"math"
+	"net"
 	"os"
 	"os/signal"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/spf13/cobra"
-	"k8s.io/client-go/kubernetes/scheme"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/kubernetes"
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 	"k8s.io/klog/v2"
 
@@ -22,6 +29,7 @@ import (
 	"github.com/knight42/krelay/pkg/ports"
 	"github.com/knight42/krelay/pkg/remoteaddr"
 	slogutil "github.com/knight42/krelay/pkg/slog"
+	"github.com/knight42/krelay/pkg/tracing"
 	"github.com/knight42/krelay/pkg/xnet"
 )
 
@@ -32,37 +40,76 @@ type Options struct {
 	address string
 	// targetsFile is the file containing the list of targets.
 	targetsFile string
+	// lb is the load balancing policy across the pods of a target.
+	lb string
+	// readiness decides which pods of a target may receive connections.
+	readiness string
+	// allPods forwards to every pod of a StatefulSet or Service.
+	allPods bool
+	// nodeExternalIP uses the ExternalIP of nodes instead of the InternalIP.
+	nodeExternalIP bool
+	// host and path pick the rule of an Ingress or HTTPRoute target.
+	host string
+	path string
+	// endpoints makes Services with a cluster IP resolve to their endpoints.
+	endpoints bool
+	// watch reloads the targets file whenever it changes.
+	watch bool
+	// control is the address of the control API, "unix:PATH" or a loopback
+	// HOST:PORT. It is disabled if empty.
+	control string
+	// metrics is the address to serve the metrics on. It is disabled if empty.
+	metrics string
+	// otlpEndpoint is the OTLP/HTTP collector the spans are exported to.
+	// Tracing is disabled if it is empty.
+	otlpEndpoint string
+	// ui shows a live dashboard of the forwards instead of the logs.
+	ui bool
 
 	verbosity int
 }
 
 func (o *Options) Run(ctx context.Context, args []string) error {
+	err := o.kf.Validate()
+	if err != nil {
+		return err
+	}
 	ns, _, err := o.kf.GetNamespace()
 	if err != nil {
 		return fmt.Errorf("get namespace: %w", err)
 	}
 
+	if len(o.otlpEndpoint) > 0 {
+		shutdown, err := tracing.Setup(ctx, "krelay", o.otlpEndpoint)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			// ctx is done by now
+			flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := shutdown(flushCtx); err != nil {
+				slog.Warn("Fail to flush spans", slogutil.Error(err))
+			}
+		}()
+	}
+
 	var targets []target
 	if len(o.targetsFile) > 0 {
 		if len(args) != 0 {
 			return errors.New("target file and TYPE/NAME with ports cannot be specified at the same time")
 		}
-
-		var fin *os.File
-		if o.targetsFile == "-" {
-			fin = os.Stdin
-		} else {
-			fin, err = os.Open(o.targetsFile)
-			if err != nil {
-				return err
-			}
-			defer fin.Close()
+		if o.watch && o.targetsFile == "-" {
+			return errors.New("--watch does not support reading the targets from stdin")
 		}
-		targets, err = parseTargetsFile(fin, ns)
+		targets, err = o.readTargetsFile(ns)
 		if err != nil {
 			return err
 		}
 	} else {
+		if o.watch {
+			return errors.New("--watch requires a targets file")
+		}
 		if len(args) < 2 {
 			return errors.New("TYPE/NAME and list of ports are required for port-forward")
 		}
@@ -76,94 +123,358 @@ func (o *Options) Run(ctx context.Context, args []string) error {
 				ports:     args[1:],
 				namespace: ns,
 				lisAddr:   o.address,
+				allPods:   o.allPods,
+				host:      o.host,
+				path:      o.path,
 			},
 		}
 	}
 
-	cs, err := o.kf.ToClientSet()
+	addrOpts := targetOptions{endpoints: o.endpoints}
+	addrOpts.LB, err = remoteaddr.ParseLBPolicy(o.lb)
+	if err != nil {
+		return err
+	}
+	addrOpts.Readiness, err = remoteaddr.ParseReadiness(o.readiness)
 	if err != nil {
 		return err
 	}
 
-	var portForwarders []*portForwarder
-
-	for _, targetSpec := range targets {
-		var addrGetter remoteaddr.Getter
-		parser := ports.NewParser(targetSpec.ports)
-		resParts := strings.Split(targetSpec.resource, "/")
-		switch resParts[0] {
-		case "ip":
-			remoteAddr, err := xnet.AddrFromIP(resParts[1])
+	var (
+		controlLis   net.Listener
+		controlToken string
+	)
+	if len(o.control) > 0 {
+		controlLis, err = listenControl(o.control)
+		if err != nil {
+			return fmt.Errorf("listen control api: %w", err)
+		}
+		defer controlLis.Close()
+		if controlLis.Addr().Network() == "tcp" {
+			controlToken, err = newControlToken(o.ui)
 			if err != nil {
 				return err
 			}
-			addrGetter = remoteaddr.NewStaticAddr(remoteAddr)
+		}
+	}
+	var metricsLis net.Listener
+	if len(o.metrics) > 0 {
+		metricsLis, err = net.Listen("tcp", o.metrics)
+		if err != nil {
+			return fmt.Errorf("listen metrics: %w", err)
+		}
+		defer metricsLis.Close()
+		o.kf.EnableServerMetrics()
+	}
 
-		case "host":
-			addrGetter = remoteaddr.NewStaticAddr(xnet.AddrFromHost(resParts[1]))
+	// quitting the dashboard stops the relay
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-		default:
-			obj, err := o.kf.ToResourceBuilder().
-				WithScheme(scheme.Scheme, scheme.Scheme.PrioritizedVersionsAllGroups()...).
-				NamespaceParam(targetSpec.namespace).DefaultNamespace().
-				ResourceNames("pods", targetSpec.resource).
-				Do().Object()
-			if err != nil {
-				return err
+	r := newRelay(ctx, o, addrOpts)
+	err = r.apply(targets)
+	if err == nil && !r.listening() {
+		err = fmt.Errorf("unable to listen on any of the requested ports")
+	}
+	if err != nil {
+		// the sessions of the targets that started have to return before
+		// they are closed
+		cancel()
+		r.wait()
+		return err
+	}
+
+	// the control API has to be stopped before waiting for the relay, since it
+	// may start targets, and so does the metrics endpoint, since it uses the
+	// sessions
+	var controlDone, metricsDone <-chan struct{}
+	if controlLis != nil {
+		controlDone = serveHTTP(ctx, "control API", controlLis, controlHandler(r, ns, controlToken))
+	}
+	if metricsLis != nil {
+		metricsDone = serveHTTP(ctx, "metrics", metricsLis, metricsHandler(r))
+	}
+
+	var uiDone chan struct{}
+	if o.ui {
+		uiDone = make(chan struct{})
+		go func() {
+			defer close(uiDone)
+			defer cancel()
+			if err := runDashboard(ctx, r); err != nil {
+				slog.Error("Fail to run dashboard", slogutil.Error(err))
 			}
+		}()
+	}
 
-			addrGetter, err = addrGetterForObject(obj, cs, targetSpec.namespace)
-			if err != nil {
-				return err
+	var reload <-chan struct{}
+	if len(o.targetsFile) > 0 && o.targetsFile != "-" {
+		reload = watchTargetsFile(ctx, o.targetsFile, o.watch)
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			if controlDone != nil {
+				<-controlDone
 			}
-			parser = parser.WithObject(obj)
+			if metricsDone != nil {
+				<-metricsDone
+			}
+			if uiDone != nil {
+				// give the terminal back before the relay logs its shutdown
+				<-uiDone
+			}
+			r.wait()
+			return nil
+		case <-reload:
+			o.reloadTargets(r, ns)
 		}
+	}
+}
 
-		forwardPorts, err := parser.Parse()
+// readTargetsFile reads the targets from the targets file, or stdin if it
+// is "-".
+func (o *Options) readTargetsFile(ns string) ([]target, error) {
+	fin := os.Stdin
+	if o.targetsFile != "-" {
+		var err error
+		fin, err = os.Open(o.targetsFile)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		for _, pp := range forwardPorts {
-			portForwarders = append(portForwarders, &portForwarder{
-				addrGetter: addrGetter,
-				ports:      pp,
-				listenAddr: targetSpec.lisAddr,
-			})
+		defer fin.Close()
+	}
+	return loadTargets(fin, ns)
+}
+
+// reloadTargets reads the targets file again and applies the changes. An
+// invalid file leaves the running targets as they are.
+func (o *Options) reloadTargets(r *relay, ns string) {
+	targets, err := o.readTargetsFile(ns)
+	if err != nil {
+		slog.Error("Fail to reload targets", slogutil.Error(err))
+		return
+	}
+	slog.Info("Reload targets", slog.Int("count", len(targets)))
+	err = r.apply(targets)
+	if err != nil {
+		slog.Error("Fail to start targets", slogutil.Error(err))
+	}
+}
+
+// forwardersOf resolves the target in its cluster and returns a forwarder for
+// each of its ports.
+func (o *Options) forwardersOf(ctx context.Context, c *cluster, targetSpec target, addrOpts targetOptions) ([]*portForwarder, error) {
+	var (
+		ret      []*portForwarder
+		resolved []resolvedTarget
+		err      error
+	)
+	if len(targetSpec.lb) > 0 {
+		addrOpts.LB, err = remoteaddr.ParseLBPolicy(targetSpec.lb)
+		if err != nil {
+			return nil, err
 		}
 	}
+	if len(targetSpec.readiness) > 0 {
+		addrOpts.Readiness, err = remoteaddr.ParseReadiness(targetSpec.readiness)
+		if err != nil {
+			return nil, err
+		}
+	}
+	portArgs, nodePortArgs := splitNodePorts(targetSpec.ports)
+	parser := ports.NewParser(portArgs)
+	resParts := strings.Split(targetSpec.resource, "/")
+	if len(nodePortArgs) > 0 && slices.Contains([]string{"ip", "host", "node", "selector"}, resParts[0]) {
+		return nil, fmt.Errorf("%s is only supported for services", nodePortPrefix)
+	}
+	switch resParts[0] {
+	case "ip":
+		remoteAddr, err := xnet.AddrFromIP(resParts[1])
+		if err != nil {
+			return nil, err
+		}
+		resolved = []resolvedTarget{{addrGetter: remoteaddr.NewStaticAddr(remoteAddr)}}
+
+	case "host":
+		resolved = []resolvedTarget{{addrGetter: remoteaddr.NewStaticAddr(xnet.AddrFromHost(resParts[1]))}}
+
+	case "selector":
+		if targetSpec.allPods {
+			return nil, errors.New("--all-pods is not supported for selector targets")
+		}
+		selector := strings.TrimPrefix(targetSpec.resource, selectorPrefix)
+		// the pods may not have been created yet
+		opts := addrOpts.Options
+		opts.AllowEmpty = true
+		addrGetter, err := remoteaddr.NewBalancedAddr(c.cs, targetSpec.namespace, selector, opts)
+		if err != nil {
+			return nil, err
+		}
+		resolved = []resolvedTarget{{addrGetter: addrGetter}}
+
+		pod, err := firstPodOfSelector(ctx, c.cs, targetSpec.namespace, selector)
+		if err != nil {
+			return nil, err
+		}
+		if pod != nil {
+			parser = parser.WithObject(pod)
+		}
 
-	succeeded := false
-	for _, pf := range portForwarders {
-		err := pf.listen()
+	case "node":
+		node, err := c.cs.CoreV1().Nodes().Get(ctx, resParts[1], metav1.GetOptions{})
 		if err != nil {
-			slog.Error("Fail to bind address", slogutil.Error(err))
+			return nil, err
+		}
+		remoteAddr, err := remoteaddr.NodeAddr(node, o.nodeExternalIP)
+		if err != nil {
+			return nil, err
+		}
+		resolved = []resolvedTarget{{addrGetter: remoteaddr.NewStaticAddr(remoteAddr)}}
+
+	default:
+		// TYPE/NAME/POD narrows the target down to a single pod
+		var pod string
+		resource := targetSpec.resource
+		if len(resParts) == 3 {
+			resource, pod = resParts[0]+"/"+resParts[1], resParts[2]
+		}
+		// Fetch the object unstructured so that custom workloads work too.
+		uobj, err := c.kf.ToResourceBuilder().
+			Unstructured().
+			NamespaceParam(targetSpec.namespace).DefaultNamespace().
+			ResourceNames("pods", resource).
+			Do().Object()
+		if err != nil {
+			return nil, err
+		}
+		u, ok := uobj.(*unstructured.Unstructured)
+		if !ok {
+			return nil, fmt.Errorf("expect a single object, got %T", uobj)
+		}
+		obj, err := toTypedObject(u)
+		if err != nil {
+			return nil, err
+		}
+		if isRoute(obj) {
+			backend, err := backendOfRoute(obj, targetSpec.host, targetSpec.path)
+			if err != nil {
+				return nil, err
+			}
+			routeArgs, err := routePorts(portArgs, backend.port)
+			if err != nil {
+				return nil, err
+			}
+			parser = ports.NewParser(routeArgs)
+			obj, err = c.cs.CoreV1().Services(backend.namespace).Get(ctx, backend.service, metav1.GetOptions{})
+			if err != nil {
+				return nil, fmt.Errorf("get backend service: %w", err)
+			}
+		}
+
+		if len(nodePortArgs) > 0 {
+			svc, ok := obj.(*corev1.Service)
+			if !ok {
+				return nil, fmt.Errorf("%s is only supported for services", nodePortPrefix)
+			}
+			forwarders, err := o.nodePortForwarders(c.cs, svc, nodePortArgs, targetSpec)
+			if err != nil {
+				return nil, err
+			}
+			ret = append(ret, forwarders...)
+		}
+		if len(portArgs) == 0 {
+			// only NodePorts, the pods are not needed
+			return ret, nil
+		}
+
+		pods, err := podsOfObject(ctx, obj, c.cs, pod, targetSpec.allPods)
+		if err != nil {
+			return nil, err
+		}
+		if svc, ok := obj.(*corev1.Service); ok && targetSpec.allPods {
+			// The pods of a Service have no ordinals, every local port sticks
+			// to one pod instead and is handed to a new one when it is gone.
+			getters, err := remoteaddr.NewEndpointsSlots(c.cs, svc, addrOpts.Options, len(pods))
+			if err != nil {
+				return nil, err
+			}
+			for i, g := range getters {
+				resolved = append(resolved, resolvedTarget{addrGetter: g, portOffset: pods[i].offset})
+			}
 		} else {
-			succeeded = true
+			for _, pt := range pods {
+				opts := addrOpts
+				opts.Pod = pt.name
+				addrGetter, err := addrGetterForObject(obj, c.cs, targetSpec.namespace, opts)
+				if err != nil {
+					return nil, err
+				}
+				resolved = append(resolved, resolvedTarget{addrGetter: addrGetter, portOffset: pt.offset})
+			}
 		}
-	}
-	if !succeeded {
-		return fmt.Errorf("unable to listen on any of the requested ports")
+		parser = parser.WithObject(obj)
 	}
 
-	createdJob, err := o.kf.RunServerJob(ctx)
+	forwardPorts, err := parser.Parse()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer createdJob.Close()
-
-	streamConn := createdJob.StreamConn()
-	go sendHeartbeats(streamConn, 5*time.Second)
-	for _, pf := range portForwarders {
-		go pf.run(streamConn)
+	err = checkPortOffsets(forwardPorts, resolved)
+	if err != nil {
+		return nil, err
+	}
+	for _, pp := range forwardPorts {
+		for _, rt := range resolved {
+			podPorts := pp
+			// a random local port stays random
+			if podPorts.LocalPort != 0 {
+				if int(podPorts.LocalPort)+int(rt.portOffset) > math.MaxUint16 {
+					return nil, fmt.Errorf("local port %d plus offset %d is out of range", podPorts.LocalPort, rt.portOffset)
+				}
+				podPorts.LocalPort += rt.portOffset
+			}
+			ret = append(ret, &portForwarder{
+				name:       cmp.Or(targetSpec.name, targetSpec.resource),
+				addrGetter: rt.addrGetter,
+				ports:      podPorts,
+				listenAddr: targetSpec.lisAddr,
+				opts:       targetSpec.opts,
+			})
+		}
 	}
+	return ret, nil
+}
 
-	select {
-	case <-streamConn.CloseChan():
-		slog.Info("Lost connection to krelay-server pod")
-	case <-ctx.Done():
+// nodePortForwarders forwards the ports of the Service to its NodePorts on
+// any ready node.
+func (o *Options) nodePortForwarders(cs kubernetes.Interface, svc *corev1.Service, args []string, targetSpec target) ([]*portForwarder, error) {
+	parser := ports.NewParser(args).WithObject(svc)
+	pairs, err := parser.Parse()
+	if err != nil {
+		return nil, err
+	}
+	pairs, err = toNodePorts(svc, pairs)
+	if err != nil {
+		return nil, err
+	}
+	// any ready node serves the NodePort, the watch replaces one going away
+	addrGetter, err := remoteaddr.NewNodesAddr(cs, o.nodeExternalIP)
+	if err != nil {
+		return nil, err
 	}
 
-	return nil
+	ret := make([]*portForwarder, 0, len(pairs))
+	for _, pp := range pairs {
+		ret = append(ret, &portForwarder{
+			name:       cmp.Or(targetSpec.name, targetSpec.resource),
+			addrGetter: addrGetter,
+			ports:      pp,
+			listenAddr: targetSpec.lisAddr,
+			opts:       targetSpec.opts,
+		})
+	}
+	return ret, nil
 }
 
 func main() {
@@ -213,11 +524,25 @@ This behavior can be disabled by setting the environment variable "KUBECTL_PORT_
 	flags := c.Flags()
 	flags.BoolVarP(&printVersion, "version", "V", false, "Print version info and exit.")
 	flags.StringVarP(&o.address, "address", "l", "127.0.0.1", "Address to listen on. Only accepts IP addresses as a value.")
-	flags.StringVarP(&o.targetsFile, "file", "f", "", "Forward to the targets specified in the given file, with one target per line.")
+	flags.StringVarP(&o.targetsFile, "file", "f", "", "Forward to the targets specified in the given file, with one target per line or as a RelayConfig in YAML or JSON.")
+	flags.BoolVar(&o.watch, "watch", false, "Reload the targets file whenever it changes. It is also reloaded on SIGHUP.")
+	flags.StringVar(&o.control, "control", "", `Serve an HTTP API to list, add and remove forwards at runtime on "unix:PATH" or a loopback HOST:PORT, which requires the token in $KRELAY_CONTROL_TOKEN, or a generated one that is logged.`)
+	flags.StringVar(&o.metrics, "metrics", "", "Serve Prometheus metrics at /metrics on this HOST:PORT, and relay the metrics of krelay-server at /metrics/server.")
+	flags.StringVar(&o.otlpEndpoint, "otlp-endpoint", "", "Export the spans of the forwarded connections to this OTLP/HTTP collector, e.g. http://localhost:4318, and propagate the trace context to krelay-server.")
+	flags.BoolVar(&o.ui, "ui", false, "Show a live table of the forwards and their connections instead of the logs. Press enter to list the connections of a forward and q to quit.")
+	flags.StringVar(&o.lb, "lb", string(remoteaddr.LBNewest), "How to spread connections across the pods of a workload or headless service: newest, round-robin, random or least-conn.")
+	flags.StringVar(&o.readiness, "readiness", string(remoteaddr.ReadinessReady), "Which pods of a workload or headless service may receive connections: ready, gates (also wait for readiness gates) or running (ignore readiness probes).")
+	flags.BoolVar(&o.allPods, "all-pods", false, "Forward to every pod of a StatefulSet or Service, adding the ordinal (or index of the pod name) to the local ports.")
+	flags.BoolVar(&o.nodeExternalIP, "node-external-ip", false, "Forward to the ExternalIP of node targets and NodePorts instead of the InternalIP.")
+	flags.StringVar(&o.host, "host", "", "Follow the rule of an Ingress or HTTPRoute target matching this host.")
+	flags.StringVar(&o.path, "path", "", "Follow the rule of an Ingress or HTTPRoute target matching this path.")
+	flags.BoolVar(&o.endpoints, "endpoints", false, "Forward to the endpoints of a Service directly instead of its cluster IP, bypassing kube-proxy.")
 	flags.IntVarP(&o.verbosity, "v", "v", 3, "Number for the log level verbosity. The bigger the more verbose.")
 
 	c.AddCommand(
 		newProxyCommand(kf),
+		newReverseCommand(kf),
+		newServerCommand(kf),
 	)
 	_ = c.Execute()
 }
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/knight42/krelay/pkg/constants"
+	"github.com/knight42/krelay/pkg/metrics"
+	"github.com/knight42/krelay/pkg/xnet"
+)
+
+// session returns the session of the cluster, or nil if there is none.
+func (r *relay) session(key clusterKey) *session {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c, ok := r.clusters[key]
+	if !ok {
+		return nil
+	}
+	return c.sess
+}
+
+// metricsHandler serves the metrics of the client at /metrics, and relays
+// the metrics of the krelay-server of a cluster at /metrics/server, e.g.
+// /metrics/server?context=staging. The server has to be started with
+// --server.metrics.
+func metricsHandler(r *relay) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", metrics.ClientHandler())
+	mux.HandleFunc("GET /metrics/server", func(w http.ResponseWriter, req *http.Request) {
+		key := clusterKey{
+			kubeconfig: req.URL.Query().Get("kubeconfig"),
+			context:    req.URL.Query().Get("context"),
+		}
+		sess := r.session(key)
+		if sess == nil {
+			http.Error(w, "no krelay-server is running in this cluster", http.StatusNotFound)
+			return
+		}
+		resp, err := scrapeServer(sess.ServerConn(), req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+		for _, k := range []string{"Content-Type", "Content-Encoding"} {
+			if v := resp.Header.Get(k); len(v) > 0 {
+				w.Header().Set(k, v)
+			}
+		}
+		w.WriteHeader(resp.StatusCode)
+		_, _ = io.Copy(w, resp.Body)
+	})
+	return mux
+}
+
+// scrapeServer fetches the metrics of krelay-server through the port-forward
+// connection.
+func scrapeServer(c serverConn, orig *http.Request) (*http.Response, error) {
+	dataStream, errCh, err := createStreamToPort(c, xnet.NewRequestID(), constants.ServerMetricsPort)
+	if err != nil {
+		return nil, err
+	}
+	go func() { <-errCh }()
+
+	req, err := http.NewRequestWithContext(orig.Context(), http.MethodGet, "http://krelay-server/metrics", nil)
+	if err != nil {
+		_ = dataStream.Reset()
+		return nil, err
+	}
+	// keep the format negotiated by the scraper
+	for _, k := range []string{"Accept", "Accept-Encoding"} {
+		if v := orig.Header.Get(k); len(v) > 0 {
+			req.Header.Set(k, v)
+		}
+	}
+	req.Close = true
+	err = req.Write(dataStream)
+	if err != nil {
+		_ = dataStream.Reset()
+		return nil, fmt.Errorf("write request: %w", err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(dataStream), req)
+	if err != nil {
+		_ = dataStream.Reset()
+		return nil, fmt.Errorf("read response: %w", err)
+	}
+	resp.Body = &streamBody{ReadCloser: resp.Body, stream: dataStream}
+	return resp, nil
+}
+
+// streamBody closes the stream of the response along with its body.
+type streamBody struct {
+	io.ReadCloser
+	stream io.Closer
+}
+
+func (b *streamBody) Close() error {
+	_ = b.stream.Close()
+	return b.ReadCloser.Close()
+}
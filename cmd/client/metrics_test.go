@@ -0,0 +1,75 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/knight42/krelay/pkg/metrics"
+	"github.com/knight42/krelay/pkg/ports"
+	"github.com/knight42/krelay/pkg/remoteaddr"
+	"github.com/knight42/krelay/pkg/xnet"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	r := require.New(t)
+
+	local, remote := net.Pipe()
+	defer remote.Close()
+	pf := &portForwarder{metrics: metrics.NewForward("svc/metrics-test", "127.0.0.1:8080", "tcp")}
+	st := pf.connOpened("127.0.0.1:50000", xnet.AddrPortFrom(xnet.AddrFromHost("a.com"), 80))
+	c := st.wrapConn(local)
+	defer c.Close()
+	go func() {
+		_, _ = remote.Write([]byte("ping"))
+		_, _ = io.ReadFull(remote, make([]byte, 5))
+	}()
+	_, err := io.ReadFull(c, make([]byte, 4))
+	r.NoError(err)
+	_, err = c.Write([]byte("hello"))
+	r.NoError(err)
+	r.Equal(uint64(4), st.bytesOut.Load())
+	r.Equal(uint64(5), pf.bytesIn.Load())
+
+	h := metricsHandler(newRelay(t.Context(), nil, targetOptions{}))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	r.Equal(http.StatusOK, rec.Code)
+	r.Contains(rec.Body.String(), `krelay_client_bytes_total{direction="out",local_addr="127.0.0.1:8080",protocol="tcp",target="svc/metrics-test"} 4`)
+	r.Contains(rec.Body.String(), `krelay_client_bytes_total{direction="in",local_addr="127.0.0.1:8080",protocol="tcp",target="svc/metrics-test"} 5`)
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics/server?context=other", nil))
+	r.Equal(http.StatusNotFound, rec.Code)
+}
+
+func TestMetricsDeletedOnStop(t *testing.T) {
+	r := require.New(t)
+
+	addr, err := xnet.AddrFromIP("10.0.0.1")
+	r.NoError(err)
+	pf := &portForwarder{
+		name:       "svc/metrics-stop",
+		addrGetter: remoteaddr.NewStaticAddr(addr),
+		ports:      ports.PortPair{LocalPort: 0, RemotePort: 80, Protocol: "tcp"},
+		listenAddr: "127.0.0.1",
+	}
+	r.NoError(pf.listen())
+	pf.connOpened("127.0.0.1:50000", xnet.AddrPortFrom(addr, 80))
+
+	scrape := func() string {
+		rec := httptest.NewRecorder()
+		metrics.ClientHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		return rec.Body.String()
+	}
+	r.Contains(scrape(), `target="svc/metrics-stop"`)
+
+	rt := &runningTarget{forwarders: []*portForwarder{pf}, listening: true}
+	rt.stop()
+	r.NotContains(scrape(), `target="svc/metrics-stop"`)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/knight42/krelay/pkg/ports"
+)
+
+// nodePortPrefix marks a port of a Service target that should be reached via
+// its NodePort, e.g. nodeport:8080:http.
+const nodePortPrefix = "nodeport:"
+
+// splitNodePorts separates the ports prefixed with nodePortPrefix, with the
+// prefix removed, from the others.
+func splitNodePorts(args []string) (portArgs, nodePortArgs []string) {
+	for _, arg := range args {
+		if p, ok := strings.CutPrefix(arg, nodePortPrefix); ok {
+			nodePortArgs = append(nodePortArgs, p)
+		} else {
+			portArgs = append(portArgs, arg)
+		}
+	}
+	return portArgs, nodePortArgs
+}
+
+// toNodePorts replaces the service ports in pairs by the NodePorts allocated
+// for them. The local ports are kept.
+func toNodePorts(svc *corev1.Service, pairs []ports.PortPair) ([]ports.PortPair, error) {
+	ret := make([]ports.PortPair, 0, len(pairs))
+	for _, pp := range pairs {
+		idx := slices.IndexFunc(svc.Spec.Ports, func(sp corev1.ServicePort) bool {
+			return sp.Port == int32(pp.RemotePort) && strings.EqualFold(string(sp.Protocol), pp.Protocol)
+		})
+		if idx < 0 || svc.Spec.Ports[idx].NodePort == 0 {
+			return nil, fmt.Errorf("service %s has no node port for %d/%s", svc.Name, pp.RemotePort, pp.Protocol)
+		}
+		pp.RemotePort = uint16(svc.Spec.Ports[idx].NodePort)
+		ret = append(ret, pp)
+	}
+	return ret, nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/knight42/krelay/pkg/ports"
+)
+
+func TestNodePorts(t *testing.T) {
+	r := require.New(t)
+	portArgs, nodePortArgs := splitNodePorts([]string{"8080:http", "nodeport:9090:http", "nodeport:53@udp"})
+	r.Equal([]string{"8080:http"}, portArgs)
+	r.Equal([]string{"9090:http", "53@udp"}, nodePortArgs)
+
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "web"},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{
+				{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP, NodePort: 30080},
+				{Name: "dns", Port: 53, Protocol: corev1.ProtocolUDP, NodePort: 30053},
+				{Name: "metrics", Port: 9100, Protocol: corev1.ProtocolTCP},
+			},
+		},
+	}
+	parser := ports.NewParser(nodePortArgs).WithObject(svc)
+	pairs, err := parser.Parse()
+	r.NoError(err)
+	pairs, err = toNodePorts(svc, pairs)
+	r.NoError(err)
+	r.Equal([]ports.PortPair{
+		{LocalPort: 9090, RemotePort: 30080, Protocol: "tcp"},
+		{LocalPort: 53, RemotePort: 30053, Protocol: "udp"},
+	}, pairs)
+
+	_, err = toNodePorts(svc, []ports.PortPair{{LocalPort: 9100, RemotePort: 9100, Protocol: "tcp"}})
+	r.ErrorContains(err, "has no node port")
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+)
+
+// proxyAuth holds the credentials accepted by the local proxy. A nil
+// *proxyAuth accepts everyone.
+type proxyAuth struct {
+	// users maps a username to its password. Passwords prefixed with {SHA} are
+	// base64-encoded SHA-1 digests, like `htpasswd -s` generates.
+	users map[string]string
+}
+
+const shaPrefix = "{SHA}"
+
+// unsupportedHashPrefixes are the prefixes of the other hashes htpasswd
+// generates: bcrypt and the Apache MD5 variant.
+var unsupportedHashPrefixes = []string{"$2a$", "$2b$", "$2y$", "$apr1$"}
+
+// newProxyAuth merges the "user:password" pairs from the flags with the ones
+// in fileName. It returns nil if no credentials are configured.
+func newProxyAuth(pairs []string, fileName string) (*proxyAuth, error) {
+	a := &proxyAuth{users: map[string]string{}}
+	for _, pair := range pairs {
+		err := a.add(pair)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(fileName) > 0 {
+		f, err := os.Open(fileName)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		err = a.load(f)
+		if err != nil {
+			return nil, fmt.Errorf("parse %s: %w", fileName, err)
+		}
+	}
+	if len(a.users) == 0 {
+		return nil, nil
+	}
+	return a, nil
+}
+
+func (a *proxyAuth) add(pair string) error {
+	user, password, ok := strings.Cut(pair, ":")
+	if !ok || len(user) == 0 || len(user) > 255 {
+		return fmt.Errorf("invalid credential: expected user:password")
+	}
+	if slices.ContainsFunc(unsupportedHashPrefixes, func(prefix string) bool {
+		return strings.HasPrefix(password, prefix)
+	}) {
+		return fmt.Errorf("unsupported password hash for user %q, only plain text and {SHA} are supported", user)
+	}
+	a.users[user] = password
+	return nil
+}
+
+// load reads an htpasswd-style file, one user:password per line.
+func (a *proxyAuth) load(r io.Reader) error {
+	s := bufio.NewScanner(r)
+	lineNo := 0
+	for s.Scan() {
+		lineNo++
+		line := strings.TrimSpace(s.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		err := a.add(line)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", lineNo, err)
+		}
+	}
+	return s.Err()
+}
+
+func (a *proxyAuth) verify(user, password string) bool {
+	expected, ok := a.users[user]
+	if !ok {
+		// compare anyway to not leak whether the user exists
+		expected = "\x00"
+	}
+	if strings.HasPrefix(expected, shaPrefix) {
+		sum := sha1.Sum([]byte(password))
+		password = shaPrefix + base64.StdEncoding.EncodeToString(sum[:])
+	}
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(password)) == 1 && ok
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxyAuth(t *testing.T) {
+	r := require.New(t)
+	a, err := newProxyAuth([]string{"alice:s3cr3t"}, "")
+	r.NoError(err)
+	// generated by `htpasswd -nbs bob password`
+	r.NoError(a.load(strings.NewReader(`
+# comment
+bob:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=
+`)))
+
+	r.True(a.verify("alice", "s3cr3t"))
+	r.False(a.verify("alice", "wrong"))
+	r.True(a.verify("bob", "password"))
+	r.False(a.verify("bob", "{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g="))
+	r.False(a.verify("carol", ""))
+
+	err = a.load(strings.NewReader("dave:$2y$05$abcdefghijklmnopqrstuv"))
+	r.ErrorContains(err, "unsupported password hash")
+	err = a.load(strings.NewReader("dave:$apr1$abcdefgh$ijklmnopqrstuvwxyz0123"))
+	r.ErrorContains(err, "unsupported password hash")
+
+	// plain text passwords may start with $
+	r.NoError(a.add("erin:$ecret"))
+	r.True(a.verify("erin", "$ecret"))
+
+	a, err = newProxyAuth(nil, "")
+	r.NoError(err)
+	r.Nil(a)
+}
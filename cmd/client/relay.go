@@ -0,0 +1,275 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"slices"
+	"sync"
+
+	"github.com/knight42/krelay/pkg/constants"
+	"github.com/knight42/krelay/pkg/metrics"
+	"github.com/knight42/krelay/pkg/remoteaddr"
+	slogutil "github.com/knight42/krelay/pkg/slog"
+)
+
+// relay runs the forwarders of a list of targets. The list can be replaced
+// while running, which only touches the targets that changed: the sessions and
+// the connections in flight are kept. Targets can also be added and removed
+// one by one through the control API.
+type relay struct {
+	// ctx bounds the sessions, it is also used to resolve the targets.
+	ctx      context.Context
+	o        *Options
+	addrOpts targetOptions
+	wg       sync.WaitGroup
+
+	// startMu serializes starting targets, which resolves them and may
+	// create sessions, without holding mu, so that listing and removing
+	// targets does not wait for the cluster.
+	startMu sync.Mutex
+
+	mu       sync.Mutex
+	clusters map[clusterKey]*cluster
+	running  []*runningTarget
+	lastID   int
+	// closed is set once wait is called, after which no session may start.
+	closed bool
+}
+
+// runningTarget is a target with its forwarders.
+type runningTarget struct {
+	id         int
+	spec       target
+	forwarders []*portForwarder
+	// listening is true if any of the forwarders is listening.
+	listening bool
+	// manual is true for targets added through the control API, which are
+	// left alone when the targets file is reloaded.
+	manual bool
+}
+
+func newRelay(ctx context.Context, o *Options, addrOpts targetOptions) *relay {
+	return &relay{
+		ctx:      ctx,
+		o:        o,
+		addrOpts: addrOpts,
+		clusters: map[clusterKey]*cluster{},
+	}
+}
+
+// apply makes the running targets, except the manual ones, match targets.
+// Removed targets stop accepting connections first, so that their local ports
+// can be taken over by the added ones. Targets that fail to start are skipped
+// and reported.
+func (r *relay) apply(targets []target) error {
+	r.startMu.Lock()
+	defer r.startMu.Unlock()
+
+	r.mu.Lock()
+	unmanaged := slices.DeleteFunc(slices.Clone(r.running), func(rt *runningTarget) bool { return rt.manual })
+	removed, added := diffTargets(unmanaged, targets)
+	for _, rt := range removed {
+		r.removeLocked(rt)
+	}
+	r.mu.Unlock()
+
+	var errs []error
+	for _, spec := range added {
+		rt, err := r.start(spec)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", spec.resource, err))
+			continue
+		}
+		r.mu.Lock()
+		r.running = append(r.running, rt)
+		r.mu.Unlock()
+	}
+	return errors.Join(errs...)
+}
+
+// add starts a manual target. Unlike apply, it fails if the target cannot
+// listen on any of its ports.
+func (r *relay) add(spec target) (*runningTarget, error) {
+	r.startMu.Lock()
+	defer r.startMu.Unlock()
+
+	rt, err := r.start(spec)
+	if err != nil {
+		return nil, err
+	}
+	if !rt.listening {
+		rt.stop()
+		return nil, errors.New("unable to listen on any of the requested ports")
+	}
+	rt.manual = true
+	r.mu.Lock()
+	r.running = append(r.running, rt)
+	r.mu.Unlock()
+	return rt, nil
+}
+
+// remove stops the target with the given id. It reports whether there was one.
+func (r *relay) remove(id int) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	idx := slices.IndexFunc(r.running, func(rt *runningTarget) bool { return rt.id == id })
+	if idx < 0 {
+		return false
+	}
+	r.removeLocked(r.running[idx])
+	return true
+}
+
+func (r *relay) removeLocked(rt *runningTarget) {
+	if rt.listening {
+		slog.Info("Stop forwarding", slog.String(constants.LogFieldTarget, cmp.Or(rt.spec.name, rt.spec.resource)))
+	}
+	rt.stop()
+	r.running = slices.DeleteFunc(r.running, func(other *runningTarget) bool { return other == rt })
+}
+
+// start resolves the target in its cluster and forwards the ports it is able
+// to listen on, connecting to the cluster first if needed. startMu has to be
+// held, but not mu, which it only takes to update the relay.
+func (r *relay) start(spec target) (*runningTarget, error) {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return nil, errors.New("relay is closed")
+	}
+	key := clusterKey{kubeconfig: spec.kubeconfig, context: spec.context}
+	c, ok := r.clusters[key]
+	if !ok {
+		var err error
+		c, err = newCluster(r.o.kf, key)
+		if err != nil {
+			r.mu.Unlock()
+			return nil, err
+		}
+		r.clusters[key] = c
+	}
+	sess := c.sess
+	r.mu.Unlock()
+
+	resolvedSpec := spec
+	if len(resolvedSpec.namespace) == 0 {
+		var err error
+		resolvedSpec.namespace, _, err = c.kf.GetNamespace()
+		if err != nil {
+			return nil, fmt.Errorf("get namespace: %w", err)
+		}
+	}
+	forwarders, err := r.o.forwardersOf(r.ctx, c, resolvedSpec, r.addrOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	rt := &runningTarget{spec: spec, forwarders: forwarders}
+	var listened []*portForwarder
+	for _, pf := range forwarders {
+		err := pf.listen()
+		if err != nil {
+			slog.Error("Fail to bind address", slogutil.Error(err))
+			continue
+		}
+		listened = append(listened, pf)
+	}
+	rt.listening = len(listened) > 0
+
+	// one krelay-server per cluster
+	var newSess *session
+	if rt.listening && sess == nil {
+		newSess, err = newSession(r.ctx, c.kf)
+		if err != nil {
+			rt.stop()
+			return nil, err
+		}
+		sess = newSess
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		rt.stop()
+		if newSess != nil {
+			newSess.Close()
+		}
+		return nil, errors.New("relay is closed")
+	}
+	r.lastID++
+	rt.id = r.lastID
+	if newSess != nil {
+		c.sess = newSess
+		r.wg.Go(func() { newSess.run(r.ctx) })
+	}
+	for _, pf := range listened {
+		go pf.run(sess)
+	}
+	return rt, nil
+}
+
+// diffTargets returns the running targets that are not in targets, and the
+// targets that are not running yet.
+func diffTargets(running []*runningTarget, targets []target) (removed []*runningTarget, added []target) {
+	removed = slices.Clone(running)
+	for _, spec := range targets {
+		// targets not listening at all are restarted to retry
+		idx := slices.IndexFunc(removed, func(rt *runningTarget) bool {
+			return rt.listening && reflect.DeepEqual(rt.spec, spec)
+		})
+		if idx < 0 {
+			added = append(added, spec)
+			continue
+		}
+		removed = slices.Delete(removed, idx, idx+1)
+	}
+	return removed, added
+}
+
+// listening reports whether any target is listening on a local port.
+func (r *relay) listening() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.ContainsFunc(r.running, func(rt *runningTarget) bool {
+		return rt.listening
+	})
+}
+
+// wait blocks until the sessions are done, then closes everything.
+func (r *relay) wait() {
+	r.mu.Lock()
+	r.closed = true
+	r.mu.Unlock()
+	r.wg.Wait()
+	r.close()
+}
+
+func (r *relay) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, rt := range r.running {
+		rt.stop()
+	}
+	for _, c := range r.clusters {
+		if c.sess != nil {
+			c.sess.Close()
+		}
+	}
+}
+
+// stop closes the listeners of the target and drops their metrics.
+// Connections already accepted keep going until either side closes them.
+func (rt *runningTarget) stop() {
+	for _, pf := range rt.forwarders {
+		pf.close()
+		remoteaddr.Stop(pf.addrGetter)
+		if localAddr := pf.localAddr(); localAddr != "" {
+			metrics.DeleteForward(pf.name, localAddr, pf.ports.Protocol)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiffTargets(t *testing.T) {
+	web := target{resource: "svc/web", ports: []string{"8080:80"}, lisAddr: "127.0.0.1"}
+	db := target{resource: "svc/db", ports: []string{"5432"}, lisAddr: "127.0.0.1"}
+	dbOtherPort := target{resource: "svc/db", ports: []string{"5433:5432"}, lisAddr: "127.0.0.1"}
+	dns := target{resource: "svc/dns", ports: []string{"10053:53@udp"}, lisAddr: "127.0.0.1"}
+
+	running := []*runningTarget{
+		{spec: web, listening: true},
+		{spec: db, listening: true},
+		// failed to listen before, so it is started again
+		{spec: dns},
+	}
+	removed, added := diffTargets(running, []target{web, dbOtherPort, dns})
+	require.Equal(t, []*runningTarget{running[1], running[2]}, removed)
+	require.Equal(t, []target{dbOtherPort, dns}, added)
+
+	removed, added = diffTargets(running[:2], []target{db, web})
+	require.Empty(t, removed)
+	require.Empty(t, added)
+}
+
+func TestRelayApplyFailure(t *testing.T) {
+	r := require.New(t)
+	job := newFakeJob("krelay-server-a")
+	var created atomic.Int32
+	sess := newFakeSession(job, func(context.Context) (serverJob, error) {
+		created.Add(1)
+		return nil, errors.New("unexpected new job")
+	})
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	rl := newRelay(ctx, &Options{}, targetOptions{})
+	// the session of the cluster has been started by an earlier target
+	rl.clusters[clusterKey{}] = &cluster{sess: sess}
+	rl.wg.Go(func() { sess.run(rl.ctx) })
+
+	err := rl.apply([]target{
+		{resource: "ip/10.0.0.1", ports: []string{"0:80"}, namespace: "default", lisAddr: "127.0.0.1"},
+		{resource: "ip/not-an-ip", ports: []string{"0:80"}, namespace: "default", lisAddr: "127.0.0.1"},
+	})
+	r.ErrorContains(err, "ip/not-an-ip")
+	r.True(rl.listening())
+	localAddr := rl.running[0].forwarders[0].localAddr()
+
+	// what Run does when a target fails
+	cancel()
+	rl.wait()
+	r.True(job.closed.Load())
+	r.Zero(job.reconnects.Load())
+	r.Zero(created.Load())
+	_, err = net.Dial("tcp", localAddr)
+	r.Error(err)
+}
+
+func TestWatchTargetsFile(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "targets.txt")
+	require.NoError(t, os.WriteFile(name, []byte("svc/web 8080:80\n"), 0o600))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reload := watchTargetsFile(ctx, name, true)
+
+	require.NoError(t, os.WriteFile(name, []byte("svc/web 8080:80\nsvc/db 5432\n"), 0o600))
+	select {
+	case <-reload:
+	case <-time.After(5 * watchInterval):
+		t.Fatal("no reload after the file changed")
+	}
+
+	select {
+	case <-reload:
+		t.Fatal("unexpected reload of an unchanged file")
+	case <-time.After(2 * watchInterval):
+	}
+}
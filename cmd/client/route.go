@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+const gatewayAPIGroup = "gateway.networking.k8s.io"
+
+// routeBackend is the Service an Ingress or HTTPRoute sends a request to.
+type routeBackend struct {
+	namespace string
+	service   string
+	// port is the number or the name of the service port, or empty if the
+	// route does not specify it.
+	port string
+}
+
+// isRoute reports whether obj is an Ingress or an HTTPRoute.
+func isRoute(obj runtime.Object) bool {
+	switch actual := obj.(type) {
+	case *networkingv1.Ingress:
+		return true
+	case *unstructured.Unstructured:
+		gvk := actual.GroupVersionKind()
+		return gvk.Group == gatewayAPIGroup && gvk.Kind == "HTTPRoute"
+	}
+	return false
+}
+
+// matchHost matches a hostname against a route hostname, which may start with
+// a wildcard label. An empty host matches every route hostname.
+func matchHost(pattern, host string) bool {
+	if len(host) == 0 || len(pattern) == 0 {
+		return true
+	}
+	if suffix, ok := strings.CutPrefix(pattern, "*"); ok {
+		label, found := strings.CutSuffix(host, suffix)
+		return found && len(label) > 0 && !strings.Contains(label, ".")
+	}
+	return strings.EqualFold(pattern, host)
+}
+
+// matchPath returns how well the path matches a route path, or -1 if it does
+// not match: exact matches win over prefix matches, longer prefixes win over
+// shorter ones. An empty path matches every route path.
+func matchPath(typ, pattern, path string) int {
+	const exactScore = 1 << 16
+	if len(path) == 0 {
+		return 0
+	}
+	switch typ {
+	case "Exact":
+		if pattern == path {
+			return exactScore
+		}
+	case "RegularExpression":
+		if ok, _ := regexp.MatchString("^(?:"+pattern+")$", path); ok {
+			return 1
+		}
+	default: // Prefix, PathPrefix and ImplementationSpecific
+		prefix := strings.TrimSuffix(pattern, "/")
+		if prefix == "" || path == prefix || strings.HasPrefix(path, prefix+"/") {
+			return len(prefix) + 1
+		}
+	}
+	return -1
+}
+
+// backendOfRoute follows the rules of an Ingress or HTTPRoute to the backend
+// Service, considering only the rules matching host and path if given.
+func backendOfRoute(obj runtime.Object, host, path string) (routeBackend, error) {
+	switch actual := obj.(type) {
+	case *networkingv1.Ingress:
+		return backendOfIngress(actual, host, path)
+	case *unstructured.Unstructured:
+		return backendOfHTTPRoute(actual, host, path)
+	}
+	return routeBackend{}, fmt.Errorf("unknown route: %T", obj)
+}
+
+func backendOfIngress(ing *networkingv1.Ingress, host, path string) (routeBackend, error) {
+	var (
+		best      *networkingv1.IngressBackend
+		bestScore = -1
+	)
+	for _, rule := range ing.Spec.Rules {
+		if !matchHost(rule.Host, host) || rule.HTTP == nil {
+			continue
+		}
+		for i := range rule.HTTP.Paths {
+			p := &rule.HTTP.Paths[i]
+			typ := "Prefix"
+			if p.PathType != nil {
+				typ = string(*p.PathType)
+			}
+			if score := matchPath(typ, p.Path, path); score > bestScore {
+				best, bestScore = &p.Backend, score
+			}
+		}
+	}
+	if best == nil {
+		best = ing.Spec.DefaultBackend
+	}
+	if best == nil {
+		return routeBackend{}, fmt.Errorf("no rule of ingress %s matches host %q and path %q", ing.Name, host, path)
+	}
+	if best.Service == nil {
+		return routeBackend{}, fmt.Errorf("backend of ingress %s is not a service", ing.Name)
+	}
+
+	ret := routeBackend{namespace: ing.Namespace, service: best.Service.Name, port: best.Service.Port.Name}
+	if best.Service.Port.Number != 0 {
+		ret.port = strconv.Itoa(int(best.Service.Port.Number))
+	}
+	return ret, nil
+}
+
+func backendOfHTTPRoute(route *unstructured.Unstructured, host, path string) (routeBackend, error) {
+	hostnames, _, _ := unstructured.NestedStringSlice(route.Object, "spec", "hostnames")
+	if len(hostnames) > 0 && len(host) > 0 {
+		matched := false
+		for _, h := range hostnames {
+			matched = matched || matchHost(h, host)
+		}
+		if !matched {
+			return routeBackend{}, fmt.Errorf("httproute %s does not serve host %q", route.GetName(), host)
+		}
+	}
+
+	rules, _, _ := unstructured.NestedSlice(route.Object, "spec", "rules")
+	var (
+		best      map[string]any
+		bestScore = -1
+	)
+	for _, r := range rules {
+		rule, _ := r.(map[string]any)
+		backend := serviceBackendRef(rule)
+		if backend == nil {
+			continue
+		}
+		matches, _, _ := unstructured.NestedSlice(rule, "matches")
+		if len(matches) == 0 {
+			// a rule without matches is the same as a PathPrefix match on "/"
+			matches = []any{map[string]any{}}
+		}
+		for _, m := range matches {
+			match, _ := m.(map[string]any)
+			typ, _, _ := unstructured.NestedString(match, "path", "type")
+			value, found, _ := unstructured.NestedString(match, "path", "value")
+			if !found {
+				value = "/"
+			}
+			if score := matchPath(typ, value, path); score > bestScore {
+				best, bestScore = backend, score
+			}
+		}
+	}
+	if best == nil {
+		return routeBackend{}, fmt.Errorf("no rule of httproute %s forwards path %q to a service", route.GetName(), path)
+	}
+
+	ret := routeBackend{namespace: route.GetNamespace()}
+	ret.service, _, _ = unstructured.NestedString(best, "name")
+	if ns, _, _ := unstructured.NestedString(best, "namespace"); len(ns) > 0 {
+		ret.namespace = ns
+	}
+	if port, found, _ := unstructured.NestedInt64(best, "port"); found {
+		ret.port = strconv.FormatInt(port, 10)
+	}
+	return ret, nil
+}
+
+// serviceBackendRef returns the first backendRef of the rule that points at a
+// Service and has a non-zero weight.
+func serviceBackendRef(rule map[string]any) map[string]any {
+	refs, _, _ := unstructured.NestedSlice(rule, "backendRefs")
+	for _, r := range refs {
+		ref, _ := r.(map[string]any)
+		group, _, _ := unstructured.NestedString(ref, "group")
+		kind, found, _ := unstructured.NestedString(ref, "kind")
+		if len(group) > 0 || (found && kind != "Service") {
+			continue
+		}
+		if weight, found, _ := unstructured.NestedInt64(ref, "weight"); found && weight == 0 {
+			continue
+		}
+		return ref
+	}
+	return nil
+}
+
+// routePorts turns the ports of a route target into ports of the backend
+// Service: LOCAL_PORT[@PROTOCOL] forwards to the backend port, while ports
+// with an explicit remote part are kept as they are.
+func routePorts(args []string, backendPort string) ([]string, error) {
+	ret := make([]string, 0, len(args))
+	for _, arg := range args {
+		portPart, proto, hasProto := strings.Cut(arg, "@")
+		if strings.Contains(portPart, ":") {
+			ret = append(ret, arg)
+			continue
+		}
+		if len(backendPort) == 0 {
+			return nil, fmt.Errorf("the route does not specify the backend port, use LOCAL_PORT:REMOTE_PORT instead of %q", arg)
+		}
+		port := portPart + ":" + backendPort
+		if hasProto {
+			port += "@" + proto
+		}
+		ret = append(ret, port)
+	}
+	return ret, nil
+}
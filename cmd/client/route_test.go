@@ -0,0 +1,147 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func ingressPath(path string, typ networkingv1.PathType, svc string, port networkingv1.ServiceBackendPort) networkingv1.HTTPIngressPath {
+	return networkingv1.HTTPIngressPath{
+		Path:     path,
+		PathType: &typ,
+		Backend: networkingv1.IngressBackend{
+			Service: &networkingv1.IngressServiceBackend{Name: svc, Port: port},
+		},
+	}
+}
+
+func TestBackendOfRoute(t *testing.T) {
+	ing := &networkingv1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "shop"},
+		Spec: networkingv1.IngressSpec{
+			Rules: []networkingv1.IngressRule{
+				{
+					Host: "shop.example.com",
+					IngressRuleValue: networkingv1.IngressRuleValue{HTTP: &networkingv1.HTTPIngressRuleValue{
+						Paths: []networkingv1.HTTPIngressPath{
+							ingressPath("/", networkingv1.PathTypePrefix, "frontend", networkingv1.ServiceBackendPort{Name: "http"}),
+							ingressPath("/api", networkingv1.PathTypePrefix, "api", networkingv1.ServiceBackendPort{Number: 8080}),
+							ingressPath("/api/health", networkingv1.PathTypeExact, "health", networkingv1.ServiceBackendPort{Number: 9090}),
+						},
+					}},
+				},
+				{
+					Host: "*.admin.example.com",
+					IngressRuleValue: networkingv1.IngressRuleValue{HTTP: &networkingv1.HTTPIngressRuleValue{
+						Paths: []networkingv1.HTTPIngressPath{
+							ingressPath("/", networkingv1.PathTypePrefix, "admin", networkingv1.ServiceBackendPort{Number: 80}),
+						},
+					}},
+				},
+			},
+		},
+	}
+	route := &unstructured.Unstructured{Object: map[string]any{
+		"apiVersion": "gateway.networking.k8s.io/v1",
+		"kind":       "HTTPRoute",
+		"metadata":   map[string]any{"name": "web", "namespace": "shop"},
+		"spec": map[string]any{
+			"hostnames": []any{"shop.example.com"},
+			"rules": []any{
+				map[string]any{
+					"matches": []any{
+						map[string]any{"path": map[string]any{"type": "PathPrefix", "value": "/api"}},
+					},
+					"backendRefs": []any{
+						map[string]any{"name": "canary", "port": int64(8080), "weight": int64(0)},
+						map[string]any{"name": "api", "namespace": "backend", "port": int64(8080)},
+					},
+				},
+				map[string]any{
+					"backendRefs": []any{
+						map[string]any{"name": "frontend", "port": int64(80)},
+					},
+				},
+			},
+		},
+	}}
+
+	testCases := map[string]struct {
+		obj        runtime.Object
+		host, path string
+
+		expect    routeBackend
+		expectErr string
+	}{
+		"ingress first rule": {
+			obj:    ing,
+			expect: routeBackend{namespace: "shop", service: "frontend", port: "http"},
+		},
+		"ingress longest prefix": {
+			obj:    ing,
+			path:   "/api/users",
+			expect: routeBackend{namespace: "shop", service: "api", port: "8080"},
+		},
+		"ingress exact": {
+			obj:    ing,
+			path:   "/api/health",
+			expect: routeBackend{namespace: "shop", service: "health", port: "9090"},
+		},
+		"ingress prefix is per path element": {
+			obj:    ing,
+			path:   "/apis",
+			expect: routeBackend{namespace: "shop", service: "frontend", port: "http"},
+		},
+		"ingress wildcard host": {
+			obj:    ing,
+			host:   "eu.admin.example.com",
+			expect: routeBackend{namespace: "shop", service: "admin", port: "80"},
+		},
+		"ingress unknown host": {
+			obj:       ing,
+			host:      "blog.example.com",
+			expectErr: "no rule of ingress web matches",
+		},
+		"httproute": {
+			obj:    route,
+			path:   "/api/users",
+			expect: routeBackend{namespace: "backend", service: "api", port: "8080"},
+		},
+		"httproute without matches": {
+			obj:    route,
+			path:   "/cart",
+			expect: routeBackend{namespace: "shop", service: "frontend", port: "80"},
+		},
+		"httproute unknown host": {
+			obj:       route,
+			host:      "blog.example.com",
+			expectErr: "does not serve host",
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			require.True(t, isRoute(tc.obj))
+			got, err := backendOfRoute(tc.obj, tc.host, tc.path)
+			if len(tc.expectErr) == 0 {
+				require.NoError(t, err)
+				require.Equal(t, tc.expect, got)
+				return
+			}
+			require.ErrorContains(t, err, tc.expectErr)
+		})
+	}
+}
+
+func TestRoutePorts(t *testing.T) {
+	got, err := routePorts([]string{"8080", "9000@tcp", "9001:metrics"}, "http")
+	require.NoError(t, err)
+	require.Equal(t, []string{"8080:http", "9000:http@tcp", "9001:metrics"}, got)
+
+	_, err = routePorts([]string{"8080"}, "")
+	require.ErrorContains(t, err, "does not specify the backend port")
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/streaming/pkg/httpstream"
+
+	"github.com/knight42/krelay/pkg/kube"
+	slogutil "github.com/knight42/krelay/pkg/slog"
+	"github.com/knight42/krelay/pkg/xnet"
+)
+
+const heartbeatInterval = 5 * time.Second
+
+// session owns the port-forward connection to krelay-server. When the
+// connection drops, it re-dials the existing pod, or creates a new Job if the
+// pod is gone, so the local listeners can stay open.
+type session struct {
+	// runJob creates a new krelay-server Job, see kube.Flags.RunServerJob.
+	runJob func(ctx context.Context) (serverJob, error)
+	// backoff paces the attempts to reconnect, run gives up once its steps
+	// are exhausted.
+	backoff wait.Backoff
+	// job is only replaced by run, which holds mu while doing so, so run
+	// itself reads it without locking. It is nil while a new Job is being
+	// created.
+	job serverJob
+
+	mu   sync.RWMutex
+	conn serverConn
+}
+
+// serverJob is the krelay-server Job a session is connected to, implemented
+// by *kube.ServerJob.
+type serverJob interface {
+	StreamConn() httpstream.Connection
+	Token() string
+	Traced() bool
+	Namespace() string
+	JobName() string
+	PodName() string
+	// Reconnect re-dials the pod, it returns kube.ErrServerPodGone if the pod
+	// is gone.
+	Reconnect(ctx context.Context) error
+	Close() error
+}
+
+var _ serverJob = (*kube.ServerJob)(nil)
+
+// serverConn is a connection to krelay-server together with the token every
+// request on it has to carry.
+type serverConn struct {
+	httpstream.Connection
+	token string
+	// traced is set if the server accepts the trace context in the header.
+	traced bool
+}
+
+// newHeader returns the header of a new request to dst.
+func (c serverConn) newHeader(reqID string, proto byte, dst xnet.AddrPort) xnet.Header {
+	hdr := xnet.Header{
+		RequestID: reqID,
+		Protocol:  proto,
+		Port:      dst.Port(),
+		Addr:      dst.Addr(),
+	}
+	if len(c.token) > 0 {
+		hdr.Version = xnet.HeaderVersionWithToken
+		hdr.Token = c.token
+	}
+	return hdr
+}
+
+func serverConnOf(job serverJob) serverConn {
+	return serverConn{Connection: job.StreamConn(), token: job.Token(), traced: job.Traced()}
+}
+
+func newSession(ctx context.Context, kf *kube.Flags) (*session, error) {
+	runJob := func(ctx context.Context) (serverJob, error) {
+		job, err := kf.RunServerJob(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return job, nil
+	}
+	job, err := runJob(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &session{
+		runJob: runJob,
+		backoff: wait.Backoff{
+			Duration: time.Second,
+			Factor:   2,
+			Jitter:   0.1,
+			Steps:    math.MaxInt32,
+			Cap:      30 * time.Second,
+		},
+		job:  job,
+		conn: serverConnOf(job),
+	}, nil
+}
+
+// ServerConn returns the current connection to krelay-server. Callers should
+// fetch it for every new stream instead of holding on to it, since it is
+// replaced after a reconnection.
+func (s *session) ServerConn() serverConn {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.conn
+}
+
+// run sends heartbeats over the current connection and reconnects whenever it
+// is lost. It blocks until ctx is done, or reconnecting fails for good, and
+// must not be called concurrently.
+func (s *session) run(ctx context.Context) {
+	for {
+		streamConn := s.ServerConn()
+		go sendHeartbeats(streamConn, heartbeatInterval)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-streamConn.CloseChan():
+		}
+
+		slog.Warn("Lost connection to krelay-server pod. Reconnecting.")
+		if !s.reconnect(ctx) {
+			return
+		}
+		slog.Info("Reconnected to krelay-server pod")
+	}
+}
+
+// reconnect retries tryReconnect until it succeeds. It returns false if ctx
+// is done or the backoff is exhausted.
+func (s *session) reconnect(ctx context.Context) bool {
+	backoff := s.backoff
+	for {
+		err := s.tryReconnect(ctx)
+		if err == nil {
+			return true
+		}
+		if backoff.Steps <= 1 {
+			slog.Error("Fail to reconnect to krelay-server. Giving up.", slogutil.Error(err))
+			return false
+		}
+		delay := backoff.Step()
+		slog.Warn("Fail to reconnect to krelay-server. Will retry.", slogutil.Error(err), slog.Duration("after", delay))
+
+		t := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return false
+		case <-t.C:
+		}
+	}
+}
+
+func (s *session) tryReconnect(ctx context.Context) error {
+	if s.job != nil {
+		err := s.job.Reconnect(ctx)
+		if !errors.Is(err, kube.ErrServerPodGone) {
+			if err != nil {
+				return err
+			}
+			s.setServerConn(serverConnOf(s.job))
+			return nil
+		}
+		slog.Info("krelay-server pod is gone, creating a new one")
+		_ = s.job.Close()
+		s.setJob(nil)
+	}
+
+	job, err := s.runJob(ctx)
+	if err != nil {
+		return err
+	}
+	s.setJob(job)
+	s.setServerConn(serverConnOf(job))
+	return nil
+}
+
+func (s *session) setJob(job serverJob) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.job = job
+}
+
+// serverPod returns the namespace and the names of the Job and the pod of
+// krelay-server. They are empty while a new Job is being created.
+func (s *session) serverPod() (namespace, job, pod string) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.job == nil {
+		return "", "", ""
+	}
+	return s.job.Namespace(), s.job.JobName(), s.job.PodName()
+}
+
+func (s *session) setServerConn(c serverConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conn = c
+}
+
+// Close closes the connection and removes the krelay-server Job. It must not
+// be called while run is still running.
+func (s *session) Close() error {
+	if s.job == nil {
+		return nil
+	}
+	return s.job.Close()
+}
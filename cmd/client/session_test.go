@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/streaming/pkg/httpstream"
+
+	"github.com/knight42/krelay/pkg/kube"
+)
+
+type fakeJob struct {
+	name string
+
+	mu   sync.Mutex
+	conn *fakeConn
+	// reconnectErr is returned by Reconnect, which otherwise switches to a
+	// new connection.
+	reconnectErr error
+	reconnects   atomic.Int32
+	closed       atomic.Bool
+}
+
+func newFakeJob(name string) *fakeJob {
+	return &fakeJob{name: name, conn: newFakeConn()}
+}
+
+func (j *fakeJob) StreamConn() httpstream.Connection {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.conn
+}
+
+func (j *fakeJob) Token() string     { return "" }
+func (j *fakeJob) Traced() bool      { return false }
+func (j *fakeJob) Namespace() string { return "default" }
+func (j *fakeJob) JobName() string   { return j.name }
+func (j *fakeJob) PodName() string   { return j.name + "-pod" }
+
+func (j *fakeJob) Reconnect(context.Context) error {
+	j.reconnects.Add(1)
+	if j.reconnectErr != nil {
+		return j.reconnectErr
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.conn = newFakeConn()
+	return nil
+}
+
+// Close drops the connection like the real Job does.
+func (j *fakeJob) Close() error {
+	j.closed.Store(true)
+	j.dropConn()
+	return nil
+}
+
+// dropConn closes the current connection of the job.
+func (j *fakeJob) dropConn() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	select {
+	case <-j.conn.closeCh:
+	default:
+		close(j.conn.closeCh)
+	}
+}
+
+func newFakeSession(job *fakeJob, runJob func(context.Context) (serverJob, error)) *session {
+	return &session{
+		runJob:  runJob,
+		backoff: wait.Backoff{Duration: time.Millisecond, Steps: 3},
+		job:     job,
+		conn:    serverConnOf(job),
+	}
+}
+
+func TestSessionReconnect(t *testing.T) {
+	r := require.New(t)
+	job := newFakeJob("krelay-server-a")
+	s := newFakeSession(job, func(context.Context) (serverJob, error) {
+		return nil, errors.New("unexpected new job")
+	})
+
+	ctx, cancel := context.WithCancel(t.Context())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.run(ctx)
+	}()
+
+	first := s.ServerConn().Connection
+	job.dropConn()
+	r.Eventually(func() bool {
+		return s.ServerConn().Connection != first
+	}, time.Second, 10*time.Millisecond)
+	r.Equal(job.StreamConn(), s.ServerConn().Connection)
+	r.Equal(int32(1), job.reconnects.Load())
+	r.False(job.closed.Load())
+
+	cancel()
+	<-done
+}
+
+func TestSessionReconnectPodGone(t *testing.T) {
+	r := require.New(t)
+	oldJob := newFakeJob("krelay-server-a")
+	oldJob.reconnectErr = kube.ErrServerPodGone
+	newJob := newFakeJob("krelay-server-b")
+	var created atomic.Int32
+	s := newFakeSession(oldJob, func(context.Context) (serverJob, error) {
+		// the first attempt fails, the second one is retried after the backoff
+		if created.Add(1) == 1 {
+			return nil, errors.New("quota exceeded")
+		}
+		return newJob, nil
+	})
+
+	ctx, cancel := context.WithCancel(t.Context())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.run(ctx)
+	}()
+
+	oldJob.dropConn()
+	r.Eventually(func() bool {
+		_, jobName, _ := s.serverPod()
+		return jobName == newJob.name
+	}, time.Second, 10*time.Millisecond)
+	r.True(oldJob.closed.Load())
+	r.Equal(int32(1), oldJob.reconnects.Load())
+	r.Equal(int32(2), created.Load())
+	r.Equal(newJob.StreamConn(), s.ServerConn().Connection)
+
+	cancel()
+	<-done
+}
+
+func TestSessionReconnectGiveUp(t *testing.T) {
+	job := newFakeJob("krelay-server-a")
+	job.reconnectErr = errors.New("connection refused")
+	s := newFakeSession(job, func(context.Context) (serverJob, error) {
+		return nil, errors.New("unexpected new job")
+	})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.run(t.Context())
+	}()
+
+	job.dropConn()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("run did not give up once the backoff was exhausted")
+	}
+	require.Equal(t, int32(3), job.reconnects.Load())
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+
+	"github.com/knight42/krelay/pkg/constants"
+	slogutil "github.com/knight42/krelay/pkg/slog"
+	"github.com/knight42/krelay/pkg/xio"
+	"github.com/knight42/krelay/pkg/xnet"
+)
+
+// socks5RepFromAck maps a failed acknowledgement to a SOCKS5 reply code.
+func socks5RepFromAck(code xnet.AckCode) byte {
+	switch code {
+	case xnet.AckCodeForbidden:
+		return socks5RepNotAllowed
+	case xnet.AckCodeNoSuchHost:
+		return socks5RepHostUnreachable
+	default:
+		return socks5RepServerFailure
+	}
+}
+
+// readBindReply reads one of the two replies of a bind request.
+func readBindReply(r io.Reader) (netip.AddrPort, error) {
+	var ack xnet.Acknowledgement
+	err := ack.FromReader(r)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	if ack.Code != xnet.AckCodeOK {
+		return netip.AddrPort{}, ack.Code
+	}
+	return xnet.ReadBindAddr(r)
+}
+
+// handleSOCKS5Bind serves a BIND request. krelay-server listens on a random
+// port, and the first connection it accepts is relayed to clientConn.
+func handleSOCKS5Bind(clientConn net.Conn, serverConn serverConn, dstAddrPort xnet.AddrPort) {
+	defer clientConn.Close()
+
+	requestID := xnet.NewRequestID()
+	l := slog.With(slog.String(constants.LogFieldRequestID, requestID))
+	defer l.Debug("handleSOCKS5Bind exit")
+	l.Info("Handling bind request",
+		slog.String(constants.LogFieldDestAddr, dstAddrPort.String()),
+		slog.String("clientAddr", clientConn.RemoteAddr().String()),
+	)
+
+	dataStream, errorChan, err := createStream(serverConn, requestID)
+	if err != nil {
+		l.Error("Fail to create stream", slogutil.Error(err))
+		_ = writeSOCKS5Reply(clientConn, socks5RepServerFailure, netip.AddrPort{})
+		return
+	}
+
+	hdr := serverConn.newHeader(requestID, xnet.ProtocolTCPBind, dstAddrPort)
+	_, err = xio.WriteFull(dataStream, hdr.Marshal())
+	if err != nil {
+		l.Error("Fail to write header", slogutil.Error(err))
+		_ = writeSOCKS5Reply(clientConn, socks5RepServerFailure, netip.AddrPort{})
+		return
+	}
+
+	// The first reply carries the address krelay-server listens on, the second
+	// one carries the address of the peer that connected to it.
+	for _, step := range []string{"listen", "accept"} {
+		ap, err := readBindReply(dataStream)
+		if err != nil {
+			var code xnet.AckCode
+			rep := byte(socks5RepServerFailure)
+			if errors.As(err, &code) {
+				rep = socks5RepFromAck(code)
+			}
+			l.Error("Fail to bind", slog.String("step", step), slogutil.Error(err))
+			_ = writeSOCKS5Reply(clientConn, rep, netip.AddrPort{})
+			return
+		}
+		l.Info("Bind reply received", slog.String("step", step), slog.String("address", ap.String()))
+		err = writeSOCKS5Reply(clientConn, socks5RepSucceeded, ap)
+		if err != nil {
+			l.Error("Fail to write reply", slogutil.Error(err))
+			_ = dataStream.Close()
+			return
+		}
+	}
+
+	pipeStream(l, clientConn, dataStream, errorChan)
+}
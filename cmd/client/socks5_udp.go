@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+
+	"github.com/knight42/krelay/pkg/constants"
+	slogutil "github.com/knight42/krelay/pkg/slog"
+	"github.com/knight42/krelay/pkg/xnet"
+)
+
+// socks5UDPQueueSize is the number of datagrams queued per destination while
+// its stream is being set up. Datagrams beyond that are dropped.
+const socks5UDPQueueSize = 64
+
+// parseSOCKS5UDPHeader parses RSV FRAG ATYP DST.ADDR DST.PORT at the start of a
+// SOCKS5 UDP request and returns the destination and the length of the header.
+func parseSOCKS5UDPHeader(pkt []byte) (ap xnet.AddrPort, hdrLen int, err error) {
+	if len(pkt) < 4 {
+		return ap, 0, io.ErrUnexpectedEOF
+	}
+	if pkt[2] != 0 {
+		return ap, 0, errors.New("fragmentation is not supported")
+	}
+	r := bytes.NewReader(pkt[3:])
+	br := bytesReader{
+		buf: make([]byte, 256),
+		r:   r,
+	}
+	ap, err = readSOCKS5AddrPort(&br)
+	if err != nil {
+		return ap, 0, err
+	}
+	return ap, len(pkt) - r.Len(), nil
+}
+
+// socks5PacketConn prepends a SOCKS5 UDP header to every datagram sent to the
+// client, so that the replies look like they come from the destination.
+type socks5PacketConn struct {
+	net.PacketConn
+	header []byte
+}
+
+func (c *socks5PacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	pkt := make([]byte, 0, len(c.header)+len(b))
+	pkt = append(pkt, c.header...)
+	pkt = append(pkt, b...)
+	_, err := c.PacketConn.WriteTo(pkt, addr)
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// handleSOCKS5UDPAssociate serves a UDP ASSOCIATE request. Every destination
+// gets its own relay stream, and the association lasts as long as clientConn.
+func handleSOCKS5UDPAssociate(clientConn net.Conn, serverConn serverConn) {
+	defer clientConn.Close()
+
+	l := slog.With(slog.String("clientAddr", clientConn.RemoteAddr().String()))
+	defer l.Debug("handleSOCKS5UDPAssociate exit")
+
+	tcpAddr := clientConn.LocalAddr().(*net.TCPAddr)
+	pc, err := net.ListenUDP(constants.ProtocolUDP, &net.UDPAddr{IP: tcpAddr.IP, Zone: tcpAddr.Zone})
+	if err != nil {
+		l.Error("Fail to listen udp", slogutil.Error(err))
+		_ = writeSOCKS5Reply(clientConn, socks5RepServerFailure, tcpAddr.AddrPort())
+		return
+	}
+	defer pc.Close()
+
+	err = writeSOCKS5Reply(clientConn, socks5RepSucceeded, pc.LocalAddr().(*net.UDPAddr).AddrPort())
+	if err != nil {
+		l.Error("Fail to write reply", slogutil.Error(err))
+		return
+	}
+	l.Info("Handling udp association", slog.String(constants.LogFieldLocalAddr, pc.LocalAddr().String()))
+
+	// The association terminates when the TCP connection terminates.
+	go func() {
+		_, _ = io.Copy(io.Discard, clientConn)
+		_ = pc.Close()
+	}()
+
+	track := newConnTrack()
+	finish := make(chan string)
+	var wg sync.WaitGroup
+	defer func() {
+		track.CloseAll()
+		go func() {
+			wg.Wait()
+			close(finish)
+		}()
+	}()
+	go func() {
+		for key := range finish {
+			track.Delete(key)
+		}
+	}()
+
+	clientIP := clientConn.RemoteAddr().(*net.TCPAddr).AddrPort().Addr().Unmap()
+	var cliAddr *net.UDPAddr
+	buf := make([]byte, constants.UDPBufferSize)
+	for {
+		n, from, err := pc.ReadFromUDP(buf)
+		if err != nil {
+			if !xnet.IsClosedConnectionError(err) {
+				l.Error("Fail to read udp packet", slogutil.Error(err))
+			}
+			return
+		}
+		// Only accept datagrams from the client that requested the association.
+		if from.AddrPort().Addr().Unmap() != clientIP {
+			continue
+		}
+		if cliAddr == nil {
+			cliAddr = from
+		} else if from.Port != cliAddr.Port {
+			continue
+		}
+
+		dstAddrPort, hdrLen, err := parseSOCKS5UDPHeader(buf[:n])
+		if err != nil {
+			l.Debug("Drop invalid udp packet", slogutil.Error(err))
+			continue
+		}
+		payload := buf[hdrLen:n]
+		data := make([]byte, 2+len(payload))
+		binary.BigEndian.PutUint16(data, uint16(len(payload)))
+		copy(data[2:], payload)
+
+		key := dstAddrPort.String()
+		dataCh, ok := track.Get(key)
+		if !ok {
+			dataCh = make(chan []byte, socks5UDPQueueSize)
+			track.Set(key, dataCh)
+			conn := &socks5PacketConn{PacketConn: pc, header: copyBuffer(buf[:hdrLen])}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				handleUDPConn(conn, cliAddr, dataCh, serverConn, dstAddrPort, nil)
+				finish <- key
+			}()
+		}
+		select {
+		case dataCh <- data:
+		default:
+			// The stream cannot keep up, drop the datagram like a congested link would.
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSOCKS5UDPHeader(t *testing.T) {
+	testCases := map[string]struct {
+		input []byte
+
+		expectAddr   string
+		expectHdrLen int
+		expectErr    string
+	}{
+		"ipv4": {
+			input:        []byte{0, 0, 0, 1, 10, 96, 0, 10, 0, 53, 'd', 'n', 's'},
+			expectAddr:   "10.96.0.10:53",
+			expectHdrLen: 10,
+		},
+		"ipv6": {
+			input:        []byte{0, 0, 0, 4, 0xfe, 0x80, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x1f, 0x90},
+			expectAddr:   "[fe80::1]:8080",
+			expectHdrLen: 22,
+		},
+		"domain": {
+			input:        []byte{0, 0, 0, 3, 3, 'f', 'o', 'o', 0, 53, 'x'},
+			expectAddr:   "foo:53",
+			expectHdrLen: 10,
+		},
+		"fragmented": {
+			input:     []byte{0, 0, 1, 1, 10, 96, 0, 10, 0, 53},
+			expectErr: "fragmentation is not supported",
+		},
+		"unknown address type": {
+			input:     []byte{0, 0, 0, 5, 10, 96, 0, 10, 0, 53},
+			expectErr: "unsupported address type",
+		},
+		"truncated": {
+			input:     []byte{0, 0, 0, 1, 10, 96},
+			expectErr: "unexpected EOF",
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			r := require.New(t)
+			ap, hdrLen, err := parseSOCKS5UDPHeader(tc.input)
+			if len(tc.expectErr) > 0 {
+				r.ErrorContains(err, tc.expectErr)
+				return
+			}
+			r.NoError(err)
+			r.Equal(tc.expectAddr, ap.String())
+			r.Equal(tc.expectHdrLen, hdrLen)
+		})
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/knight42/krelay/pkg/remoteaddr"
+	"github.com/knight42/krelay/pkg/xnet"
+)
+
+// connStats counts the traffic of a connection, or a UDP flow, accepted by a
+// forwarder. The counts also go to the forwarder and its metrics. A nil
+// *connStats counts nothing, e.g. for the connections of the proxy.
+type connStats struct {
+	pf         *portForwarder
+	requestID  string
+	clientAddr string
+	started    time.Time
+	// dst changes if the connection is retried.
+	dst atomic.Pointer[xnet.AddrPort]
+
+	// bytesIn is received from the destination, bytesOut is sent to it.
+	bytesIn  atomic.Uint64
+	bytesOut atomic.Uint64
+	lastErr  atomic.Pointer[string]
+
+	// idle is reset by the traffic, see watchIdle.
+	idle        *time.Timer
+	idleTimeout time.Duration
+}
+
+func (s *connStats) destination() xnet.AddrPort {
+	return *s.dst.Load()
+}
+
+// options returns the connection options of the forwarder, none if the
+// connection is not tracked.
+func (s *connStats) options() connOptions {
+	if s == nil {
+		return connOptions{}
+	}
+	return s.pf.opts
+}
+
+// redial resolves the destination again before retrying the connection.
+func (s *connStats) redial() (xnet.AddrPort, error) {
+	pf := s.pf
+	prev := s.destination()
+	dst, err := remoteaddr.GetAddrPort(pf.addrGetter, pf.ports.RemotePort, pf.ports.Protocol)
+	if err != nil {
+		return prev, err
+	}
+	remoteaddr.Done(pf.addrGetter, prev.Addr())
+	s.dst.Store(&dst)
+	pf.lastDst.Store(&dst)
+	return dst, nil
+}
+
+// watchIdle calls onIdle once no traffic has been counted for the idle
+// timeout of the forwarder, if any. stop has to be called when the
+// connection is closed.
+func (s *connStats) watchIdle(onIdle func()) (stop func()) {
+	timeout := s.options().idleTimeout
+	if timeout <= 0 {
+		return func() {}
+	}
+	s.idleTimeout = timeout
+	s.idle = time.AfterFunc(timeout, onIdle)
+	return func() { s.idle.Stop() }
+}
+
+func (s *connStats) touch() {
+	if s.idle != nil {
+		s.idle.Reset(s.idleTimeout)
+	}
+}
+
+// id returns the request ID of the connection, or a new one if it is not
+// tracked.
+func (s *connStats) id() string {
+	if s == nil {
+		return xnet.NewRequestID()
+	}
+	return s.requestID
+}
+
+func (s *connStats) addIn(n int) {
+	if s == nil || n <= 0 {
+		return
+	}
+	s.touch()
+	s.bytesIn.Add(uint64(n))
+	s.pf.bytesIn.Add(uint64(n))
+	if s.pf.metrics != nil {
+		s.pf.metrics.BytesIn.Add(float64(n))
+	}
+}
+
+func (s *connStats) addOut(n int) {
+	if s == nil || n <= 0 {
+		return
+	}
+	s.touch()
+	s.bytesOut.Add(uint64(n))
+	s.pf.bytesOut.Add(uint64(n))
+	if s.pf.metrics != nil {
+		s.pf.metrics.BytesOut.Add(float64(n))
+	}
+}
+
+// fail records the error that ended the connection, which is also the latest
+// error of the forwarder.
+func (s *connStats) fail(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	msg := err.Error()
+	s.lastErr.Store(&msg)
+	s.pf.fail(err)
+}
+
+// wrapConn returns c counting its bytes into s.
+func (s *connStats) wrapConn(c net.Conn) net.Conn {
+	if s == nil {
+		return c
+	}
+	return &countingConn{Conn: c, stats: s}
+}
+
+// countingConn counts the bytes read from and written to a client connection.
+type countingConn struct {
+	net.Conn
+	stats *connStats
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.stats.addOut(n)
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.stats.addIn(n)
+	return n, err
+}
+
+// connTable holds the open connections of a forwarder by request ID.
+type connTable struct {
+	mu    sync.Mutex
+	conns map[string]*connStats
+}
+
+func (t *connTable) add(s *connStats) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conns == nil {
+		t.conns = map[string]*connStats{}
+	}
+	t.conns[s.requestID] = s
+}
+
+func (t *connTable) remove(s *connStats) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.conns, s.requestID)
+}
+
+// list returns the open connections, oldest first.
+func (t *connTable) list() []*connStats {
+	t.mu.Lock()
+	ret := make([]*connStats, 0, len(t.conns))
+	for _, s := range t.conns {
+		ret = append(ret, s)
+	}
+	t.mu.Unlock()
+	slices.SortFunc(ret, func(a, b *connStats) int {
+		if c := a.started.Compare(b.started); c != 0 {
+			return c
+		}
+		return strings.Compare(a.requestID, b.requestID)
+	})
+	return ret
+}
@@ -1,22 +1,32 @@
 package main
 
 import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
 	"io"
 	"log/slog"
 	"net"
+	"time"
 
+	"go.opentelemetry.io/otel/trace"
 	"k8s.io/streaming/pkg/httpstream"
 
 	"github.com/knight42/krelay/pkg/constants"
+	"github.com/knight42/krelay/pkg/metrics"
 	slogutil "github.com/knight42/krelay/pkg/slog"
+	"github.com/knight42/krelay/pkg/tracing"
 	"github.com/knight42/krelay/pkg/xio"
 	"github.com/knight42/krelay/pkg/xnet"
 )
 
-func handleTCPConn(clientConn net.Conn, serverConn httpstream.Connection, dstAddrPort xnet.AddrPort) {
+// handleTCPConn relays clientConn to dstAddrPort through krelay-server,
+// recording its traffic and errors in st, which may be nil.
+func handleTCPConn(clientConn net.Conn, serverConn serverConn, dstAddrPort xnet.AddrPort, st *connStats) {
 	defer clientConn.Close()
 
-	requestID := xnet.NewRequestID()
+	requestID := st.id()
 	l := slog.With(slog.String(constants.LogFieldRequestID, requestID))
 	defer l.Debug("handleTCPConn exit")
 	l.Info("Handling tcp connection",
@@ -25,35 +35,183 @@ func handleTCPConn(clientConn net.Conn, serverConn httpstream.Connection, dstAdd
 		slog.String("clientAddr", clientConn.RemoteAddr().String()),
 	)
 
-	dataStream, errorChan, err := createStream(serverConn, requestID)
+	// stop retrying once the connection to krelay-server is gone, e.g. when
+	// the relay shuts down
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-serverConn.CloseChan():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	ctx, span := tracing.StartConn(ctx, trace.SpanKindClient, requestID, constants.ProtocolTCP, dstAddrPort.String())
+	defer span.End()
+	span.SetAttributes(tracing.AttrLocalAddr.String(clientConn.LocalAddr().String()))
+
+	dataStream, errorChan, err := dialStream(ctx, l, serverConn, requestID, xnet.ProtocolTCP, dstAddrPort, st)
 	if err != nil {
-		l.Error("Fail to create stream", slogutil.Error(err))
+		st.fail(err)
 		return
 	}
+	stopIdle := st.watchIdle(func() {
+		l.Info("Close idle connection")
+		// the copy from the client ends and closes the stream
+		_ = clientConn.Close()
+	})
+	defer stopIdle()
+
+	_, transferSpan := tracing.Start(ctx, "transfer")
+	defer transferSpan.End()
+	err = pipeStream(l, st.wrapConn(clientConn), dataStream, errorChan)
+	st.fail(err)
+}
+
+// maxRetryBackoff caps the doubling wait between the attempts of dialStream.
+const maxRetryBackoff = 30 * time.Second
+
+// dialStream opens a stream like openStream, within the connect timeout of
+// the forwarder of st. TCP connections are retried according to its retry
+// policy, resolving the destination again, unless krelay-server refused the
+// destination or ctx is done.
+func dialStream(ctx context.Context, l *slog.Logger, serverConn serverConn, requestID string, proto byte, dstAddrPort xnet.AddrPort, st *connStats) (httpstream.Stream, chan error, error) {
+	opts := st.options()
+	backoff := cmp.Or(opts.backoff, time.Second)
+	for attempt := 1; ; attempt++ {
+		attemptCtx, cancel := ctx, context.CancelFunc(func() {})
+		if opts.connectTimeout > 0 {
+			attemptCtx, cancel = context.WithTimeout(ctx, opts.connectTimeout)
+		}
+		dataStream, errorChan, err := openStream(attemptCtx, l, serverConn, requestID, proto, dstAddrPort)
+		cancel()
+		if err == nil || proto != xnet.ProtocolTCP || attempt >= opts.attempts || !retryable(err) {
+			return dataStream, errorChan, err
+		}
+
+		t := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return nil, nil, ctx.Err()
+		case <-t.C:
+		}
+		backoff = min(backoff*2, maxRetryBackoff)
+		dstAddrPort, err = st.redial()
+		if err != nil {
+			l.Error("Fail to get remote address", slogutil.Error(err))
+			return nil, nil, err
+		}
+		// kubelet may still hold the streams of the failed attempt
+		requestID = xnet.NewRequestID()
+		l.Info("Retry connection",
+			slog.Int("attempt", attempt+1),
+			slog.String("retryRequestID", requestID),
+			slog.String(constants.LogFieldDestAddr, dstAddrPort.String()),
+		)
+	}
+}
 
-	hdr := xnet.Header{
-		RequestID: requestID,
-		Protocol:  xnet.ProtocolTCP,
-		Port:      dstAddrPort.Port(),
-		Addr:      dstAddrPort.Addr(),
+// retryable reports whether another attempt may open the stream, which is
+// not the case if krelay-server refused the destination.
+func retryable(err error) bool {
+	var code xnet.AckCode
+	if errors.As(err, &code) {
+		switch code {
+		case xnet.AckCodeUnknownProtocol, xnet.AckCodeUnauthorized, xnet.AckCodeForbidden:
+			return false
+		}
+	}
+	return true
+}
+
+// openStream creates a stream to krelay-server, asks it to connect to
+// dstAddrPort and waits for the ack. Every step is traced as a child of the
+// span in ctx, whose trace context is sent to the server if tracing is
+// enabled. The stream is reset if ctx is done before the ack. Failures are
+// logged before being returned.
+func openStream(ctx context.Context, l *slog.Logger, serverConn serverConn, requestID string, proto byte, dstAddrPort xnet.AddrPort) (dataStream httpstream.Stream, errorChan chan error, err error) {
+	protocol := constants.ProtocolTCP
+	if proto == xnet.ProtocolUDP {
+		protocol = constants.ProtocolUDP
+	}
+	connSpan := trace.SpanFromContext(ctx)
+	start := time.Now()
+
+	_, span := tracing.Start(ctx, "create stream")
+	dataStream, errorChan, err = createStream(serverConn, requestID)
+	if err != nil {
+		tracing.Fail(span, err)
+		tracing.Fail(connSpan, err)
+		span.End()
+		l.Error("Fail to create stream", slogutil.Error(err))
+		return nil, nil, err
+	}
+	span.End()
+	stopReset := context.AfterFunc(ctx, func() { _ = dataStream.Reset() })
+	defer stopReset()
+
+	_, span = tracing.Start(ctx, "write header")
+	hdr := serverConn.newHeader(requestID, proto, dstAddrPort)
+	// older servers reject the trace context
+	if serverConn.traced && tracing.Enabled() {
+		hdr.Version = xnet.HeaderVersionWithTrace
+		hdr.Trace = tracing.ToHeader(ctx)
 	}
 	_, err = xio.WriteFull(dataStream, hdr.Marshal())
 	if err != nil {
+		err = streamError(ctx, err)
+		tracing.Fail(span, err)
+		tracing.Fail(connSpan, err)
+		span.End()
 		l.Error("Fail to write header", slogutil.Error(err))
-		return
+		return nil, nil, err
 	}
+	span.End()
 
+	_, span = tracing.Start(ctx, "wait ack")
+	defer span.End()
 	var ack xnet.Acknowledgement
 	err = ack.FromReader(dataStream)
+	if err == nil && !stopReset() {
+		// reset right after the ack
+		err = ctx.Err()
+	}
 	if err != nil {
+		err = streamError(ctx, err)
+		tracing.Fail(span, err)
+		tracing.Fail(connSpan, err)
 		l.Error("Fail to receive ack", slogutil.Error(err))
-		return
+		return nil, nil, err
 	}
-	if ack.Code != xnet.AckCodeOK {
+	metrics.ObserveClientDial(protocol, ack.Code, start)
+	span.SetAttributes(tracing.AttrAckCode.String(metrics.AckCodeName(ack.Code)))
+	switch ack.Code {
+	case xnet.AckCodeOK:
+		return dataStream, errorChan, nil
+	case xnet.AckCodeForbidden:
+		l.Error("Destination is forbidden by the policy of krelay-server", slog.String(constants.LogFieldDestAddr, dstAddrPort.String()))
+	default:
 		l.Error("Fail to connect", slogutil.Error(ack.Code))
-		return
 	}
+	tracing.Fail(span, ack.Code)
+	tracing.Fail(connSpan, ack.Code)
+	return nil, nil, ack.Code
+}
+
+// streamError explains an error caused by resetting the stream when ctx is
+// done.
+func streamError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return fmt.Errorf("no ack from krelay-server in time: %w", ctx.Err())
+	}
+	return err
+}
 
+// pipeStream copies data between clientConn and dataStream until either side
+// is done. It returns the error reported by the stream, if any.
+func pipeStream(l *slog.Logger, clientConn net.Conn, dataStream httpstream.Stream, errorChan chan error) error {
 	localError := make(chan struct{})
 	remoteDone := make(chan struct{})
 
@@ -86,8 +244,9 @@ func handleTCPConn(clientConn net.Conn, serverConn httpstream.Connection, dstAdd
 	}
 
 	// always expect something on errorChan (it may be nil)
-	err = <-errorChan
+	err := <-errorChan
 	if err != nil {
 		l.Error("Unexpected error from stream", slogutil.Error(err))
 	}
+	return err
 }
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"k8s.io/streaming/pkg/httpstream"
+
+	"github.com/knight42/krelay/pkg/ports"
+	"github.com/knight42/krelay/pkg/remoteaddr"
+	"github.com/knight42/krelay/pkg/xnet"
+)
+
+func TestDialStreamRetry(t *testing.T) {
+	addr, err := xnet.AddrFromIP("10.0.0.1")
+	require.NoError(t, err)
+	dst := xnet.AddrPortFrom(addr, 80)
+
+	testCases := map[string]struct {
+		proto    byte
+		attempts int
+		// every attempt creates an error and a data stream
+		expectStreams int32
+	}{
+		"no retry": {proto: xnet.ProtocolTCP, attempts: 0, expectStreams: 2},
+		"tcp":      {proto: xnet.ProtocolTCP, attempts: 3, expectStreams: 6},
+		"udp":      {proto: xnet.ProtocolUDP, attempts: 3, expectStreams: 2},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			pf := &portForwarder{
+				addrGetter: remoteaddr.NewStaticAddr(addr),
+				ports:      ports.PortPair{RemotePort: 80, Protocol: "tcp"},
+				opts:       connOptions{attempts: tc.attempts, backoff: time.Millisecond},
+			}
+			st := pf.connOpened("127.0.0.1:50000", dst)
+			conn := newFakeConn()
+			// the fake streams are closed before the ack
+			_, _, err := dialStream(t.Context(), slog.Default(), serverConn{Connection: conn}, st.id(), tc.proto, dst, st)
+			require.Error(t, err)
+			require.Equal(t, tc.expectStreams, conn.createCount.Load())
+		})
+	}
+}
+
+func TestDialStreamRetryCanceled(t *testing.T) {
+	addr, err := xnet.AddrFromIP("10.0.0.1")
+	require.NoError(t, err)
+	dst := xnet.AddrPortFrom(addr, 80)
+	pf := &portForwarder{
+		addrGetter: remoteaddr.NewStaticAddr(addr),
+		ports:      ports.PortPair{RemotePort: 80, Protocol: "tcp"},
+		opts:       connOptions{attempts: 100, backoff: time.Hour},
+	}
+	st := pf.connOpened("127.0.0.1:50000", dst)
+	conn := newFakeConn()
+
+	ctx, cancel := context.WithTimeout(t.Context(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, _, err = dialStream(ctx, slog.Default(), serverConn{Connection: conn}, st.id(), xnet.ProtocolTCP, dst, st)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Less(t, time.Since(start), 10*time.Second)
+	// only the first attempt was made before waiting for the backoff
+	require.Equal(t, int32(2), conn.createCount.Load())
+}
+
+// hangingStream blocks reads until it is closed or reset.
+type hangingStream struct {
+	fakeStream
+	once sync.Once
+	done chan struct{}
+}
+
+func (s *hangingStream) Read([]byte) (int, error) {
+	<-s.done
+	return 0, io.EOF
+}
+func (s *hangingStream) Close() error { s.once.Do(func() { close(s.done) }); return nil }
+func (s *hangingStream) Reset() error { return s.Close() }
+
+type hangingConn struct {
+	*fakeConn
+}
+
+func (c hangingConn) CreateStream(http.Header) (httpstream.Stream, error) {
+	return &hangingStream{done: make(chan struct{})}, nil
+}
+
+func TestDialStreamConnectTimeout(t *testing.T) {
+	addr, err := xnet.AddrFromIP("10.0.0.1")
+	require.NoError(t, err)
+	dst := xnet.AddrPortFrom(addr, 80)
+	pf := &portForwarder{
+		addrGetter: remoteaddr.NewStaticAddr(addr),
+		ports:      ports.PortPair{RemotePort: 80, Protocol: "tcp"},
+		opts:       connOptions{connectTimeout: 10 * time.Millisecond},
+	}
+	st := pf.connOpened("127.0.0.1:50000", dst)
+	conn := hangingConn{fakeConn: newFakeConn()}
+	_, _, err = dialStream(t.Context(), slog.Default(), serverConn{Connection: conn}, st.id(), xnet.ProtocolTCP, dst, st)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestRetryable(t *testing.T) {
+	require.True(t, retryable(xnet.AckCode(xnet.AckCodeConnectTimeout)))
+	require.False(t, retryable(xnet.AckCode(xnet.AckCodeForbidden)))
+}
@@ -27,6 +27,21 @@ func example() string {
   # Listen on port 5353 on all addresses, forwarding data to port 53 in the pod
   {{.Name}} --address 0.0.0.0 pod/my-pod 5353:53
 
+  # Listen on port 6379 locally, forwarding data to the pod redis-2 of the statefulset, even if it is recreated
+  {{.Name}} sts/redis/2 6379
+
+  # Listen on port 6379, 6380 and 6381 locally, forwarding data to the pods redis-0, redis-1 and redis-2
+  {{.Name}} --all-pods sts/redis 6379
+
+  # Listen on port 8080 locally, forwarding data to the backend of the ingress rule for "shop.example.com/api"
+  {{.Name}} ingress/web 8080 --host shop.example.com --path /api
+
+  # Listen on port 5432 locally, forwarding data to a pod matching the label selector
+  {{.Name}} -n db selector/app=postgres,tier=primary 5432
+
+  # Listen on port 10250 locally, forwarding data to the kubelet of the node via its InternalIP
+  {{.Name}} node/worker-1 10250
+
   # Listen on port 6379 locally, forwarding data to "redis.cn-north-1.cache.amazonaws.com:6379" from the cluster
   {{.Name}} host/redis.cn-north-1.cache.amazonaws.com 6379
 
@@ -36,6 +51,18 @@ func example() string {
   # Customize the server, and forward local port 5000 to "1.2.3.4:5000"
   {{.Name}} --patch '{"metadata":{"namespace":"kube-public"},"spec":{"nodeSelector":{"k": "v"}}}' ip/1.2.3.4 5000
 
+  # Forward traffic to the targets in targets.txt, starting and stopping targets as the file is edited
+  {{.Name}} --watch -f targets.txt
+
+  # Forward port 8080, and accept requests to add and remove forwards on the unix socket /tmp/krelay.sock
+  {{.Name}} --control unix:/tmp/krelay.sock svc/web 8080:80
+
+  # Forward port 8080, and serve the metrics of krelay and krelay-server on 127.0.0.1:9090
+  {{.Name}} --metrics 127.0.0.1:9090 svc/web 8080:80
+
+  # Forward traffic to the targets in targets.txt, showing a live table of the forwards and their connections
+  {{.Name}} --ui -f targets.txt
+
   # Forward traffic to multiple targets
   cat <<EOF | {{.Name}} -f -
 -l 192.168.1.100 ip/1.2.3.4 5000
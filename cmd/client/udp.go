@@ -1,58 +1,50 @@
 package main
 
 import (
+	"context"
 	"log/slog"
 	"net"
 
-	"k8s.io/streaming/pkg/httpstream"
+	"go.opentelemetry.io/otel/trace"
 
 	"github.com/knight42/krelay/pkg/constants"
 	slogutil "github.com/knight42/krelay/pkg/slog"
+	"github.com/knight42/krelay/pkg/tracing"
 	"github.com/knight42/krelay/pkg/xio"
 	"github.com/knight42/krelay/pkg/xnet"
 )
 
-func handleUDPConn(clientConn net.PacketConn, cliAddr net.Addr, dataCh chan []byte, finish chan<- string, serverConn httpstream.Connection, dstAddrPort xnet.AddrPort) {
-	requestID := xnet.NewRequestID()
+// handleUDPConn relays the packets of cliAddr, received on dataCh with their
+// length prepended, to dstAddrPort through krelay-server, recording the
+// traffic and errors in st, which may be nil.
+func handleUDPConn(clientConn net.PacketConn, cliAddr net.Addr, dataCh chan []byte, serverConn serverConn, dstAddrPort xnet.AddrPort, st *connStats) {
+	requestID := st.id()
 	l := slog.With(slog.String(constants.LogFieldRequestID, requestID))
 	defer l.Debug("handleUDPConn exit")
-	defer func() {
-		finish <- cliAddr.String()
-	}()
 	l.Info("Handling udp connection",
 		slog.String(constants.LogFieldDestAddr, dstAddrPort.String()),
 		slog.String(constants.LogFieldLocalAddr, clientConn.LocalAddr().String()),
 		slog.String("clientAddr", cliAddr.String()),
 	)
 
-	dataStream, errorChan, err := createStream(serverConn, requestID)
-	if err != nil {
-		l.Error("Fail to create stream", slogutil.Error(err))
-		return
-	}
+	ctx, span := tracing.StartConn(context.Background(), trace.SpanKindClient, requestID, constants.ProtocolUDP, dstAddrPort.String())
+	defer span.End()
+	span.SetAttributes(tracing.AttrLocalAddr.String(clientConn.LocalAddr().String()))
 
-	hdr := xnet.Header{
-		RequestID: requestID,
-		Protocol:  xnet.ProtocolUDP,
-		Port:      dstAddrPort.Port(),
-		Addr:      dstAddrPort.Addr(),
-	}
-	_, err = xio.WriteFull(dataStream, hdr.Marshal())
+	dataStream, errorChan, err := dialStream(ctx, l, serverConn, requestID, xnet.ProtocolUDP, dstAddrPort, st)
 	if err != nil {
-		l.Error("Fail to write header", slogutil.Error(err))
+		st.fail(err)
 		return
 	}
+	stopIdle := st.watchIdle(func() {
+		l.Info("Close idle connection")
+		// krelay-server closes the stream in turn
+		_ = dataStream.Close()
+	})
+	defer stopIdle()
 
-	var ack xnet.Acknowledgement
-	err = ack.FromReader(dataStream)
-	if err != nil {
-		l.Error("Fail to receive ack", slogutil.Error(err))
-		return
-	}
-	if ack.Code != xnet.AckCodeOK {
-		l.Error("Fail to connect", slogutil.Error(ack.Code))
-		return
-	}
+	_, transferSpan := tracing.Start(ctx, "transfer")
+	defer transferSpan.End()
 
 	upClosed := make(chan struct{})
 	go func() {
@@ -64,15 +56,18 @@ func handleUDPConn(clientConn net.PacketConn, cliAddr net.Addr, dataCh chan []by
 			select {
 			case data, ok = <-dataCh:
 				if !ok {
+					// inform server we're not sending any more data
+					_ = dataStream.Close()
 					return
 				}
 			case <-upClosed:
 				return
 			}
-			_, err = xio.WriteFull(dataStream, data)
+			_, err := xio.WriteFull(dataStream, data)
 			if err != nil {
 				return
 			}
+			st.addOut(len(data) - 2)
 		}
 	}()
 
@@ -87,10 +82,11 @@ func handleUDPConn(clientConn net.PacketConn, cliAddr net.Addr, dataCh chan []by
 				return
 			}
 
-			_, err = clientConn.WriteTo(buf[:n], cliAddr)
+			n, err = clientConn.WriteTo(buf[:n], cliAddr)
 			if err != nil {
 				return
 			}
+			st.addIn(n)
 		}
 	}()
 
@@ -98,5 +94,6 @@ func handleUDPConn(clientConn net.PacketConn, cliAddr net.Addr, dataCh chan []by
 	err = <-errorChan
 	if err != nil {
 		l.Error("Unexpected error from stream", slogutil.Error(err))
+		st.fail(err)
 	}
 }
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -10,27 +11,34 @@ import (
 	"net"
 	"net/http"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/spf13/pflag"
 	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
 	"k8s.io/streaming/pkg/httpstream"
 
 	"github.com/knight42/krelay/pkg/constants"
+	"github.com/knight42/krelay/pkg/metrics"
+	"github.com/knight42/krelay/pkg/ports"
 	"github.com/knight42/krelay/pkg/remoteaddr"
 	slogutil "github.com/knight42/krelay/pkg/slog"
 	"github.com/knight42/krelay/pkg/xio"
 	"github.com/knight42/krelay/pkg/xnet"
 )
 
-func sendHeartbeats(c httpstream.Connection, interval time.Duration) {
+func sendHeartbeats(c serverConn, interval time.Duration) {
 	tick := time.NewTicker(interval)
 	defer tick.Stop()
 	for {
@@ -41,15 +49,14 @@ func sendHeartbeats(c httpstream.Connection, interval time.Duration) {
 			reqID := xnet.NewRequestID()
 			stream, errCh, err := createStream(c, reqID)
 			if err != nil {
+				metrics.ClientHeartbeatFailures.Inc()
 				slog.Error("Fail to create heartbeat stream", slogutil.Error(err))
 				return
 			}
 			go func() { <-errCh }()
-			hdr := xnet.Header{
-				RequestID: reqID,
-				Protocol:  xnet.ProtocolKeepalive,
-			}
+			hdr := c.newHeader(reqID, xnet.ProtocolKeepalive, xnet.AddrPort{})
 			if _, err := xio.WriteFull(stream, hdr.Marshal()); err != nil {
+				metrics.ClientHeartbeatFailures.Inc()
 				slog.Error("Fail to send heartbeat", slogutil.Error(err))
 				_ = stream.Close()
 				return
@@ -65,7 +72,15 @@ func copyBuffer(b []byte) []byte {
 	return c
 }
 
-func addrGetterForObject(obj runtime.Object, cs kubernetes.Interface, ns string) (remoteaddr.Getter, error) {
+// targetOptions tune how the objects of the targets are resolved.
+type targetOptions struct {
+	remoteaddr.Options
+	// endpoints makes Services with a cluster IP resolve to their endpoints
+	// as well, bypassing kube-proxy.
+	endpoints bool
+}
+
+func addrGetterForObject(obj runtime.Object, cs kubernetes.Interface, ns string, opts targetOptions) (remoteaddr.Getter, error) {
 	switch actual := obj.(type) {
 	case *corev1.Pod:
 		addr, err := xnet.AddrFromIP(actual.Status.PodIP)
@@ -76,61 +91,233 @@ func addrGetterForObject(obj runtime.Object, cs kubernetes.Interface, ns string)
 
 	case *corev1.Service:
 		if actual.Spec.Type == corev1.ServiceTypeExternalName {
+			if opts.Pod != "" {
+				return nil, fmt.Errorf("service %s of type ExternalName has no pods", actual.Name)
+			}
 			addr := xnet.AddrFromHost(actual.Spec.ExternalName)
 			return remoteaddr.NewStaticAddr(addr), nil
 		}
-		if actual.Spec.ClusterIP != corev1.ClusterIPNone {
+		if actual.Spec.ClusterIP != corev1.ClusterIPNone && !opts.endpoints && opts.Pod == "" {
 			addr, err := xnet.AddrFromIP(actual.Spec.ClusterIP)
 			if err != nil {
 				return nil, err
 			}
 			return remoteaddr.NewStaticAddr(addr), nil
 		}
+		return remoteaddr.NewEndpointsAddr(cs, actual, opts.Options)
 
-		if len(actual.Spec.Selector) == 0 {
-			return nil, fmt.Errorf("service selector is empty")
-		}
+	}
 
-		selector := labels.SelectorFromSet(actual.Spec.Selector)
-		return remoteaddr.NewDynamicAddr(cs, ns, selector.String())
+	selector, err := selectorOfObject(obj)
+	if err != nil {
+		return nil, err
+	}
+	return remoteaddr.NewBalancedAddr(cs, ns, selector.String(), opts.Options)
+}
 
+// selectorOfObject returns the selector of the pods managed by a workload.
+func selectorOfObject(obj runtime.Object) (labels.Selector, error) {
+	switch actual := obj.(type) {
 	case *appsv1.ReplicaSet:
-		selector, err := metav1.LabelSelectorAsSelector(actual.Spec.Selector)
-		if err != nil {
-			return nil, err
+		return metav1.LabelSelectorAsSelector(actual.Spec.Selector)
+	case *appsv1.Deployment:
+		return metav1.LabelSelectorAsSelector(actual.Spec.Selector)
+	case *appsv1.StatefulSet:
+		return metav1.LabelSelectorAsSelector(actual.Spec.Selector)
+	case *appsv1.DaemonSet:
+		return metav1.LabelSelectorAsSelector(actual.Spec.Selector)
+	case *batchv1.Job:
+		return metav1.LabelSelectorAsSelector(actual.Spec.Selector)
+	case *batchv1.CronJob:
+		// The Jobs, and thus their selectors, come and go. The pods keep the
+		// labels of the template.
+		tplLabels := actual.Spec.JobTemplate.Spec.Template.Labels
+		if len(tplLabels) == 0 {
+			return nil, fmt.Errorf("cronjob %s has no pod template labels", actual.Name)
 		}
-		return remoteaddr.NewDynamicAddr(cs, ns, selector.String())
+		return labels.SelectorFromSet(tplLabels), nil
+	case *corev1.ReplicationController:
+		if len(actual.Spec.Selector) == 0 {
+			return nil, fmt.Errorf("replicationcontroller %s has no selector", actual.Name)
+		}
+		return labels.SelectorFromSet(actual.Spec.Selector), nil
+	case *unstructured.Unstructured:
+		return selectorOfUnstructured(actual)
+	}
+	return nil, fmt.Errorf("unknown object: %T", obj)
+}
 
-	case *appsv1.Deployment:
-		selector, err := metav1.LabelSelectorAsSelector(actual.Spec.Selector)
-		if err != nil {
-			return nil, err
+// selectorOfUnstructured handles custom workloads like Argo Rollouts or
+// OpenKruise CloneSets. spec.selector may be a LabelSelector or a plain map,
+// otherwise status.selector is used, which is the path the scale subresource
+// of such resources usually points at.
+func selectorOfUnstructured(u *unstructured.Unstructured) (labels.Selector, error) {
+	sel, found, err := unstructured.NestedMap(u.Object, "spec", "selector")
+	if err == nil && found {
+		_, hasLabels := sel["matchLabels"]
+		_, hasExprs := sel["matchExpressions"]
+		if hasLabels || hasExprs {
+			var ls metav1.LabelSelector
+			err := runtime.DefaultUnstructuredConverter.FromUnstructured(sel, &ls)
+			if err != nil {
+				return nil, fmt.Errorf("parse spec.selector of %s %s: %w", u.GetKind(), u.GetName(), err)
+			}
+			return metav1.LabelSelectorAsSelector(&ls)
+		}
+		set, found, err := unstructured.NestedStringMap(u.Object, "spec", "selector")
+		if err == nil && found && len(set) > 0 {
+			return labels.SelectorFromSet(set), nil
+		}
+	}
+
+	str, found, err := unstructured.NestedString(u.Object, "status", "selector")
+	if err == nil && found && len(str) > 0 {
+		return labels.Parse(str)
+	}
+	return nil, fmt.Errorf("%s %s has neither spec.selector nor status.selector", u.GetKind(), u.GetName())
+}
+
+// toTypedObject converts u to its typed counterpart if the scheme knows its
+// kind. Custom resources stay unstructured.
+func toTypedObject(u *unstructured.Unstructured) (runtime.Object, error) {
+	obj, err := scheme.Scheme.New(u.GroupVersionKind())
+	if err != nil {
+		if runtime.IsNotRegisteredError(err) {
+			return u, nil
 		}
-		return remoteaddr.NewDynamicAddr(cs, ns, selector.String())
+		return nil, err
+	}
+	err = runtime.DefaultUnstructuredConverter.FromUnstructured(u.Object, obj)
+	if err != nil {
+		return nil, fmt.Errorf("convert %s: %w", u.GetKind(), err)
+	}
+	return obj, nil
+}
+
+// podTarget is a pod that a target is narrowed down to. The offset is added to
+// the local ports, so that every pod gets its own with --all-pods.
+type podTarget struct {
+	name   string
+	offset uint16
+}
+
+// podsOfObject returns the pods of a target written as TYPE/NAME/POD, where
+// POD is an ordinal for StatefulSets and a pod name for Services, or all of
+// them with --all-pods. It returns a single unnamed podTarget otherwise.
+func podsOfObject(ctx context.Context, obj runtime.Object, cs kubernetes.Interface, pod string, allPods bool) ([]podTarget, error) {
+	if !allPods && pod == "" {
+		return []podTarget{{}}, nil
+	}
+	if allPods && pod != "" {
+		return nil, errors.New("--all-pods cannot be used with a specific pod")
+	}
 
+	switch actual := obj.(type) {
 	case *appsv1.StatefulSet:
-		selector, err := metav1.LabelSelectorAsSelector(actual.Spec.Selector)
-		if err != nil {
-			return nil, err
+		if pod != "" {
+			ordinal, err := strconv.ParseUint(pod, 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("invalid ordinal: %q", pod)
+			}
+			return []podTarget{{name: fmt.Sprintf("%s-%d", actual.Name, ordinal)}}, nil
 		}
-		return remoteaddr.NewDynamicAddr(cs, ns, selector.String())
 
-	case *appsv1.DaemonSet:
-		selector, err := metav1.LabelSelectorAsSelector(actual.Spec.Selector)
+		replicas := int32(1)
+		if actual.Spec.Replicas != nil {
+			replicas = *actual.Spec.Replicas
+		}
+		var start int32
+		if actual.Spec.Ordinals != nil {
+			start = actual.Spec.Ordinals.Start
+		}
+		ret := make([]podTarget, 0, replicas)
+		for ordinal := start; ordinal < start+replicas; ordinal++ {
+			ret = append(ret, podTarget{
+				name:   fmt.Sprintf("%s-%d", actual.Name, ordinal),
+				offset: uint16(ordinal),
+			})
+		}
+		return ret, nil
+
+	case *corev1.Service:
+		if pod != "" {
+			return []podTarget{{name: pod}}, nil
+		}
+
+		// Services have no ordinals, the pods are only counted here and
+		// numbered by name as they are now, see remoteaddr.NewEndpointsSlots.
+		sliceList, err := cs.DiscoveryV1().EndpointSlices(actual.Namespace).List(ctx, metav1.ListOptions{
+			LabelSelector: discoveryv1.LabelServiceName + "=" + actual.Name,
+		})
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("list endpointslices: %w", err)
+		}
+		var names []string
+		for _, slice := range sliceList.Items {
+			for _, ep := range slice.Endpoints {
+				if ep.TargetRef != nil && ep.TargetRef.Kind == "Pod" && !slices.Contains(names, ep.TargetRef.Name) {
+					names = append(names, ep.TargetRef.Name)
+				}
+			}
 		}
-		return remoteaddr.NewDynamicAddr(cs, ns, selector.String())
+		if len(names) == 0 {
+			return nil, fmt.Errorf("no pods found behind service %s", actual.Name)
+		}
+		slices.Sort(names)
+		ret := make([]podTarget, 0, len(names))
+		for i, name := range names {
+			ret = append(ret, podTarget{name: name, offset: uint16(i)})
+		}
+		return ret, nil
 	}
 
-	return nil, fmt.Errorf("unknown object: %T", obj)
+	return nil, fmt.Errorf("per-pod forwarding is only supported for statefulsets and services, not %T", obj)
+}
+
+// resolvedTarget is a remote address getter together with the offset added to
+// the local ports of the target.
+type resolvedTarget struct {
+	addrGetter remoteaddr.Getter
+	portOffset uint16
+}
+
+// checkPortOffsets rejects fixed local ports that end up on the same port once
+// the offsets of the pods are added, e.g. 6379 and 6380 with 3 pods.
+func checkPortOffsets(forwardPorts []ports.PortPair, resolved []resolvedTarget) error {
+	if len(resolved) < 2 {
+		return nil
+	}
+	type localPort struct {
+		port     int
+		protocol string
+	}
+	bases := map[localPort]uint16{}
+	for _, pp := range forwardPorts {
+		if pp.LocalPort == 0 {
+			continue
+		}
+		for _, rt := range resolved {
+			lp := localPort{port: int(pp.LocalPort) + int(rt.portOffset), protocol: pp.Protocol}
+			if base, ok := bases[lp]; ok && base != pp.LocalPort {
+				return fmt.Errorf("local ports %d and %d overlap with %d pods, they have to be at least %d apart", base, pp.LocalPort, len(resolved), len(resolved))
+			}
+			bases[lp] = pp.LocalPort
+		}
+	}
+	return nil
 }
 
 func createStream(c httpstream.Connection, reqID string) (dataStream httpstream.Stream, errCh chan error, err error) {
+	return createStreamToPort(c, reqID, constants.ServerPort)
+}
+
+// createStreamToPort is like createStream, but forwards to another port of
+// the krelay-server pod.
+func createStreamToPort(c httpstream.Connection, reqID string, port int) (dataStream httpstream.Stream, errCh chan error, err error) {
 	// create error stream
 	headers := http.Header{}
 	headers.Set(corev1.StreamType, corev1.StreamTypeError)
-	headers.Set(corev1.PortHeader, strconv.Itoa(constants.ServerPort))
+	headers.Set(corev1.PortHeader, strconv.Itoa(port))
 	headers.Set(corev1.PortForwardRequestIDHeader, reqID)
 	errStream, err := c.CreateStream(headers)
 	if err != nil {
@@ -168,13 +355,43 @@ func createStream(c httpstream.Connection, reqID string) (dataStream httpstream.
 	return dataStream, errCh, nil
 }
 
+// selectorPrefix starts a target given by a label selector, e.g.
+// selector/app=foo,tier=db.
+const selectorPrefix = "selector/"
+
+// firstPodOfSelector returns the first pod by name matching the selector, whose
+// container ports are used to resolve named ports. It returns nil if no pod
+// matches.
+func firstPodOfSelector(ctx context.Context, cs kubernetes.Interface, ns, selector string) (*corev1.Pod, error) {
+	podList, err := cs.CoreV1().Pods(ns).List(ctx, metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return nil, fmt.Errorf("list pods: %w", err)
+	}
+	if len(podList.Items) == 0 {
+		return nil, nil
+	}
+	pod := slices.MinFunc(podList.Items, func(a, b corev1.Pod) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return &pod, nil
+}
+
 func validateFields(fields []string) error {
 	if len(fields) < 2 {
 		return fmt.Errorf("invalid syntax")
 	}
 
+	// label keys may contain slashes, so the selector is validated as a whole
+	if sel, ok := strings.CutPrefix(fields[0], selectorPrefix); ok {
+		_, err := labels.Parse(sel)
+		if err != nil || len(sel) == 0 {
+			return fmt.Errorf("invalid selector: %q", sel)
+		}
+		return nil
+	}
+
 	resourceParts := strings.Split(fields[0], "/")
-	if len(resourceParts) > 2 {
+	if len(resourceParts) > 3 || (len(resourceParts) == 3 && (resourceParts[0] == "ip" || resourceParts[0] == "host" || resourceParts[0] == "node")) {
 		return fmt.Errorf("unknown resource: %q", fields[0])
 	}
 
@@ -188,10 +405,25 @@ func validateFields(fields []string) error {
 }
 
 type target struct {
+	// name identifies the target in the logs, the resource is used if empty.
+	name      string
 	resource  string
 	ports     []string
 	namespace string
 	lisAddr   string
+	// allPods forwards to every pod of the target, each on its own local ports.
+	allPods bool
+	// host and path pick the rule of an Ingress or HTTPRoute target.
+	host string
+	path string
+	// kubeconfig and context select the cluster of the target, empty values
+	// mean the one given on the command line.
+	kubeconfig string
+	context    string
+	// lb and readiness override --lb and --readiness if not empty.
+	lb        string
+	readiness string
+	opts      connOptions
 }
 
 func parseTargetsFile(r io.Reader, defaultNamespace string) ([]target, error) {
@@ -201,11 +433,21 @@ func parseTargetsFile(r io.Reader, defaultNamespace string) ([]target, error) {
 	var (
 		ns         string
 		listenAddr string
+		allPods    bool
+		host       string
+		path       string
+		kubeconfig string
+		kubeCtx    string
 	)
 	const defaultListenAddr = "127.0.0.1"
 
-	fs.StringVarP(&ns, "namespace", "n", defaultNamespace, "namespace")
+	fs.StringVarP(&ns, "namespace", "n", "", "namespace")
 	fs.StringVarP(&listenAddr, "address", "l", defaultListenAddr, "listen address")
+	fs.BoolVar(&allPods, "all-pods", false, "forward to every pod")
+	fs.StringVar(&host, "host", "", "host of the route")
+	fs.StringVar(&path, "path", "", "path of the route")
+	fs.StringVar(&kubeconfig, "kubeconfig", "", "kubeconfig of the cluster")
+	fs.StringVar(&kubeCtx, "context", "", "context of the cluster")
 
 	s := bufio.NewScanner(r)
 	var ret []target
@@ -220,22 +462,35 @@ func parseTargetsFile(r io.Reader, defaultNamespace string) ([]target, error) {
 
 		fields := strings.Fields(line)
 		// We need to reset the state before parsing the next line
-		ns = defaultNamespace
+		ns = ""
 		listenAddr = defaultListenAddr
+		allPods = false
+		host, path = "", ""
+		kubeconfig, kubeCtx = "", ""
 		err := fs.Parse(fields)
 		if err != nil {
 			return nil, fmt.Errorf("line: %d: %w", lineNo, err)
 		}
+		// The default namespace belongs to the cluster given on the command
+		// line, targets in other clusters use the one of their context.
+		if len(ns) == 0 && len(kubeconfig) == 0 && len(kubeCtx) == 0 {
+			ns = defaultNamespace
+		}
 		remain := fs.Args()
 		err = validateFields(remain)
 		if err != nil {
 			return nil, fmt.Errorf("line %d: %w", lineNo, err)
 		}
 		ret = append(ret, target{
-			resource:  remain[0],
-			ports:     remain[1:],
-			namespace: ns,
-			lisAddr:   listenAddr,
+			resource:   remain[0],
+			ports:      remain[1:],
+			namespace:  ns,
+			lisAddr:    listenAddr,
+			allPods:    allPods,
+			host:       host,
+			path:       path,
+			kubeconfig: kubeconfig,
+			context:    kubeCtx,
 		})
 	}
 	return ret, nil
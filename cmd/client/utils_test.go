@@ -1,10 +1,21 @@
 package main
 
 import (
+	"context"
 	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/knight42/krelay/pkg/ports"
 )
 
 func TestParseTargetsFile(t *testing.T) {
@@ -106,12 +117,80 @@ svc/q 8000
 				},
 			},
 		},
+		"selector": {
+			input: `-n db selector/app.kubernetes.io/name=postgres,tier!=replica 5432`,
+			expect: []target{
+				{
+					resource:  "selector/app.kubernetes.io/name=postgres,tier!=replica",
+					ports:     []string{"5432"},
+					namespace: "db",
+					lisAddr:   "127.0.0.1",
+				},
+			},
+		},
+		"per-pod": {
+			input: `
+sts/redis/2 6379
+--all-pods sts/redis 6379
+`,
+			expect: []target{
+				{
+					resource: "sts/redis/2",
+					ports:    []string{"6379"},
+					lisAddr:  "127.0.0.1",
+				},
+				{
+					resource: "sts/redis",
+					ports:    []string{"6379"},
+					lisAddr:  "127.0.0.1",
+					allPods:  true,
+				},
+			},
+		},
+
+		"other clusters": {
+			defaultNamespace: "default",
+			input: `
+--context staging svc/web 8080:80
+--kubeconfig /etc/prod.yaml -n shop svc/web 8081:80
+svc/web 8082:80
+`,
+			expect: []target{
+				{
+					resource: "svc/web",
+					ports:    []string{"8080:80"},
+					lisAddr:  "127.0.0.1",
+					context:  "staging",
+				},
+				{
+					resource:   "svc/web",
+					ports:      []string{"8081:80"},
+					namespace:  "shop",
+					lisAddr:    "127.0.0.1",
+					kubeconfig: "/etc/prod.yaml",
+				},
+				{
+					resource:  "svc/web",
+					ports:     []string{"8082:80"},
+					namespace: "default",
+					lisAddr:   "127.0.0.1",
+				},
+			},
+		},
 
 		// invalid cases
 		"invalid ip": {
 			input:     `ip/1.2.3 8080`,
 			expectErr: "invalid IP address",
 		},
+		"invalid selector": {
+			input:     `selector/app=(foo 5432`,
+			expectErr: "invalid selector",
+		},
+		"pod of ip": {
+			input:     `ip/1.2.3.4/0 8080`,
+			expectErr: "unknown resource",
+		},
 		"unknown flag": {
 			input:     `-invalid-flag foo 8080`,
 			expectErr: "unknown shorthand flag",
@@ -137,3 +216,228 @@ svc/q 8000
 		})
 	}
 }
+
+func TestPodsOfObject(t *testing.T) {
+	sts := &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "redis", Namespace: metav1.NamespaceDefault},
+		Spec:       appsv1.StatefulSetSpec{Replicas: new(int32(3))},
+	}
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "redis", Namespace: metav1.NamespaceDefault},
+	}
+	cs := fake.NewClientset(&discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "redis-abc",
+			Namespace: metav1.NamespaceDefault,
+			Labels:    map[string]string{discoveryv1.LabelServiceName: "redis"},
+		},
+		Endpoints: []discoveryv1.Endpoint{
+			{Addresses: []string{"10.0.0.2"}, TargetRef: &corev1.ObjectReference{Kind: "Pod", Name: "redis-b"}},
+			{Addresses: []string{"10.0.0.1"}, TargetRef: &corev1.ObjectReference{Kind: "Pod", Name: "redis-a"}},
+		},
+	})
+
+	testCases := map[string]struct {
+		obj     runtime.Object
+		pod     string
+		allPods bool
+
+		expect    []podTarget
+		expectErr string
+	}{
+		"whole target": {
+			obj:    sts,
+			expect: []podTarget{{}},
+		},
+		"ordinal": {
+			obj:    sts,
+			pod:    "2",
+			expect: []podTarget{{name: "redis-2"}},
+		},
+		"invalid ordinal": {
+			obj:       sts,
+			pod:       "two",
+			expectErr: "invalid ordinal",
+		},
+		"all pods of statefulset": {
+			obj:     sts,
+			allPods: true,
+			expect:  []podTarget{{name: "redis-0"}, {name: "redis-1", offset: 1}, {name: "redis-2", offset: 2}},
+		},
+		"pod of service": {
+			obj:    svc,
+			pod:    "redis-b",
+			expect: []podTarget{{name: "redis-b"}},
+		},
+		"all pods of service": {
+			obj:     svc,
+			allPods: true,
+			expect:  []podTarget{{name: "redis-a"}, {name: "redis-b", offset: 1}},
+		},
+		"deployment": {
+			obj:       &appsv1.Deployment{},
+			allPods:   true,
+			expectErr: "only supported for statefulsets and services",
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			got, err := podsOfObject(context.Background(), tc.obj, cs, tc.pod, tc.allPods)
+			if len(tc.expectErr) == 0 {
+				require.NoError(t, err)
+				require.Equal(t, tc.expect, got)
+				return
+			}
+			require.ErrorContains(t, err, tc.expectErr)
+		})
+	}
+}
+
+func TestCheckPortOffsets(t *testing.T) {
+	threePods := []resolvedTarget{{}, {portOffset: 1}, {portOffset: 2}}
+	testCases := map[string]struct {
+		ports    []ports.PortPair
+		resolved []resolvedTarget
+
+		expectErr string
+	}{
+		"apart": {
+			ports:    []ports.PortPair{{LocalPort: 6379, Protocol: "tcp"}, {LocalPort: 6382, Protocol: "tcp"}},
+			resolved: threePods,
+		},
+		"overlapping": {
+			ports:     []ports.PortPair{{LocalPort: 6379, Protocol: "tcp"}, {LocalPort: 6380, Protocol: "tcp"}},
+			resolved:  threePods,
+			expectErr: "local ports 6379 and 6380 overlap with 3 pods",
+		},
+		"different protocols": {
+			ports:    []ports.PortPair{{LocalPort: 53, Protocol: "tcp"}, {LocalPort: 53, Protocol: "udp"}},
+			resolved: threePods,
+		},
+		"random ports": {
+			ports:    []ports.PortPair{{Protocol: "tcp"}, {Protocol: "tcp"}},
+			resolved: threePods,
+		},
+		"single pod": {
+			ports:    []ports.PortPair{{LocalPort: 6379, Protocol: "tcp"}, {LocalPort: 6380, Protocol: "tcp"}},
+			resolved: []resolvedTarget{{}},
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			err := checkPortOffsets(tc.ports, tc.resolved)
+			if len(tc.expectErr) == 0 {
+				require.NoError(t, err)
+				return
+			}
+			require.ErrorContains(t, err, tc.expectErr)
+		})
+	}
+}
+
+func TestSelectorOfObject(t *testing.T) {
+	testCases := map[string]struct {
+		obj runtime.Object
+
+		expect    string
+		expectErr string
+	}{
+		"job": {
+			obj: &batchv1.Job{Spec: batchv1.JobSpec{
+				Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"batch.kubernetes.io/controller-uid": "abc"}},
+			}},
+			expect: "batch.kubernetes.io/controller-uid=abc",
+		},
+		"cronjob": {
+			obj: &batchv1.CronJob{Spec: batchv1.CronJobSpec{JobTemplate: batchv1.JobTemplateSpec{
+				Spec: batchv1.JobSpec{Template: corev1.PodTemplateSpec{
+					ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": "report"}},
+				}},
+			}}},
+			expect: "app=report",
+		},
+		"replicationcontroller": {
+			obj: &corev1.ReplicationController{Spec: corev1.ReplicationControllerSpec{
+				Selector: map[string]string{"app": "legacy"},
+			}},
+			expect: "app=legacy",
+		},
+		"rollout": {
+			obj: &unstructured.Unstructured{Object: map[string]any{
+				"kind": "Rollout",
+				"spec": map[string]any{
+					"selector": map[string]any{"matchLabels": map[string]any{"app": "web"}},
+				},
+			}},
+			expect: "app=web",
+		},
+		"plain map selector": {
+			obj: &unstructured.Unstructured{Object: map[string]any{
+				"kind": "Legacy",
+				"spec": map[string]any{"selector": map[string]any{"app": "web"}},
+			}},
+			expect: "app=web",
+		},
+		"scale selector": {
+			obj: &unstructured.Unstructured{Object: map[string]any{
+				"kind":   "CloneSet",
+				"status": map[string]any{"selector": "app=web,tier in (frontend)"},
+			}},
+			expect: "app=web,tier in (frontend)",
+		},
+		"no selector": {
+			obj:       &unstructured.Unstructured{Object: map[string]any{"kind": "Widget"}},
+			expectErr: "neither spec.selector nor status.selector",
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			got, err := selectorOfObject(tc.obj)
+			if len(tc.expectErr) == 0 {
+				require.NoError(t, err)
+				require.Equal(t, tc.expect, got.String())
+				return
+			}
+			require.ErrorContains(t, err, tc.expectErr)
+		})
+	}
+}
+
+func TestToTypedObject(t *testing.T) {
+	r := require.New(t)
+	obj, err := toTypedObject(&unstructured.Unstructured{Object: map[string]any{
+		"apiVersion": "batch/v1",
+		"kind":       "Job",
+		"metadata":   map[string]any{"name": "migrate"},
+	}})
+	r.NoError(err)
+	r.IsType(&batchv1.Job{}, obj)
+
+	rollout := &unstructured.Unstructured{Object: map[string]any{
+		"apiVersion": "argoproj.io/v1alpha1",
+		"kind":       "Rollout",
+	}}
+	obj, err = toTypedObject(rollout)
+	r.NoError(err)
+	r.Same(rollout, obj)
+}
+
+func TestFirstPodOfSelector(t *testing.T) {
+	r := require.New(t)
+	newPod := func(name string, labels map[string]string) *corev1.Pod {
+		return &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "db", Labels: labels}}
+	}
+	cs := fake.NewClientset(
+		newPod("pg-b", map[string]string{"app": "postgres"}),
+		newPod("pg-a", map[string]string{"app": "postgres"}),
+		newPod("redis", map[string]string{"app": "redis"}),
+	)
+
+	pod, err := firstPodOfSelector(context.Background(), cs, "db", "app=postgres")
+	r.NoError(err)
+	r.Equal("pg-a", pod.Name)
+
+	pod, err = firstPodOfSelector(context.Background(), cs, "db", "app=mysql")
+	r.NoError(err)
+	r.Nil(pod)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// watchInterval is how often the targets file is checked for changes.
+const watchInterval = time.Second
+
+// watchTargetsFile notifies when the targets file should be read again: on
+// SIGHUP, and if poll is true, whenever its size or modification time changes.
+func watchTargetsFile(ctx context.Context, name string, poll bool) <-chan struct{} {
+	ret := make(chan struct{})
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var tick <-chan time.Time
+	var last os.FileInfo
+	if poll {
+		ticker := time.NewTicker(watchInterval)
+		tick = ticker.C
+		context.AfterFunc(ctx, ticker.Stop)
+		last, _ = os.Stat(name)
+	}
+
+	go func() {
+		defer signal.Stop(hup)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+			case <-tick:
+				fi, err := os.Stat(name)
+				// the file may be missing for a moment while being replaced
+				if err != nil || (last != nil && fi.Size() == last.Size() && fi.ModTime().Equal(last.ModTime())) {
+					continue
+				}
+				last = fi
+			}
+			select {
+			case ret <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ret
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/knight42/krelay/pkg/constants"
+	"github.com/knight42/krelay/pkg/policy"
+	slogutil "github.com/knight42/krelay/pkg/slog"
+	"github.com/knight42/krelay/pkg/xnet"
+)
+
+// advertisedAddr returns an address of this pod that other workloads can use to
+// reach port, since the bind listener listens on all interfaces.
+func advertisedAddr(port uint16) (netip.AddrPort, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	for _, a := range addrs {
+		ipNet, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		ip, ok := netip.AddrFromSlice(ipNet.IP)
+		if !ok {
+			continue
+		}
+		ip = ip.Unmap()
+		if ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+			continue
+		}
+		return netip.AddrPortFrom(ip, port), nil
+	}
+	return netip.AddrPort{}, errors.New("no routable address found")
+}
+
+// handleBind listens on a random port, reports the bound address to the
+// client, then accepts one connection and relays it.
+func (s *server) handleBind(ctx context.Context, l *slog.Logger, c *net.TCPConn, hdr *xnet.Header) {
+	// The port of the request is the one the expected peer connects from,
+	// often 0, so the port rules do not apply. An allowed host name does not
+	// vouch for the peer either, whose IP is checked once it connects.
+	_, err := s.policy.CheckHost(ctx, constants.ProtocolTCP, hdr.Addr.String())
+	if err != nil {
+		s.rejectForbidden(l, c, xnet.JoinHostPort(hdr.Addr.String(), hdr.Port), err)
+		return
+	}
+
+	var lc net.ListenConfig
+	lis, err := lc.Listen(ctx, constants.ProtocolTCP, ":0")
+	if err != nil {
+		l.Error("Fail to listen", slogutil.Error(err))
+		_ = writeACK(c, xnet.Acknowledgement{
+			Code: xnet.AckCodeUnknownError,
+		})
+		return
+	}
+	defer lis.Close()
+
+	tcpLis := lis.(*net.TCPListener)
+	bindAddr, err := advertisedAddr(uint16(tcpLis.Addr().(*net.TCPAddr).Port))
+	if err != nil {
+		l.Error("Fail to get the address of this pod", slogutil.Error(err))
+		_ = writeACK(c, xnet.Acknowledgement{
+			Code: xnet.AckCodeUnknownError,
+		})
+		return
+	}
+	err = writeBindACK(c, bindAddr)
+	if err != nil {
+		l.Error("Fail to write ack", slogutil.Error(err))
+		return
+	}
+	l.Info("Waiting for incoming connection", slog.String(constants.LogFieldLocalAddr, bindAddr.String()))
+
+	if s.bindTimeout > 0 {
+		_ = tcpLis.SetDeadline(time.Now().Add(s.bindTimeout))
+	}
+	// Stop waiting once the client goes away. It sends nothing until the
+	// second ack, so the read only returns when the stream is closed.
+	clientGone := make(chan struct{})
+	go func() {
+		defer close(clientGone)
+		_, _ = c.Read(make([]byte, 1))
+		_ = lis.Close()
+	}()
+	stopCtx := context.AfterFunc(ctx, func() { _ = lis.Close() })
+	peerConn, err := tcpLis.AcceptTCP()
+	stopCtx()
+	_ = c.SetReadDeadline(time.Now())
+	<-clientGone
+	_ = c.SetReadDeadline(time.Time{})
+	if err != nil {
+		l.Error("Fail to accept tcp connection", slogutil.Error(err))
+		_ = writeACK(c, xnet.Acknowledgement{
+			Code: ackCodeFromErr(err),
+		})
+		return
+	}
+	_ = lis.Close()
+
+	peerAddr := peerConn.RemoteAddr().(*net.TCPAddr).AddrPort()
+	err = s.checkBindPeer(ctx, hdr, peerAddr)
+	if err != nil {
+		_ = peerConn.Close()
+		s.rejectForbidden(l, c, peerAddr.String(), err)
+		return
+	}
+	err = writeBindACK(c, peerAddr)
+	if err != nil {
+		_ = peerConn.Close()
+		l.Error("Fail to write ack", slogutil.Error(err))
+		return
+	}
+	l.Info("Start proxy bind request", slog.String(constants.LogFieldDestAddr, peerAddr.String()))
+	xnet.ProxyTCP(hdr.RequestID, c, peerConn)
+}
+
+// checkBindPeer rejects peers whose IP is denied, or not allowed, by the CIDRs
+// of the policy, or that differ from the IP the client expects.
+func (s *server) checkBindPeer(ctx context.Context, hdr *xnet.Header, peerAddr netip.AddrPort) error {
+	err := s.policy.Control(ctx, constants.ProtocolTCP, peerAddr.String(), nil)
+	if err != nil {
+		return err
+	}
+	expected, err := netip.ParseAddr(hdr.Addr.String())
+	if err != nil || expected.IsUnspecified() {
+		return nil
+	}
+	if expected.Unmap() != peerAddr.Addr().Unmap() {
+		return fmt.Errorf("%w: unexpected peer %s", policy.ErrForbidden, peerAddr)
+	}
+	return nil
+}
+
+func writeBindACK(c net.Conn, ap netip.AddrPort) error {
+	err := writeACK(c, xnet.Acknowledgement{
+		Code: xnet.AckCodeOK,
+	})
+	if err != nil {
+		return err
+	}
+	return xnet.WriteBindAddr(c, ap)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/knight42/krelay/pkg/policy"
+	"github.com/knight42/krelay/pkg/testutils/tcp"
+	"github.com/knight42/krelay/pkg/xio"
+	"github.com/knight42/krelay/pkg/xnet"
+)
+
+func TestHandleBind(t *testing.T) {
+	if _, err := advertisedAddr(0); err != nil {
+		t.Skipf("no routable address: %v", err)
+	}
+
+	svr := &server{dialer: &net.Dialer{}, policy: &policy.Policy{}, bindTimeout: time.Second * 10}
+	l := tcp.NewTCPServer(t, func(c net.Conn) {
+		svr.handleConn(context.Background(), c.(*net.TCPConn))
+	})
+	defer l.Close()
+
+	r := require.New(t)
+	c, err := net.Dial("tcp", l.Addr().String())
+	r.NoError(err)
+	defer c.Close()
+
+	unspecified, err := xnet.AddrFromIP("0.0.0.0")
+	r.NoError(err)
+	hdr := xnet.Header{
+		RequestID: xnet.NewRequestID(),
+		Protocol:  xnet.ProtocolTCPBind,
+		Addr:      unspecified,
+	}
+	_, err = xio.WriteFull(c, hdr.Marshal())
+	r.NoError(err)
+
+	var ack xnet.Acknowledgement
+	r.NoError(ack.FromReader(c))
+	r.Equal(xnet.AckCode(xnet.AckCodeOK), ack.Code)
+	bindAddr, err := xnet.ReadBindAddr(c)
+	r.NoError(err)
+
+	peer, err := net.Dial("tcp", bindAddr.String())
+	r.NoError(err)
+	defer peer.Close()
+
+	r.NoError(ack.FromReader(c))
+	r.Equal(xnet.AckCode(xnet.AckCodeOK), ack.Code)
+	peerAddr, err := xnet.ReadBindAddr(c)
+	r.NoError(err)
+	r.Equal(peer.LocalAddr().(*net.TCPAddr).AddrPort().Port(), peerAddr.Port())
+
+	const msg = "Hello, World!"
+	_, err = peer.Write([]byte(msg))
+	r.NoError(err)
+	buf := make([]byte, len(msg))
+	_, err = io.ReadFull(c, buf)
+	r.NoError(err)
+	r.Equal(msg, string(buf))
+}
+
+func TestHandleBindClientGone(t *testing.T) {
+	if _, err := advertisedAddr(0); err != nil {
+		t.Skipf("no routable address: %v", err)
+	}
+
+	// no bind timeout, only the client going away ends the wait
+	svr := &server{dialer: &net.Dialer{}, policy: &policy.Policy{}}
+	done := make(chan struct{})
+	l := tcp.NewTCPServer(t, func(c net.Conn) {
+		defer close(done)
+		svr.handleConn(context.Background(), c.(*net.TCPConn))
+	})
+	defer l.Close()
+
+	r := require.New(t)
+	c, err := net.Dial("tcp", l.Addr().String())
+	r.NoError(err)
+
+	unspecified, err := xnet.AddrFromIP("0.0.0.0")
+	r.NoError(err)
+	hdr := xnet.Header{
+		RequestID: xnet.NewRequestID(),
+		Protocol:  xnet.ProtocolTCPBind,
+		Addr:      unspecified,
+	}
+	_, err = xio.WriteFull(c, hdr.Marshal())
+	r.NoError(err)
+	var ack xnet.Acknowledgement
+	r.NoError(ack.FromReader(c))
+	r.Equal(xnet.AckCode(xnet.AckCodeOK), ack.Code)
+	bindAddr, err := xnet.ReadBindAddr(c)
+	r.NoError(err)
+	_ = c.Close()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handleBind did not return after the client closed the stream")
+	}
+	_, err = net.Dial("tcp", bindAddr.String())
+	r.Error(err)
+}
+
+func TestHandleBindPolicy(t *testing.T) {
+	podAddr, err := advertisedAddr(0)
+	if err != nil {
+		t.Skipf("no routable address: %v", err)
+	}
+
+	testCases := map[string]struct {
+		policy *policy.Policy
+		// peerCode is the code of the second ack, once the peer connects.
+		peerCode xnet.AckCode
+	}{
+		"any peer port with allowed ports": {
+			policy:   &policy.Policy{Ports: []policy.PortRange{{From: 443, To: 443}}},
+			peerCode: xnet.AckCodeOK,
+		},
+		"denied peer": {
+			policy:   &policy.Policy{DenyCIDRs: []netip.Prefix{netip.PrefixFrom(podAddr.Addr(), podAddr.Addr().BitLen())}},
+			peerCode: xnet.AckCodeForbidden,
+		},
+		"peer outside of allowed cidrs": {
+			policy:   &policy.Policy{AllowCIDRs: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}},
+			peerCode: xnet.AckCodeForbidden,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			svr := &server{dialer: &net.Dialer{}, policy: tc.policy, bindTimeout: time.Second * 10}
+			l := tcp.NewTCPServer(t, func(c net.Conn) {
+				svr.handleConn(context.Background(), c.(*net.TCPConn))
+			})
+			defer l.Close()
+
+			r := require.New(t)
+			c, err := net.Dial("tcp", l.Addr().String())
+			r.NoError(err)
+			defer c.Close()
+
+			unspecified, err := xnet.AddrFromIP("0.0.0.0")
+			r.NoError(err)
+			// SOCKS5 clients usually do not know the port of the peer
+			hdr := xnet.Header{
+				RequestID: xnet.NewRequestID(),
+				Protocol:  xnet.ProtocolTCPBind,
+				Addr:      unspecified,
+			}
+			_, err = xio.WriteFull(c, hdr.Marshal())
+			r.NoError(err)
+
+			var ack xnet.Acknowledgement
+			r.NoError(ack.FromReader(c))
+			r.Equal(xnet.AckCode(xnet.AckCodeOK), ack.Code)
+			bindAddr, err := xnet.ReadBindAddr(c)
+			r.NoError(err)
+
+			peer, err := net.Dial("tcp", bindAddr.String())
+			r.NoError(err)
+			defer peer.Close()
+			r.NoError(ack.FromReader(c))
+			r.Equal(tc.peerCode, ack.Code)
+		})
+	}
+}
@@ -2,23 +2,55 @@ package main
 
 import (
 	"context"
+	"crypto/subtle"
 	"errors"
 	"fmt"
 	"log/slog"
 	"net"
+	"net/http"
+	"os"
+	"strconv"
 	"sync/atomic"
 	"time"
 
 	"github.com/spf13/cobra"
+	"go.opentelemetry.io/otel/trace"
 
 	"github.com/knight42/krelay/pkg/constants"
+	"github.com/knight42/krelay/pkg/metrics"
+	"github.com/knight42/krelay/pkg/policy"
 	slogutil "github.com/knight42/krelay/pkg/slog"
+	"github.com/knight42/krelay/pkg/tracing"
 	"github.com/knight42/krelay/pkg/xnet"
 )
 
 type options struct {
 	connectTimeout time.Duration
 	idleTimeout    time.Duration
+	bindTimeout    time.Duration
+	token          string
+
+	policyFile string
+	policy     policy.Config
+
+	// metricsPort serves the metrics if it is not 0.
+	metricsPort int
+	// otlpEndpoint is the OTLP/HTTP collector the spans are exported to. Tracing
+	// is disabled if it is empty.
+	otlpEndpoint string
+}
+
+// server holds what handleConn needs to serve a connection.
+type server struct {
+	dialer *net.Dialer
+	// token must be carried by every header if it is not empty.
+	token string
+	// policy restricts the destinations; it is never nil.
+	policy *policy.Policy
+	// bindTimeout limits how long a bind request waits for the peer.
+	bindTimeout time.Duration
+	// pending holds the inbound connections of reverse listeners.
+	pending *pendingConns
 }
 
 // idleTracker closes the listener when no connections have been active for
@@ -77,13 +109,54 @@ func (t *idleTracker) monitor(ctx context.Context, lis net.Listener) {
 }
 
 func (o *options) run(ctx context.Context) error {
+	err := xnet.ValidateToken(o.token)
+	if err != nil {
+		return fmt.Errorf("invalid token: %w", err)
+	}
+	if len(o.otlpEndpoint) > 0 {
+		shutdown, err := tracing.Setup(ctx, constants.ServerName, o.otlpEndpoint)
+		if err != nil {
+			return err
+		}
+		defer flushSpans(shutdown)
+	}
+
 	tcpListener, err := net.Listen(constants.ProtocolTCP, fmt.Sprintf("0.0.0.0:%d", constants.ServerPort))
 	if err != nil {
 		return err
 	}
 	defer tcpListener.Close()
 
-	dialer := net.Dialer{Timeout: o.connectTimeout}
+	policyCfg := o.policy
+	if len(o.policyFile) > 0 {
+		fileCfg, err := policy.LoadConfig(o.policyFile)
+		if err != nil {
+			return err
+		}
+		policyCfg.Merge(fileCfg)
+	}
+	pol, err := policyCfg.Build()
+	if err != nil {
+		return fmt.Errorf("invalid policy: %w", err)
+	}
+
+	svr := &server{
+		dialer:      &net.Dialer{Timeout: o.connectTimeout},
+		token:       o.token,
+		policy:      pol,
+		bindTimeout: o.bindTimeout,
+		pending:     newPendingConns(),
+	}
+	if !pol.IsEmpty() {
+		svr.dialer.ControlContext = pol.Control
+		slog.Info("Destination policy is enabled")
+	}
+	if len(svr.token) == 0 {
+		slog.Warn("No token is configured, accepting connections from anyone who can reach this pod")
+	}
+	if o.metricsPort > 0 {
+		go serveMetrics(o.metricsPort)
+	}
 	tracker := newIdleTracker(o.idleTimeout)
 	monitorCtx, cancelMonitor := context.WithCancel(ctx)
 	defer cancelMonitor()
@@ -108,18 +181,47 @@ func (o *options) run(ctx context.Context) error {
 		tracker.onConnect()
 		go func(c *net.TCPConn) {
 			defer tracker.onDisconnect()
-			handleConn(ctx, c, &dialer)
+			svr.handleConn(ctx, c)
 		}(c.(*net.TCPConn))
 	}
 }
 
+func flushSpans(shutdown func(context.Context) error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := shutdown(ctx); err != nil {
+		slog.Warn("Fail to flush spans", slogutil.Error(err))
+	}
+}
+
+// serveMetrics serves the metrics on port of the loopback, which port-forward
+// still reaches, so that they are not exposed to the rest of the cluster.
+func serveMetrics(port int) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.ServerHandler())
+	srv := &http.Server{
+		Addr:              fmt.Sprintf("127.0.0.1:%d", port),
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	slog.Info("Serving metrics", slog.Int("port", port))
+	if err := srv.ListenAndServe(); err != nil {
+		slog.Error("Fail to serve metrics", slogutil.Error(err))
+	}
+}
+
 func writeACK(c net.Conn, ack xnet.Acknowledgement) error {
+	metrics.ServerAcks.WithLabelValues(metrics.AckCodeName(ack.Code)).Inc()
 	data := ack.Marshal()
 	_, err := c.Write(data)
 	return err
 }
 
 func ackCodeFromErr(err error) xnet.AckCode {
+	if errors.Is(err, policy.ErrForbidden) {
+		return xnet.AckCodeForbidden
+	}
+
 	var dnsErr *net.DNSError
 	if errors.As(err, &dnsErr) {
 		if dnsErr.IsNotFound {
@@ -138,7 +240,50 @@ func ackCodeFromErr(err error) xnet.AckCode {
 	return xnet.AckCodeUnknownError
 }
 
-func handleConn(ctx context.Context, c *net.TCPConn, dialer *net.Dialer) {
+// startConn starts the span of a proxied connection, as a child of the span
+// of the client if the header carries its trace context.
+func startConn(ctx context.Context, hdr *xnet.Header, protocol, dstAddr string) (context.Context, trace.Span) {
+	return tracing.StartConn(tracing.FromHeader(ctx, hdr.Trace), trace.SpanKindServer, hdr.RequestID, protocol, dstAddr)
+}
+
+// dial connects to a destination and records how long it took.
+func (s *server) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	ctx, span := tracing.Start(ctx, "dial")
+	defer span.End()
+	start := time.Now()
+	conn, err := s.dialer.DialContext(ctx, network, addr)
+	metrics.ServerDialDuration.WithLabelValues(network).Observe(time.Since(start).Seconds())
+	if err != nil {
+		tracing.Fail(span, err)
+	}
+	return conn, err
+}
+
+// observeProxy records a proxied connection once it is closed, and ends the
+// span of its transfer.
+func observeProxy(span trace.Span, protocol string, sent, received int64) {
+	span.SetAttributes(tracing.AttrBytesSent.Int64(sent), tracing.AttrBytesRecv.Int64(received))
+	span.End()
+	metrics.ServerConnsClosed.WithLabelValues(protocol).Inc()
+	metrics.ServerBytes.WithLabelValues(protocol, metrics.DirectionOut).Add(float64(sent))
+	metrics.ServerBytes.WithLabelValues(protocol, metrics.DirectionIn).Add(float64(received))
+}
+
+func (s *server) authorized(hdr *xnet.Header) bool {
+	if len(s.token) == 0 {
+		return true
+	}
+	return subtle.ConstantTimeCompare([]byte(hdr.Token), []byte(s.token)) == 1
+}
+
+func (s *server) rejectForbidden(l *slog.Logger, c net.Conn, dstAddr string, err error) {
+	l.Warn("Reject request forbidden by policy", slog.String(constants.LogFieldDestAddr, dstAddr), slogutil.Error(err))
+	_ = writeACK(c, xnet.Acknowledgement{
+		Code: xnet.AckCodeForbidden,
+	})
+}
+
+func (s *server) handleConn(ctx context.Context, c *net.TCPConn) {
 	defer c.Close()
 
 	hdr := xnet.Header{}
@@ -150,10 +295,27 @@ func handleConn(ctx context.Context, c *net.TCPConn, dialer *net.Dialer) {
 
 	dstAddr := xnet.JoinHostPort(hdr.Addr.String(), hdr.Port)
 	l := slog.With(slog.String(constants.LogFieldRequestID, hdr.RequestID))
+	if !s.authorized(&hdr) {
+		l.Warn("Reject request with invalid token", slog.String("clientAddr", c.RemoteAddr().String()))
+		_ = writeACK(c, xnet.Acknowledgement{
+			Code: xnet.AckCodeUnauthorized,
+		})
+		return
+	}
+
 	switch hdr.Protocol {
 	case xnet.ProtocolTCP:
-		upstreamConn, err := dialer.DialContext(ctx, constants.ProtocolTCP, dstAddr)
+		ctx, span := startConn(ctx, &hdr, constants.ProtocolTCP, dstAddr)
+		defer span.End()
+		dialCtx, err := s.policy.Check(ctx, constants.ProtocolTCP, hdr.Addr.String(), hdr.Port)
 		if err != nil {
+			tracing.Fail(span, err)
+			s.rejectForbidden(l, c, dstAddr, err)
+			return
+		}
+		upstreamConn, err := s.dial(dialCtx, constants.ProtocolTCP, dstAddr)
+		if err != nil {
+			tracing.Fail(span, err)
 			l.Error("Fail to create tcp connection", slog.String(constants.LogFieldDestAddr, dstAddr), slogutil.Error(err))
 			_ = writeACK(c, xnet.Acknowledgement{
 				Code: ackCodeFromErr(err),
@@ -164,15 +326,28 @@ func handleConn(ctx context.Context, c *net.TCPConn, dialer *net.Dialer) {
 			Code: xnet.AckCodeOK,
 		})
 		if err != nil {
+			tracing.Fail(span, err)
 			l.Error("Fail to write ack", slogutil.Error(err))
 			return
 		}
 		l.Info("Start proxy tcp request", slog.String(constants.LogFieldDestAddr, dstAddr))
-		xnet.ProxyTCP(hdr.RequestID, c, upstreamConn.(*net.TCPConn))
+		metrics.ServerConnsOpened.WithLabelValues(constants.ProtocolTCP).Inc()
+		_, transferSpan := tracing.Start(ctx, "transfer")
+		sent, received := xnet.ProxyTCP(hdr.RequestID, c, upstreamConn.(*net.TCPConn))
+		observeProxy(transferSpan, constants.ProtocolTCP, sent, received)
 
 	case xnet.ProtocolUDP:
-		upstreamConn, err := dialer.DialContext(ctx, constants.ProtocolUDP, dstAddr)
+		ctx, span := startConn(ctx, &hdr, constants.ProtocolUDP, dstAddr)
+		defer span.End()
+		dialCtx, err := s.policy.Check(ctx, constants.ProtocolUDP, hdr.Addr.String(), hdr.Port)
+		if err != nil {
+			tracing.Fail(span, err)
+			s.rejectForbidden(l, c, dstAddr, err)
+			return
+		}
+		upstreamConn, err := s.dial(dialCtx, constants.ProtocolUDP, dstAddr)
 		if err != nil {
+			tracing.Fail(span, err)
 			l.Error("Fail to create udp connection", slog.String(constants.LogFieldDestAddr, dstAddr), slogutil.Error(err))
 			_ = writeACK(c, xnet.Acknowledgement{
 				Code: ackCodeFromErr(err),
@@ -183,12 +358,25 @@ func handleConn(ctx context.Context, c *net.TCPConn, dialer *net.Dialer) {
 			Code: xnet.AckCodeOK,
 		})
 		if err != nil {
+			tracing.Fail(span, err)
 			l.Error("Fail to write ack", slogutil.Error(err))
 			return
 		}
 		l.Info("Start proxy udp request", slog.String(constants.LogFieldDestAddr, dstAddr))
 		udpConn := &xnet.UDPConn{UDPConn: upstreamConn.(*net.UDPConn)}
-		xnet.ProxyUDP(hdr.RequestID, c, udpConn)
+		metrics.ServerConnsOpened.WithLabelValues(constants.ProtocolUDP).Inc()
+		_, transferSpan := tracing.Start(ctx, "transfer")
+		sent, received := xnet.ProxyUDP(hdr.RequestID, c, udpConn)
+		observeProxy(transferSpan, constants.ProtocolUDP, sent, received)
+
+	case xnet.ProtocolTCPBind:
+		s.handleBind(ctx, l, c, &hdr)
+
+	case xnet.ProtocolReverseListen:
+		s.handleReverseListen(ctx, l, c, &hdr)
+
+	case xnet.ProtocolReverseAccept:
+		s.handleReverseAccept(l, c, &hdr)
 
 	case xnet.ProtocolKeepalive:
 		l.Debug("Heartbeat received")
@@ -205,6 +393,11 @@ func handleConn(ctx context.Context, c *net.TCPConn, dialer *net.Dialer) {
 	}
 }
 
+func metricsPortFromEnv() int {
+	port, _ := strconv.Atoi(os.Getenv(constants.ServerMetricsPortEnv))
+	return port
+}
+
 func main() {
 	o := options{}
 	c := cobra.Command{
@@ -217,6 +410,17 @@ func main() {
 	flags := c.Flags()
 	flags.DurationVar(&o.connectTimeout, "connect-timeout", time.Second*10, "Timeout for connecting to upstream")
 	flags.DurationVar(&o.idleTimeout, "idle-timeout", 5*time.Minute, "Exit when no connections have been active for this duration after the last client disconnects. 0 disables.")
+	flags.DurationVar(&o.bindTimeout, "bind-timeout", 2*time.Minute, "Timeout for accepting the incoming connection of a bind request. 0 disables.")
+	flags.StringVar(&o.token, "token", os.Getenv(constants.ServerTokenEnv), fmt.Sprintf("Reject requests that do not carry this token. Defaults to $%s.", constants.ServerTokenEnv))
+	flags.StringVar(&o.policyFile, "policy-file", "", "A YAML or JSON file with the allow and deny rules for destinations. Rules from flags are added to it.")
+	flags.StringSliceVar(&o.policy.Allow.CIDRs, "allow-cidr", nil, "Only allow destinations in these CIDRs, unless the hostname is allowed by --allow-host.")
+	flags.StringSliceVar(&o.policy.Deny.CIDRs, "deny-cidr", nil, "Deny destinations in these CIDRs, including hostnames resolving to them.")
+	flags.StringSliceVar(&o.policy.Allow.Hosts, "allow-host", nil, "Only allow hostnames matching these globs, e.g. *.svc.cluster.local, unless the address is allowed by --allow-cidr.")
+	flags.StringSliceVar(&o.policy.Deny.Hosts, "deny-host", nil, "Deny hostnames matching these globs.")
+	flags.StringSliceVar(&o.policy.Allow.Ports, "allow-port", nil, "Only allow these destination ports or port ranges, e.g. 443,8000-9000.")
+	flags.StringSliceVar(&o.policy.Allow.Protocols, "allow-protocol", nil, "Only allow these protocols, tcp or udp.")
+	flags.IntVar(&o.metricsPort, "metrics-port", metricsPortFromEnv(), fmt.Sprintf("Serve Prometheus metrics at /metrics on this port. 0 disables. Defaults to $%s.", constants.ServerMetricsPortEnv))
+	flags.StringVar(&o.otlpEndpoint, "otlp-endpoint", os.Getenv(constants.ServerOTLPEndpointEnv), fmt.Sprintf("Export the spans of the proxied connections to this OTLP/HTTP collector, e.g. http://otel-collector.observability:4318. Defaults to $%s.", constants.ServerOTLPEndpointEnv))
 	flags.IntP("v", "v", 0, "bogus flag to keep backward compatibility. This flag will be removed in the future.")
 	_ = c.Execute()
 }
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/knight42/krelay/pkg/constants"
+	slogutil "github.com/knight42/krelay/pkg/slog"
+	"github.com/knight42/krelay/pkg/xnet"
+)
+
+// pendingTimeout is how long an inbound connection of a reverse listener waits
+// for the client to accept it.
+const pendingTimeout = 30 * time.Second
+
+// pendingConns holds the inbound connections of reverse listeners until the
+// client opens a stream to accept them.
+type pendingConns struct {
+	mu    sync.Mutex
+	conns map[string]pendingConn
+}
+
+// pendingConn is an inbound connection with the key of the listener that
+// accepted it, which is only known to the client owning the listener.
+type pendingConn struct {
+	conn *net.TCPConn
+	key  string
+}
+
+func newPendingConns() *pendingConns {
+	return &pendingConns{conns: map[string]pendingConn{}}
+}
+
+// add registers c, accepted by the listener with the given key, under a new
+// request ID, and closes it if it is not taken within pendingTimeout.
+func (p *pendingConns) add(c *net.TCPConn, key string) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	reqID := xnet.NewRequestID()
+	for _, ok := p.conns[reqID]; ok; _, ok = p.conns[reqID] {
+		reqID = xnet.NewRequestID()
+	}
+	p.conns[reqID] = pendingConn{conn: c, key: key}
+	time.AfterFunc(pendingTimeout, func() {
+		if c, ok := p.take(reqID, key); ok {
+			_ = c.Close()
+		}
+	})
+	return reqID
+}
+
+// take removes the connection announced as reqID, if key is the one of its
+// listener.
+func (p *pendingConns) take(reqID, key string) (*net.TCPConn, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pc, ok := p.conns[reqID]
+	if !ok || subtle.ConstantTimeCompare([]byte(pc.key), []byte(key)) != 1 {
+		return nil, false
+	}
+	delete(p.conns, reqID)
+	return pc.conn, true
+}
+
+// handleReverseListen listens on the port of the header and announces every
+// inbound connection to the client, until the client closes the stream.
+func (s *server) handleReverseListen(ctx context.Context, l *slog.Logger, c *net.TCPConn, hdr *xnet.Header) {
+	// a listener has no destination, only its protocol and port are checked
+	listenAddr := netip.AddrPortFrom(netip.IPv4Unspecified(), hdr.Port)
+	ctx, err := s.policy.Check(ctx, constants.ProtocolTCP, listenAddr.Addr().String(), hdr.Port)
+	if err != nil {
+		s.rejectForbidden(l, c, listenAddr.String(), err)
+		return
+	}
+
+	var lc net.ListenConfig
+	lis, err := lc.Listen(ctx, constants.ProtocolTCP, ":"+strconv.Itoa(int(hdr.Port)))
+	if err != nil {
+		l.Error("Fail to listen", slogutil.Uint16(constants.LogFieldRemotePort, hdr.Port), slogutil.Error(err))
+		_ = writeACK(c, xnet.Acknowledgement{
+			Code: xnet.AckCodeUnknownError,
+		})
+		return
+	}
+	defer lis.Close()
+
+	bindAddr, err := advertisedAddr(uint16(lis.Addr().(*net.TCPAddr).Port))
+	if err != nil {
+		l.Error("Fail to get the address of this pod", slogutil.Error(err))
+		_ = writeACK(c, xnet.Acknowledgement{
+			Code: xnet.AckCodeUnknownError,
+		})
+		return
+	}
+	err = writeBindACK(c, bindAddr)
+	if err != nil {
+		l.Error("Fail to write ack", slogutil.Error(err))
+		return
+	}
+	key := rand.Text()
+	err = xnet.WriteListenerKey(c, key)
+	if err != nil {
+		l.Error("Fail to write listener key", slogutil.Error(err))
+		return
+	}
+	l.Info("Start reverse listener", slog.String(constants.LogFieldLocalAddr, bindAddr.String()))
+
+	// The client closes the stream to stop listening.
+	go func() {
+		_, _ = io.Copy(io.Discard, c)
+		_ = lis.Close()
+	}()
+
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			if !xnet.IsClosedConnectionError(err) {
+				l.Error("Fail to accept tcp connection", slogutil.Error(err))
+			}
+			return
+		}
+		reqID := s.pending.add(conn.(*net.TCPConn), key)
+		l.Debug("Announce inbound connection", slog.String("inboundID", reqID), slog.String("clientAddr", conn.RemoteAddr().String()))
+		err = xnet.WriteRequestID(c, reqID)
+		if err != nil {
+			l.Error("Fail to announce inbound connection", slogutil.Error(err))
+			return
+		}
+	}
+}
+
+// handleReverseAccept relays the inbound connection announced with the request
+// ID of the header, if the header carries the key of its listener.
+func (s *server) handleReverseAccept(l *slog.Logger, c *net.TCPConn, hdr *xnet.Header) {
+	conn, ok := s.pending.take(hdr.RequestID, hdr.Addr.String())
+	if !ok {
+		l.Error("No such inbound connection")
+		_ = writeACK(c, xnet.Acknowledgement{
+			Code: xnet.AckCodeUnknownError,
+		})
+		return
+	}
+	err := writeACK(c, xnet.Acknowledgement{
+		Code: xnet.AckCodeOK,
+	})
+	if err != nil {
+		_ = conn.Close()
+		l.Error("Fail to write ack", slogutil.Error(err))
+		return
+	}
+	l.Info("Start proxy inbound connection", slog.String("clientAddr", conn.RemoteAddr().String()))
+	xnet.ProxyTCP(hdr.RequestID, c, conn)
+}
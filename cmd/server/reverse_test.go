@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/knight42/krelay/pkg/policy"
+	"github.com/knight42/krelay/pkg/xio"
+	"github.com/knight42/krelay/pkg/xnet"
+)
+
+func TestHandleReverse(t *testing.T) {
+	if _, err := advertisedAddr(0); err != nil {
+		t.Skipf("no routable address: %v", err)
+	}
+
+	svr := &server{dialer: &net.Dialer{}, policy: &policy.Policy{}, pending: newPendingConns()}
+	r := require.New(t)
+	// the listen and accept requests come in separate connections
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	r.NoError(err)
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go svr.handleConn(context.Background(), c.(*net.TCPConn))
+		}
+	}()
+
+	listenConn, err := net.Dial("tcp", l.Addr().String())
+	r.NoError(err)
+	defer listenConn.Close()
+
+	// listen on a random port
+	hdr := xnet.Header{
+		RequestID: xnet.NewRequestID(),
+		Protocol:  xnet.ProtocolReverseListen,
+		Addr:      xnet.AddrFromHost(""),
+	}
+	_, err = xio.WriteFull(listenConn, hdr.Marshal())
+	r.NoError(err)
+	var ack xnet.Acknowledgement
+	r.NoError(ack.FromReader(listenConn))
+	r.Equal(xnet.AckCode(xnet.AckCodeOK), ack.Code)
+	bindAddr, err := xnet.ReadBindAddr(listenConn)
+	r.NoError(err)
+	key, err := xnet.ReadListenerKey(listenConn)
+	r.NoError(err)
+
+	inbound, err := net.Dial("tcp", bindAddr.String())
+	r.NoError(err)
+	defer inbound.Close()
+	reqID, err := xnet.ReadRequestID(listenConn)
+	r.NoError(err)
+
+	accept := func(key string) (net.Conn, xnet.AckCode) {
+		c, err := net.Dial("tcp", l.Addr().String())
+		r.NoError(err)
+		hdr := xnet.Header{
+			RequestID: reqID,
+			Protocol:  xnet.ProtocolReverseAccept,
+			Addr:      xnet.AddrFromHost(key),
+		}
+		_, err = xio.WriteFull(c, hdr.Marshal())
+		r.NoError(err)
+		var ack xnet.Acknowledgement
+		r.NoError(ack.FromReader(c))
+		return c, ack.Code
+	}
+
+	// another client knows the request ID, but not the key of the listener
+	foreign, code := accept("")
+	defer foreign.Close()
+	r.Equal(xnet.AckCode(xnet.AckCodeUnknownError), code)
+	foreign, code = accept(key + "x")
+	defer foreign.Close()
+	r.Equal(xnet.AckCode(xnet.AckCodeUnknownError), code)
+
+	acceptConn, code := accept(key)
+	defer acceptConn.Close()
+	r.Equal(xnet.AckCode(xnet.AckCodeOK), code)
+
+	const msg = "Hello, World!"
+	_, err = inbound.Write([]byte(msg))
+	r.NoError(err)
+	buf := make([]byte, len(msg))
+	_, err = io.ReadFull(acceptConn, buf)
+	r.NoError(err)
+	r.Equal(msg, string(buf))
+
+	// the request ID cannot be accepted twice
+	again, code := accept(key)
+	defer again.Close()
+	r.Equal(xnet.AckCode(xnet.AckCodeUnknownError), code)
+}
@@ -11,6 +11,7 @@ import (
 
 	"github.com/stretchr/testify/require"
 
+	"github.com/knight42/krelay/pkg/policy"
 	"github.com/knight42/krelay/pkg/testutils/tcp"
 	"github.com/knight42/krelay/pkg/xio"
 	"github.com/knight42/krelay/pkg/xnet"
@@ -27,8 +28,9 @@ func TestHandleTCPConn(t *testing.T) {
 
 	ctx := context.Background()
 
+	svr := &server{dialer: &dialer, policy: &policy.Policy{}}
 	l := tcp.NewTCPServer(t, func(c net.Conn) {
-		handleConn(ctx, c.(*net.TCPConn), &dialer)
+		svr.handleConn(ctx, c.(*net.TCPConn))
 	})
 	defer l.Close()
 
@@ -69,3 +71,104 @@ func TestHandleTCPConn(t *testing.T) {
 	t.Logf("Got body: %s", string(body))
 	r.Equal(msg, string(body))
 }
+
+func TestHandleConnUnauthorized(t *testing.T) {
+	testCases := map[string]xnet.Header{
+		"missing token": {
+			RequestID: xnet.NewRequestID(),
+			Protocol:  xnet.ProtocolTCP,
+			Port:      80,
+			Addr:      xnet.AddrFromHost("localhost"),
+		},
+		"wrong token": {
+			Version:   xnet.HeaderVersionWithToken,
+			RequestID: xnet.NewRequestID(),
+			Protocol:  xnet.ProtocolTCP,
+			Port:      80,
+			Token:     "wrong",
+			Addr:      xnet.AddrFromHost("localhost"),
+		},
+	}
+	for name, hdr := range testCases {
+		t.Run(name, func(t *testing.T) {
+			svr := &server{dialer: &net.Dialer{}, token: "s3cr3t", policy: &policy.Policy{}}
+			l := tcp.NewTCPServer(t, func(c net.Conn) {
+				svr.handleConn(context.Background(), c.(*net.TCPConn))
+			})
+			defer l.Close()
+
+			r := require.New(t)
+			c, err := net.Dial("tcp", l.Addr().String())
+			r.NoError(err)
+			defer c.Close()
+			_, err = xio.WriteFull(c, hdr.Marshal())
+			r.NoError(err)
+
+			var ack xnet.Acknowledgement
+			r.NoError(ack.FromReader(c))
+			r.Equal(xnet.AckCode(xnet.AckCodeUnauthorized), ack.Code)
+		})
+	}
+}
+
+func TestHandleConnForbidden(t *testing.T) {
+	cfg := policy.Config{
+		Allow: policy.Rules{
+			Hosts: []string{"*.svc.cluster.local"},
+			Ports: []string{"443"},
+		},
+		Deny: policy.Rules{
+			Hosts: []string{"secret.*"},
+		},
+	}
+	pol, err := cfg.Build()
+	require.NoError(t, err)
+	loopback, err := xnet.AddrFromIP("127.0.0.1")
+	require.NoError(t, err)
+
+	testCases := map[string]xnet.Header{
+		"port not allowed": {
+			RequestID: xnet.NewRequestID(),
+			Protocol:  xnet.ProtocolTCP,
+			Port:      80,
+			Addr:      xnet.AddrFromHost("web.default.svc.cluster.local"),
+		},
+		"ip not allowed": {
+			RequestID: xnet.NewRequestID(),
+			Protocol:  xnet.ProtocolTCP,
+			Port:      443,
+			Addr:      loopback,
+		},
+		"bind host denied": {
+			RequestID: xnet.NewRequestID(),
+			Protocol:  xnet.ProtocolTCPBind,
+			Addr:      xnet.AddrFromHost("secret.default.svc.cluster.local"),
+		},
+		"reverse port not allowed": {
+			RequestID: xnet.NewRequestID(),
+			Protocol:  xnet.ProtocolReverseListen,
+			Port:      80,
+		},
+	}
+	for name, hdr := range testCases {
+		t.Run(name, func(t *testing.T) {
+			dialer := &net.Dialer{ControlContext: pol.Control}
+			svr := &server{dialer: dialer, policy: pol}
+			l := tcp.NewTCPServer(t, func(c net.Conn) {
+				svr.handleConn(context.Background(), c.(*net.TCPConn))
+			})
+			defer l.Close()
+
+			r := require.New(t)
+			c, err := net.Dial("tcp", l.Addr().String())
+			r.NoError(err)
+			defer c.Close()
+			_, err = xio.WriteFull(c, hdr.Marshal())
+			r.NoError(err)
+
+			var ack xnet.Acknowledgement
+			r.NoError(ack.FromReader(c))
+			r.Equal(xnet.AckCode(xnet.AckCodeForbidden), ack.Code)
+		})
+	}
+}
@@ -6,13 +6,27 @@ const (
 	LogFieldLocalAddr  = "localAddr"
 	LogFieldRemotePort = "remotePort"
 	LogFieldProtocol   = "protocol"
+	LogFieldTarget     = "target"
 )
 
 const (
 	ServerName = "krelay-server"
 	ServerPort = 9527
+	// ServerTokenEnv is the environment variable krelay-server reads the session token from.
+	ServerTokenEnv = "KRELAY_TOKEN"
+	// ServerMetricsPort is the port krelay-server serves its metrics on when
+	// the client asks for them.
+	ServerMetricsPort = 9528
+	// ServerMetricsPortEnv is the environment variable krelay-server reads the metrics port from.
+	ServerMetricsPortEnv = "KRELAY_METRICS_PORT"
+	// ServerOTLPEndpointEnv is the environment variable krelay-server reads the OTLP collector from.
+	ServerOTLPEndpointEnv = "KRELAY_OTLP_ENDPOINT"
 )
 
+// ControlTokenEnv is the environment variable krelay reads the token of a
+// control API on TCP from.
+const ControlTokenEnv = "KRELAY_CONTROL_TOKEN"
+
 const (
 	UDPBufferSize = 65536 + 2
 	TCPBufferSize = 32768
@@ -2,15 +2,19 @@ package kube
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"os"
+	"strconv"
 	"time"
 
 	"github.com/spf13/pflag"
 	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
+	k8serr "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilrand "k8s.io/apimachinery/pkg/util/rand"
 	"k8s.io/cli-runtime/pkg/genericclioptions"
 	"k8s.io/cli-runtime/pkg/resource"
 	"k8s.io/client-go/kubernetes"
@@ -36,8 +40,23 @@ type Flags struct {
 	patch string
 	// patchFile is the file containing the MergePatch to be applied to the krelay-server pod.
 	patchFile string
+	// sharedServer reuses a krelay-server shared by all clients in the namespace.
+	sharedServer bool
+	// serverMode is either ServerModeJob or ServerModeExisting.
+	serverMode string
+	// serverMetrics makes krelay-server serve its metrics on constants.ServerMetricsPort.
+	serverMetrics bool
+	// serverOTLPEndpoint is the OTLP collector krelay-server exports its spans to.
+	serverOTLPEndpoint string
 }
 
+const (
+	// ServerModeJob runs krelay-server as a Job created for the client.
+	ServerModeJob = "job"
+	// ServerModeExisting attaches to the krelay-server installed by "server install".
+	ServerModeExisting = "existing"
+)
+
 func NewFlags() *Flags {
 	return &Flags{
 		cf: genericclioptions.NewConfigFlags(true),
@@ -53,6 +72,52 @@ func (f *Flags) AddFlags(flags *pflag.FlagSet) {
 	flags.StringVarP(&f.patch, "patch", "p", "", "The merge patch to be applied to the krelay-server pod.")
 	flags.StringVar(&f.patchFile, "patch-file", "", "A file containing a merge patch to be applied to the krelay-server pod.")
 	flags.StringVar(&f.serverImage, "server.image", "ghcr.io/knight42/krelay-server:v0.0.5", "The krelay-server image to use.")
+	flags.StringVar(&f.serverMode, "server-mode", ServerModeJob, fmt.Sprintf("How to run krelay-server. One of: %s, %s.", ServerModeJob, ServerModeExisting))
+	flags.BoolVar(&f.serverMetrics, "server.metrics", false, fmt.Sprintf("Make krelay-server serve Prometheus metrics on port %d, reachable through port-forward.", constants.ServerMetricsPort))
+	flags.StringVar(&f.serverOTLPEndpoint, "server.otlp-endpoint", "", "Make krelay-server export the spans of the proxied connections to this OTLP/HTTP collector, as reached from the cluster.")
+	flags.BoolVar(&f.sharedServer, "server.shared", false, "Attach to a krelay-server shared by all clients in the namespace, creating it if there is none. The last client to exit removes it.")
+}
+
+// Validate rejects combinations of the server flags that cannot work together.
+func (f *Flags) Validate() error {
+	if f.sharedServer && f.serverMode == ServerModeExisting {
+		return fmt.Errorf("--server.shared cannot be used with --server-mode=%s", ServerModeExisting)
+	}
+	return nil
+}
+
+// EnableServerMetrics makes the krelay-server created from now on serve its
+// metrics.
+func (f *Flags) EnableServerMetrics() {
+	f.serverMetrics = true
+}
+
+// WithCluster returns a copy of the flags that talks to the cluster of the
+// given kubeconfig and context instead. Empty values keep the current ones,
+// unless a new kubeconfig is given, in which case its current context is used.
+func (f *Flags) WithCluster(kubeconfig, context string) *Flags {
+	cf := genericclioptions.NewConfigFlags(true)
+	*cf.KubeConfig = *f.cf.KubeConfig
+	*cf.Context = *f.cf.Context
+	*cf.ClusterName = *f.cf.ClusterName
+	*cf.Namespace = *f.cf.Namespace
+	if len(kubeconfig) > 0 || len(context) > 0 {
+		// the cluster and the namespace of the other context apply
+		*cf.ClusterName = ""
+		*cf.Namespace = ""
+	}
+	if len(kubeconfig) > 0 {
+		*cf.KubeConfig = kubeconfig
+		*cf.Context = ""
+	}
+	if len(context) > 0 {
+		*cf.Context = context
+	}
+
+	ret := *f
+	ret.cf = cf
+	ret.restCfg = nil
+	return &ret
 }
 
 func (f *Flags) GetNamespace() (string, bool, error) {
@@ -88,11 +153,16 @@ func (f *Flags) ToResourceBuilder() *resource.Builder {
 	return resource.NewBuilder(f.cf)
 }
 
-func (f *Flags) buildServerJob() (*batchv1.Job, error) {
-	podLabels := map[string]string{
+func newServerLabels() map[string]string {
+	return map[string]string{
 		"app.kubernetes.io/name": constants.ServerName,
 		"app":                    constants.ServerName,
 	}
+}
+
+// buildServerPod returns the krelay-server pod with the user's patch applied.
+func (f *Flags) buildServerPod() (*corev1.Pod, error) {
+	podLabels := newServerLabels()
 	origPod := corev1.Pod{
 		ObjectMeta: metav1.ObjectMeta{
 			Namespace: metav1.NamespaceDefault,
@@ -151,12 +221,29 @@ func (f *Flags) buildServerJob() (*batchv1.Job, error) {
 		}
 		origPod = *patched
 	}
+	if f.serverMetrics {
+		setServerEnv(&origPod.Spec, corev1.EnvVar{Name: constants.ServerMetricsPortEnv, Value: strconv.Itoa(constants.ServerMetricsPort)})
+	}
+	if len(f.serverOTLPEndpoint) > 0 {
+		setServerEnv(&origPod.Spec, corev1.EnvVar{Name: constants.ServerOTLPEndpointEnv, Value: f.serverOTLPEndpoint})
+	}
+	return &origPod, nil
+}
+
+// buildServerJob returns the krelay-server Job. The server reads its token from
+// the named Secret, which is created by createTokenSecret once the Job exists.
+func (f *Flags) buildServerJob(secretName string) (*batchv1.Job, error) {
+	origPod, err := f.buildServerPod()
+	if err != nil {
+		return nil, err
+	}
+	setServerEnv(&origPod.Spec, tokenSecretEnv(secretName))
 
 	job := &batchv1.Job{
 		ObjectMeta: metav1.ObjectMeta{
 			Namespace:    origPod.Namespace,
 			GenerateName: constants.ServerName + "-",
-			Labels:       podLabels,
+			Labels:       newServerLabels(),
 		},
 		Spec: batchv1.JobSpec{
 			BackoffLimit:            new(jobBackoffLimit),
@@ -173,7 +260,13 @@ func (f *Flags) buildServerJob() (*batchv1.Job, error) {
 	return job, nil
 }
 
+// RunServerJob creates a krelay-server Job, or attaches to an existing server
+// depending on the flags, and opens a port-forward connection to its pod.
 func (f *Flags) RunServerJob(ctx context.Context) (*ServerJob, error) {
+	err := f.Validate()
+	if err != nil {
+		return nil, err
+	}
 	restCfg, err := f.ToRESTConfig()
 	if err != nil {
 		return nil, err
@@ -182,11 +275,25 @@ func (f *Flags) RunServerJob(ctx context.Context) (*ServerJob, error) {
 	if err != nil {
 		return nil, err
 	}
+	switch f.serverMode {
+	case ServerModeJob:
+	case ServerModeExisting:
+		return f.attachInstalledServer(ctx, cs)
+	default:
+		return nil, fmt.Errorf("unknown server mode: %q", f.serverMode)
+	}
 
-	svrJob, err := f.buildServerJob()
+	token, err := newToken()
 	if err != nil {
 		return nil, err
 	}
+	svrJob, err := f.buildServerJob(constants.ServerName + "-" + utilrand.String(5))
+	if err != nil {
+		return nil, err
+	}
+	if f.sharedServer {
+		return f.runSharedServer(ctx, cs, svrJob, token)
+	}
 
 	l := slog.With(slog.String("namespace", svrJob.Namespace))
 	l.Info("Creating krelay-server job")
@@ -198,6 +305,12 @@ func (f *Flags) RunServerJob(ctx context.Context) (*ServerJob, error) {
 	// ServerJob handle to call Close() on.
 	cleanup := func() { removeServerJob(cs, createdJob.Namespace, createdJob.Name, time.Minute) }
 
+	err = createTokenSecret(ctx, cs, createdJob, token)
+	if err != nil {
+		cleanup()
+		return nil, err
+	}
+
 	podName, err := waitForServerJobPod(ctx, cs, createdJob.Namespace, createdJob.Name)
 	if err != nil {
 		cleanup()
@@ -205,49 +318,137 @@ func (f *Flags) RunServerJob(ctx context.Context) (*ServerJob, error) {
 	}
 	l.Info("krelay-server is running", slog.String("job", createdJob.Name), slog.String("pod", podName))
 
-	restClient, err := rest.RESTClientFor(restCfg)
+	streamConn, err := dialServerPod(restCfg, createdJob.Namespace, podName)
 	if err != nil {
 		cleanup()
 		return nil, err
 	}
 
+	return &ServerJob{
+		cs:         cs,
+		restCfg:    restCfg,
+		namespace:  createdJob.Namespace,
+		job:        createdJob,
+		podName:    podName,
+		traced:     isServerTraced(&createdJob.Spec.Template.Spec),
+		token:      token,
+		streamConn: streamConn,
+	}, nil
+}
+
+func dialServerPod(restCfg *rest.Config, namespace, podName string) (httpstream.Connection, error) {
+	restClient, err := rest.RESTClientFor(restCfg)
+	if err != nil {
+		return nil, err
+	}
+
 	req := restClient.Post().
 		Resource("pods").
-		Namespace(createdJob.Namespace).Name(podName).
+		Namespace(namespace).Name(podName).
 		SubResource("portforward")
 
 	dialer, err := createDialer(restCfg, req.URL())
 	if err != nil {
-		cleanup()
 		return nil, fmt.Errorf("create dialer: %w", err)
 	}
 
-	l.Info("Creating port-forward stream to krelay-server pod")
+	slog.Info("Creating port-forward stream to krelay-server pod", slog.String("pod", podName))
 	streamConn, _, err := dialer.Dial(constants.PortForwardProtocolV1Name)
 	if err != nil {
-		cleanup()
 		return nil, fmt.Errorf("dial: %w", err)
 	}
-
-	return &ServerJob{
-		cs:         cs,
-		job:        createdJob,
-		streamConn: streamConn,
-	}, nil
+	return streamConn, nil
 }
 
+// ErrServerPodGone is returned by ServerJob.Reconnect when the krelay-server pod
+// is no longer running, so the caller has to create a new Job instead.
+var ErrServerPodGone = errors.New("krelay-server pod is gone")
+
+// ServerJob is a krelay-server Job together with the port-forward connection
+// to its pod. It is not safe for concurrent use.
 type ServerJob struct {
 	cs         kubernetes.Interface
-	job        *batchv1.Job
+	restCfg    *rest.Config
+	namespace  string
+	podName    string
+	token      string
 	streamConn httpstream.Connection
+	// job is nil when attached to a krelay-server installed by "server install".
+	job *batchv1.Job
+	// lease is only set when attached to a shared krelay-server.
+	lease *serverLease
+	// traced is set if the krelay-server exports spans.
+	traced bool
 }
 
 func (p *ServerJob) StreamConn() httpstream.Connection {
 	return p.streamConn
 }
 
+// Token returns the token every request to the krelay-server has to carry. It
+// is empty if the server does not require one.
+func (p *ServerJob) Token() string {
+	return p.token
+}
+
+// Traced reports whether the krelay-server was started with an OTLP endpoint,
+// see --server.otlp-endpoint. Only such servers understand
+// xnet.HeaderVersionWithTrace, older ones reject it.
+func (p *ServerJob) Traced() bool {
+	return p.traced
+}
+
+// Namespace returns the namespace of the krelay-server pod.
+func (p *ServerJob) Namespace() string {
+	return p.namespace
+}
+
+// PodName returns the name of the krelay-server pod.
+func (p *ServerJob) PodName() string {
+	return p.podName
+}
+
+// JobName returns the name of the krelay-server Job, or an empty string when
+// attached to an installed krelay-server.
+func (p *ServerJob) JobName() string {
+	if p.job == nil {
+		return ""
+	}
+	return p.job.Name
+}
+
+// Reconnect re-dials the port-forward connection to the existing krelay-server pod.
+// It returns ErrServerPodGone if the pod has been deleted or has stopped running.
+func (p *ServerJob) Reconnect(ctx context.Context) error {
+	pod, err := p.cs.CoreV1().Pods(p.namespace).Get(ctx, p.podName, metav1.GetOptions{})
+	if err != nil {
+		if k8serr.IsNotFound(err) {
+			return ErrServerPodGone
+		}
+		return fmt.Errorf("get krelay-server pod: %w", err)
+	}
+	if pod.DeletionTimestamp != nil || !isContainerRunning(pod) {
+		return ErrServerPodGone
+	}
+
+	streamConn, err := dialServerPod(p.restCfg, p.namespace, p.podName)
+	if err != nil {
+		return err
+	}
+	_ = p.streamConn.Close()
+	p.streamConn = streamConn
+	return nil
+}
+
 func (p *ServerJob) Close() error {
 	_ = p.streamConn.Close()
+	if p.job == nil {
+		return nil
+	}
+	if p.lease != nil && p.lease.release() {
+		slog.Info("krelay-server is still used by other clients", slog.String("job", p.job.Name))
+		return nil
+	}
 	removeServerJob(p.cs, p.job.Namespace, p.job.Name, time.Minute)
 	return nil
 }
@@ -0,0 +1,413 @@
+package kube
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	k8serr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/yaml"
+
+	"github.com/knight42/krelay/pkg/constants"
+	"github.com/knight42/krelay/pkg/xnet"
+)
+
+const (
+	// labelInstalledServer marks the objects created by "server install".
+	labelInstalledServer = "krelay.knight42.io/installed"
+
+	installFieldManager = "kubectl-relay"
+	// tokenSecretKey is the key of the token in the Secrets of krelay-server.
+	tokenSecretKey = "token"
+	// annotationTokenHash rolls the Deployment out whenever the token changes.
+	annotationTokenHash = "krelay.knight42.io/token-hash"
+	// installedUserRoleName is the Role granting access to the installed krelay-server.
+	installedUserRoleName = constants.ServerName + "-user"
+)
+
+var installedServerSelector = labels.Set{
+	"app.kubernetes.io/name": constants.ServerName,
+	labelInstalledServer:     "true",
+}.String()
+
+// InstallOptions configures the krelay-server installed by "server install".
+type InstallOptions struct {
+	Replicas int32
+	// Users and Groups are bound to the Role that allows connecting to the server.
+	Users  []string
+	Groups []string
+}
+
+// BuildServerInstallation renders the ServiceAccount, token Secret, Deployment
+// and RBAC of a persistent krelay-server. The Deployment uses the same pod
+// template as the Job, including the user's patch. A new token is generated
+// every time.
+func (f *Flags) BuildServerInstallation(opts InstallOptions) ([]runtime.Object, error) {
+	pod, err := f.buildServerPod()
+	if err != nil {
+		return nil, err
+	}
+	token, err := newToken()
+	if err != nil {
+		return nil, err
+	}
+	tokenHash := sha256.Sum256([]byte(token))
+	ns := pod.Namespace
+	objLabels := newServerLabels()
+	objLabels[labelInstalledServer] = "true"
+
+	podLabels := pod.Labels
+	if podLabels == nil {
+		podLabels = map[string]string{}
+	}
+	podLabels[labelInstalledServer] = "true"
+
+	podSpec := pod.Spec
+	// Deployments only support restartPolicy Always, and the server must not
+	// exit when idle, otherwise the pod would keep being restarted.
+	podSpec.RestartPolicy = corev1.RestartPolicyAlways
+	podSpec.ServiceAccountName = constants.ServerName
+	for i := range podSpec.Containers {
+		if podSpec.Containers[i].Name == constants.ServerName {
+			podSpec.Containers[i].Args = append(podSpec.Containers[i].Args, "--idle-timeout=0")
+		}
+	}
+	setServerEnv(&podSpec, tokenSecretEnv(constants.ServerName))
+	podAnnotations := maps.Clone(pod.Annotations)
+	if podAnnotations == nil {
+		podAnnotations = map[string]string{}
+	}
+	podAnnotations[annotationTokenHash] = hex.EncodeToString(tokenHash[:8])
+
+	objs := []runtime.Object{
+		&corev1.ServiceAccount{
+			TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "ServiceAccount"},
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      constants.ServerName,
+				Namespace: ns,
+				Labels:    objLabels,
+			},
+			AutomountServiceAccountToken: new(false),
+		},
+		&corev1.Secret{
+			TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Secret"},
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      constants.ServerName,
+				Namespace: ns,
+				Labels:    objLabels,
+			},
+			Type: corev1.SecretTypeOpaque,
+			StringData: map[string]string{
+				tokenSecretKey: token,
+			},
+		},
+		&appsv1.Deployment{
+			TypeMeta: metav1.TypeMeta{APIVersion: "apps/v1", Kind: "Deployment"},
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      constants.ServerName,
+				Namespace: ns,
+				Labels:    objLabels,
+			},
+			Spec: appsv1.DeploymentSpec{
+				Replicas: new(opts.Replicas),
+				Selector: &metav1.LabelSelector{
+					MatchLabels: map[string]string{
+						"app.kubernetes.io/name": constants.ServerName,
+						labelInstalledServer:     "true",
+					},
+				},
+				Template: corev1.PodTemplateSpec{
+					ObjectMeta: metav1.ObjectMeta{
+						Labels:      podLabels,
+						Annotations: podAnnotations,
+					},
+					Spec: podSpec,
+				},
+			},
+		},
+		&rbacv1.Role{
+			TypeMeta: metav1.TypeMeta{APIVersion: "rbac.authorization.k8s.io/v1", Kind: "Role"},
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      installedUserRoleName,
+				Namespace: ns,
+				Labels:    objLabels,
+			},
+			Rules: []rbacv1.PolicyRule{
+				{
+					APIGroups: []string{""},
+					Resources: []string{"pods"},
+					Verbs:     []string{"get", "list"},
+				},
+				{
+					APIGroups: []string{""},
+					Resources: []string{"pods/portforward"},
+					Verbs:     []string{"create"},
+				},
+				{
+					APIGroups:     []string{""},
+					Resources:     []string{"secrets"},
+					ResourceNames: []string{constants.ServerName},
+					Verbs:         []string{"get"},
+				},
+			},
+		},
+	}
+
+	subjects := make([]rbacv1.Subject, 0, len(opts.Users)+len(opts.Groups))
+	for _, u := range opts.Users {
+		subjects = append(subjects, rbacv1.Subject{Kind: rbacv1.UserKind, APIGroup: rbacv1.GroupName, Name: u})
+	}
+	for _, g := range opts.Groups {
+		subjects = append(subjects, rbacv1.Subject{Kind: rbacv1.GroupKind, APIGroup: rbacv1.GroupName, Name: g})
+	}
+	if len(subjects) > 0 {
+		objs = append(objs, &rbacv1.RoleBinding{
+			TypeMeta: metav1.TypeMeta{APIVersion: "rbac.authorization.k8s.io/v1", Kind: "RoleBinding"},
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      installedUserRoleName,
+				Namespace: ns,
+				Labels:    objLabels,
+			},
+			RoleRef: rbacv1.RoleRef{
+				APIGroup: rbacv1.GroupName,
+				Kind:     "Role",
+				Name:     installedUserRoleName,
+			},
+			Subjects: subjects,
+		})
+	}
+	return objs, nil
+}
+
+// PrintServerInstallation writes the objects as a multi-document YAML stream.
+func PrintServerInstallation(w io.Writer, objs []runtime.Object) error {
+	for i, obj := range objs {
+		data, err := yaml.Marshal(obj)
+		if err != nil {
+			return fmt.Errorf("marshal %T: %w", obj, err)
+		}
+		if i > 0 {
+			_, _ = io.WriteString(w, "---\n")
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// InstallServer applies the objects with server-side apply.
+func (f *Flags) InstallServer(ctx context.Context, objs []runtime.Object) error {
+	cs, err := f.ToClientSet()
+	if err != nil {
+		return err
+	}
+	force := true
+	opts := metav1.PatchOptions{FieldManager: installFieldManager, Force: &force}
+	for _, obj := range objs {
+		data, err := json.Marshal(obj)
+		if err != nil {
+			return fmt.Errorf("marshal %T: %w", obj, err)
+		}
+		accessor, err := meta.Accessor(obj)
+		if err != nil {
+			return err
+		}
+		ns, name := accessor.GetNamespace(), accessor.GetName()
+
+		switch obj.(type) {
+		case *corev1.ServiceAccount:
+			_, err = cs.CoreV1().ServiceAccounts(ns).Patch(ctx, name, types.ApplyPatchType, data, opts)
+		case *corev1.Secret:
+			_, err = cs.CoreV1().Secrets(ns).Patch(ctx, name, types.ApplyPatchType, data, opts)
+		case *appsv1.Deployment:
+			_, err = cs.AppsV1().Deployments(ns).Patch(ctx, name, types.ApplyPatchType, data, opts)
+		case *rbacv1.Role:
+			_, err = cs.RbacV1().Roles(ns).Patch(ctx, name, types.ApplyPatchType, data, opts)
+		case *rbacv1.RoleBinding:
+			_, err = cs.RbacV1().RoleBindings(ns).Patch(ctx, name, types.ApplyPatchType, data, opts)
+		default:
+			return fmt.Errorf("unknown object: %T", obj)
+		}
+		if err != nil {
+			return fmt.Errorf("apply %T %s/%s: %w", obj, ns, name, err)
+		}
+		slog.Info("Applied", slog.String("kind", obj.GetObjectKind().GroupVersionKind().Kind), slog.String("namespace", ns), slog.String("name", name))
+	}
+	return nil
+}
+
+// UninstallServer removes everything created by InstallServer.
+func (f *Flags) UninstallServer(ctx context.Context) error {
+	pod, err := f.buildServerPod()
+	if err != nil {
+		return err
+	}
+	cs, err := f.ToClientSet()
+	if err != nil {
+		return err
+	}
+	ns := pod.Namespace
+
+	deletes := []struct {
+		kind string
+		name string
+		fn   func(context.Context, string, metav1.DeleteOptions) error
+	}{
+		{"RoleBinding", installedUserRoleName, cs.RbacV1().RoleBindings(ns).Delete},
+		{"Role", installedUserRoleName, cs.RbacV1().Roles(ns).Delete},
+		{"Deployment", constants.ServerName, cs.AppsV1().Deployments(ns).Delete},
+		{"Secret", constants.ServerName, cs.CoreV1().Secrets(ns).Delete},
+		{"ServiceAccount", constants.ServerName, cs.CoreV1().ServiceAccounts(ns).Delete},
+	}
+	bg := metav1.DeletePropagationBackground
+	for _, d := range deletes {
+		err := d.fn(ctx, d.name, metav1.DeleteOptions{PropagationPolicy: &bg})
+		switch {
+		case err == nil:
+			slog.Info("Deleted", slog.String("kind", d.kind), slog.String("namespace", ns), slog.String("name", d.name))
+		case k8serr.IsNotFound(err):
+		default:
+			return fmt.Errorf("delete %s %s/%s: %w", d.kind, ns, d.name, err)
+		}
+	}
+	return nil
+}
+
+// ServerStatus describes the krelay-server installed by InstallServer.
+type ServerStatus struct {
+	Namespace     string
+	Image         string
+	Replicas      int32
+	ReadyReplicas int32
+	Pods          []ServerPodStatus
+}
+
+type ServerPodStatus struct {
+	Name  string
+	Phase corev1.PodPhase
+	Ready bool
+	Age   time.Duration
+}
+
+// GetServerStatus returns the status of the installed krelay-server. It
+// returns a NotFound error if the server is not installed.
+func (f *Flags) GetServerStatus(ctx context.Context) (*ServerStatus, error) {
+	pod, err := f.buildServerPod()
+	if err != nil {
+		return nil, err
+	}
+	cs, err := f.ToClientSet()
+	if err != nil {
+		return nil, err
+	}
+	ns := pod.Namespace
+
+	deploy, err := cs.AppsV1().Deployments(ns).Get(ctx, constants.ServerName, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	status := &ServerStatus{
+		Namespace:     ns,
+		ReadyReplicas: deploy.Status.ReadyReplicas,
+	}
+	if deploy.Spec.Replicas != nil {
+		status.Replicas = *deploy.Spec.Replicas
+	}
+	for _, ct := range deploy.Spec.Template.Spec.Containers {
+		if ct.Name == constants.ServerName {
+			status.Image = ct.Image
+		}
+	}
+
+	podList, err := cs.CoreV1().Pods(ns).List(ctx, metav1.ListOptions{LabelSelector: installedServerSelector})
+	if err != nil {
+		return nil, fmt.Errorf("list krelay-server pods: %w", err)
+	}
+	for i := range podList.Items {
+		p := &podList.Items[i]
+		status.Pods = append(status.Pods, ServerPodStatus{
+			Name:  p.Name,
+			Phase: p.Status.Phase,
+			Ready: isContainerRunning(p) && p.DeletionTimestamp == nil,
+			Age:   time.Since(p.CreationTimestamp.Time).Truncate(time.Second),
+		})
+	}
+	return status, nil
+}
+
+// attachInstalledServer connects to a running pod of the krelay-server
+// installed by InstallServer.
+func (f *Flags) attachInstalledServer(ctx context.Context, cs kubernetes.Interface) (*ServerJob, error) {
+	restCfg, err := f.ToRESTConfig()
+	if err != nil {
+		return nil, err
+	}
+	pod, err := f.buildServerPod()
+	if err != nil {
+		return nil, err
+	}
+	ns := pod.Namespace
+
+	podList, err := cs.CoreV1().Pods(ns).List(ctx, metav1.ListOptions{LabelSelector: installedServerSelector})
+	if err != nil {
+		return nil, fmt.Errorf("list krelay-server pods: %w", err)
+	}
+	podName := ""
+	traced := false
+	for i := range podList.Items {
+		p := &podList.Items[i]
+		if p.DeletionTimestamp == nil && isContainerRunning(p) {
+			podName = p.Name
+			traced = isServerTraced(&p.Spec)
+			break
+		}
+	}
+	if len(podName) == 0 {
+		return nil, fmt.Errorf("no running krelay-server pod found in namespace %q, install it with \"server install\" first", ns)
+	}
+	slog.Info("Attaching to installed krelay-server", slog.String("namespace", ns), slog.String("pod", podName))
+
+	token := ""
+	secret, err := cs.CoreV1().Secrets(ns).Get(ctx, constants.ServerName, metav1.GetOptions{})
+	switch {
+	case err == nil:
+		token = string(secret.Data[tokenSecretKey])
+		if err := xnet.ValidateToken(token); err != nil {
+			return nil, fmt.Errorf("invalid krelay-server token: %w", err)
+		}
+	case k8serr.IsNotFound(err):
+		slog.Warn("krelay-server token not found, connecting without a token")
+	default:
+		return nil, fmt.Errorf("get krelay-server token: %w", err)
+	}
+
+	streamConn, err := dialServerPod(restCfg, ns, podName)
+	if err != nil {
+		return nil, err
+	}
+	return &ServerJob{
+		cs:         cs,
+		restCfg:    restCfg,
+		namespace:  ns,
+		podName:    podName,
+		traced:     traced,
+		token:      token,
+		streamConn: streamConn,
+	}, nil
+}
@@ -0,0 +1,49 @@
+package kube
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+
+	"github.com/knight42/krelay/pkg/constants"
+)
+
+func TestBuildServerInstallation(t *testing.T) {
+	r := require.New(t)
+	f := NewFlags()
+	f.serverImage = "krelay-server:test"
+	f.patch = `{"metadata":{"namespace":"krelay"}}`
+
+	objs, err := f.BuildServerInstallation(InstallOptions{Replicas: 2})
+	r.NoError(err)
+	r.Len(objs, 4, "no RoleBinding without users or groups")
+
+	secret, ok := objs[1].(*corev1.Secret)
+	r.True(ok)
+	r.Len(secret.StringData[tokenSecretKey], 32)
+
+	deploy, ok := objs[2].(*appsv1.Deployment)
+	r.True(ok)
+	r.Equal("krelay", deploy.Namespace)
+	r.Equal(int32(2), *deploy.Spec.Replicas)
+	r.Equal("true", deploy.Spec.Template.Labels[labelInstalledServer])
+
+	podSpec := deploy.Spec.Template.Spec
+	r.Equal(corev1.RestartPolicyAlways, podSpec.RestartPolicy)
+	r.Equal([]string{"--idle-timeout=0"}, podSpec.Containers[0].Args)
+	r.Equal("krelay-server:test", podSpec.Containers[0].Image)
+	r.Equal(constants.ServerName, podSpec.Containers[0].Env[0].ValueFrom.SecretKeyRef.Name)
+
+	objs, err = f.BuildServerInstallation(InstallOptions{Replicas: 1, Users: []string{"alice"}, Groups: []string{"devs"}})
+	r.NoError(err)
+	r.Len(objs, 5)
+	binding, ok := objs[4].(*rbacv1.RoleBinding)
+	r.True(ok)
+	r.Equal([]rbacv1.Subject{
+		{Kind: rbacv1.UserKind, APIGroup: rbacv1.GroupName, Name: "alice"},
+		{Kind: rbacv1.GroupKind, APIGroup: rbacv1.GroupName, Name: "devs"},
+	}, binding.Subjects)
+}
@@ -0,0 +1,197 @@
+package kube
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	k8serr "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/knight42/krelay/pkg/constants"
+	slogutil "github.com/knight42/krelay/pkg/slog"
+)
+
+// labelReverseService marks the Services created by "reverse".
+const labelReverseService = "krelay.knight42.io/reverse"
+
+// ReverseService is a temporary Service in front of the ports krelay-server
+// listens on for "reverse". It has no selector, its EndpointSlice points at the
+// krelay-server pod instead, so that it works with every server mode.
+type ReverseService struct {
+	cs        kubernetes.Interface
+	namespace string
+	name      string
+	ports     []int32
+
+	mu sync.Mutex
+	// svc is nil until Apply succeeds.
+	svc *corev1.Service
+	ip  netip.Addr
+}
+
+// NewReverseService returns a Service named name in the namespace of the
+// krelay-server pod. Nothing is created until Apply is called.
+func (f *Flags) NewReverseService(name string, ports []int32) (*ReverseService, error) {
+	cs, err := f.ToClientSet()
+	if err != nil {
+		return nil, err
+	}
+	pod, err := f.buildServerPod()
+	if err != nil {
+		return nil, err
+	}
+	return &ReverseService{cs: cs, namespace: pod.Namespace, name: name, ports: ports}, nil
+}
+
+func reversePortName(port int32) string {
+	return "tcp-" + strconv.Itoa(int(port))
+}
+
+// Apply creates the Service if needed, and points it at ip, the address of the
+// krelay-server pod. It is safe for concurrent use.
+func (s *ReverseService) Apply(ctx context.Context, ip netip.Addr) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.svc != nil && s.ip == ip {
+		return nil
+	}
+
+	if s.svc == nil {
+		svc, err := s.createService(ctx)
+		if err != nil {
+			return err
+		}
+		s.svc = svc
+	}
+
+	slice := s.buildEndpointSlice(ip)
+	slices := s.cs.DiscoveryV1().EndpointSlices(s.namespace)
+	_, err := slices.Create(ctx, slice, metav1.CreateOptions{})
+	if k8serr.IsAlreadyExists(err) {
+		var existing *discoveryv1.EndpointSlice
+		existing, err = slices.Get(ctx, slice.Name, metav1.GetOptions{})
+		if err == nil {
+			slice.ResourceVersion = existing.ResourceVersion
+			_, err = slices.Update(ctx, slice, metav1.UpdateOptions{})
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("apply endpointslice: %w", err)
+	}
+	s.ip = ip
+	slog.Info("Service is pointing at krelay-server", slog.String("service", s.name), slog.String("namespace", s.namespace), slog.String("ip", ip.String()))
+	return nil
+}
+
+func (s *ReverseService) createService(ctx context.Context) (*corev1.Service, error) {
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      s.name,
+			Namespace: s.namespace,
+			Labels: map[string]string{
+				"app.kubernetes.io/name": constants.ServerName,
+				labelReverseService:      "true",
+			},
+		},
+	}
+	for _, port := range s.ports {
+		svc.Spec.Ports = append(svc.Spec.Ports, corev1.ServicePort{
+			Name:     reversePortName(port),
+			Protocol: corev1.ProtocolTCP,
+			Port:     port,
+		})
+	}
+	services := s.cs.CoreV1().Services(s.namespace)
+	created, err := services.Create(ctx, svc, metav1.CreateOptions{})
+	if err == nil {
+		return created, nil
+	}
+	if !k8serr.IsAlreadyExists(err) {
+		return nil, fmt.Errorf("create service: %w", err)
+	}
+
+	// Reuse the Service left behind by a previous run, but never take over
+	// someone else's.
+	existing, err := services.Get(ctx, s.name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("get service: %w", err)
+	}
+	if existing.Labels[labelReverseService] != "true" {
+		return nil, fmt.Errorf("service %s/%s already exists and is not managed by krelay", s.namespace, s.name)
+	}
+	existing.Spec.Ports = svc.Spec.Ports
+	updated, err := services.Update(ctx, existing, metav1.UpdateOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("update service: %w", err)
+	}
+	return updated, nil
+}
+
+func (s *ReverseService) buildEndpointSlice(ip netip.Addr) *discoveryv1.EndpointSlice {
+	addrType := discoveryv1.AddressTypeIPv4
+	if ip.Is6() {
+		addrType = discoveryv1.AddressTypeIPv6
+	}
+	slice := &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      s.name,
+			Namespace: s.namespace,
+			Labels: map[string]string{
+				discoveryv1.LabelServiceName: s.name,
+				discoveryv1.LabelManagedBy:   constants.ServerName,
+			},
+			// The EndpointSlice is garbage-collected together with the Service.
+			OwnerReferences: []metav1.OwnerReference{
+				{
+					APIVersion: "v1",
+					Kind:       "Service",
+					Name:       s.svc.Name,
+					UID:        s.svc.UID,
+				},
+			},
+		},
+		AddressType: addrType,
+		Endpoints: []discoveryv1.Endpoint{
+			{
+				Addresses:  []string{ip.String()},
+				Conditions: discoveryv1.EndpointConditions{Ready: new(true)},
+			},
+		},
+	}
+	for _, port := range s.ports {
+		slice.Ports = append(slice.Ports, discoveryv1.EndpointPort{
+			Name:     new(reversePortName(port)),
+			Protocol: new(corev1.ProtocolTCP),
+			Port:     new(port),
+		})
+	}
+	return slice
+}
+
+// Close deletes the Service if it has been created.
+func (s *ReverseService) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.svc == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	err := s.cs.CoreV1().Services(s.namespace).Delete(ctx, s.name, metav1.DeleteOptions{
+		PropagationPolicy: new(metav1.DeletePropagationBackground),
+	})
+	if err != nil && !k8serr.IsNotFound(err) {
+		slog.Warn("Fail to delete service", slog.String("service", s.name), slogutil.Error(err))
+		return err
+	}
+	s.svc = nil
+	return nil
+}
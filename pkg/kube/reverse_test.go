@@ -0,0 +1,46 @@
+package kube
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestReverseService(t *testing.T) {
+	r := require.New(t)
+	ctx := context.Background()
+	cs := fake.NewClientset()
+	svc := &ReverseService{cs: cs, namespace: metav1.NamespaceDefault, name: "webhook", ports: []int32{8443}}
+
+	r.NoError(svc.Apply(ctx, netip.MustParseAddr("10.0.0.1")))
+	// the krelay-server pod is replaced after a reconnection
+	r.NoError(svc.Apply(ctx, netip.MustParseAddr("10.0.0.2")))
+
+	created, err := cs.CoreV1().Services(metav1.NamespaceDefault).Get(ctx, "webhook", metav1.GetOptions{})
+	r.NoError(err)
+	r.Empty(created.Spec.Selector)
+	r.Equal(int32(8443), created.Spec.Ports[0].Port)
+
+	slice, err := cs.DiscoveryV1().EndpointSlices(metav1.NamespaceDefault).Get(ctx, "webhook", metav1.GetOptions{})
+	r.NoError(err)
+	r.Equal([]string{"10.0.0.2"}, slice.Endpoints[0].Addresses)
+	r.Equal("webhook", slice.Labels["kubernetes.io/service-name"])
+
+	r.NoError(svc.Close())
+	_, err = cs.CoreV1().Services(metav1.NamespaceDefault).Get(ctx, "webhook", metav1.GetOptions{})
+	r.Error(err)
+}
+
+func TestReverseServiceNotManaged(t *testing.T) {
+	cs := fake.NewClientset(&corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "webhook", Namespace: metav1.NamespaceDefault},
+	})
+	svc := &ReverseService{cs: cs, namespace: metav1.NamespaceDefault, name: "webhook", ports: []int32{8443}}
+	err := svc.Apply(context.Background(), netip.MustParseAddr("10.0.0.1"))
+	require.ErrorContains(t, err, "not managed by krelay")
+}
@@ -0,0 +1,352 @@
+package kube
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	corev1 "k8s.io/api/core/v1"
+	k8serr "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	utilrand "k8s.io/apimachinery/pkg/util/rand"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/knight42/krelay/pkg/constants"
+	slogutil "github.com/knight42/krelay/pkg/slog"
+)
+
+const (
+	// labelSharedServer marks the Job and pod of a krelay-server shared by multiple clients.
+	labelSharedServer = "krelay.knight42.io/shared"
+	// labelLeaseServer is set on every client Lease to the name of the shared Job it holds.
+	labelLeaseServer = "krelay.knight42.io/server"
+
+	sharedServerJobName = constants.ServerName + "-shared"
+
+	// maxSharedServerAttempts bounds the retries when the shared Job is
+	// removed while attaching to it.
+	maxSharedServerAttempts = 3
+
+	leaseDurationSeconds int32 = 30
+	leaseRenewInterval         = 10 * time.Second
+)
+
+var sharedServerSelector = labels.Set{
+	"app.kubernetes.io/name": constants.ServerName,
+	labelSharedServer:        "true",
+}.String()
+
+// runSharedServer attaches to the running shared krelay-server in the namespace,
+// creating its Job first if there is none. Every attached client holds a Lease
+// owned by the Job, and the last client to leave removes the Job.
+func (f *Flags) runSharedServer(ctx context.Context, cs kubernetes.Interface, svrJob *batchv1.Job, token string) (*ServerJob, error) {
+	restCfg, err := f.ToRESTConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	ns := svrJob.Namespace
+	job, podName, lease, err := attachSharedServer(ctx, cs, svrJob, token)
+	if err != nil {
+		return nil, err
+	}
+	token, err = tokenFromJob(ctx, cs, job)
+	if err != nil {
+		if !lease.release() {
+			removeServerJob(cs, ns, job.Name, time.Minute)
+		}
+		return nil, err
+	}
+
+	streamConn, err := dialServerPod(restCfg, ns, podName)
+	if err != nil {
+		if !lease.release() {
+			removeServerJob(cs, ns, job.Name, time.Minute)
+		}
+		return nil, err
+	}
+
+	return &ServerJob{
+		cs:         cs,
+		restCfg:    restCfg,
+		namespace:  ns,
+		job:        job,
+		podName:    podName,
+		traced:     isServerTraced(&job.Spec.Template.Spec),
+		token:      token,
+		streamConn: streamConn,
+		lease:      lease,
+	}, nil
+}
+
+// attachSharedServer finds or creates the shared Job and takes a lease on it.
+// The last client may remove the Job between finding it and taking the lease,
+// so the Job is checked again afterwards, and the whole is retried if it has
+// been removed or replaced.
+func attachSharedServer(ctx context.Context, cs kubernetes.Interface, svrJob *batchv1.Job, token string) (*batchv1.Job, string, *serverLease, error) {
+	ns := svrJob.Namespace
+	l := slog.With(slog.String("namespace", ns))
+	for attempt := 1; ; attempt++ {
+		job, podName, err := findSharedServer(ctx, cs, ns)
+		if err != nil {
+			return nil, "", nil, err
+		}
+		if job != nil {
+			l.Info("Attaching to shared krelay-server", slog.String("job", job.Name), slog.String("pod", podName))
+		} else {
+			l.Info("Creating shared krelay-server job")
+			job, err = createSharedServerJob(ctx, cs, svrJob, token)
+			if err != nil {
+				return nil, "", nil, err
+			}
+			podName, err = waitForServerJobPod(ctx, cs, ns, job.Name)
+			if err != nil {
+				return nil, "", nil, fmt.Errorf("wait for krelay-server pod: %w", err)
+			}
+			l.Info("krelay-server is running", slog.String("job", job.Name), slog.String("pod", podName))
+		}
+
+		lease, err := acquireServerLease(ctx, cs, job)
+		if err != nil {
+			return nil, "", nil, err
+		}
+		current, err := cs.BatchV1().Jobs(ns).Get(ctx, job.Name, metav1.GetOptions{})
+		if err != nil && !k8serr.IsNotFound(err) {
+			lease.release()
+			return nil, "", nil, fmt.Errorf("get krelay-server job: %w", err)
+		}
+		if err == nil && current.UID == job.UID && current.DeletionTimestamp == nil && !isJobFinished(current) {
+			return current, podName, lease, nil
+		}
+		// The lease is owned by the old Job and goes away with it.
+		lease.release()
+		if attempt == maxSharedServerAttempts {
+			return nil, "", nil, fmt.Errorf("shared krelay-server job %s keeps going away", job.Name)
+		}
+		l.Info("Shared krelay-server job went away. Will retry.", slog.String("job", job.Name))
+	}
+}
+
+// findSharedServer returns the Job and pod of a running shared krelay-server, or
+// a nil Job if there is none.
+func findSharedServer(ctx context.Context, cs kubernetes.Interface, ns string) (*batchv1.Job, string, error) {
+	podList, err := cs.CoreV1().Pods(ns).List(ctx, metav1.ListOptions{
+		LabelSelector: sharedServerSelector,
+	})
+	if err != nil {
+		return nil, "", fmt.Errorf("list krelay-server pods: %w", err)
+	}
+
+	for i := range podList.Items {
+		pod := &podList.Items[i]
+		if pod.DeletionTimestamp != nil || !isContainerRunning(pod) {
+			continue
+		}
+		jobName := pod.Labels[batchv1.JobNameLabel]
+		if len(jobName) == 0 {
+			continue
+		}
+		job, err := cs.BatchV1().Jobs(ns).Get(ctx, jobName, metav1.GetOptions{})
+		if err != nil {
+			if k8serr.IsNotFound(err) {
+				continue
+			}
+			return nil, "", fmt.Errorf("get krelay-server job: %w", err)
+		}
+		if job.DeletionTimestamp != nil || isJobFinished(job) {
+			continue
+		}
+		return job, pod.Name, nil
+	}
+	return nil, "", nil
+}
+
+// createSharedServerJob creates the shared Job under a fixed name, so that
+// concurrent clients end up with the same Job. A finished Job left behind by an
+// idle server is removed first. Only the client that creates the Job creates
+// its token Secret.
+func createSharedServerJob(ctx context.Context, cs kubernetes.Interface, svrJob *batchv1.Job, token string) (*batchv1.Job, error) {
+	svrJob = svrJob.DeepCopy()
+	svrJob.GenerateName = ""
+	svrJob.Name = sharedServerJobName
+	svrJob.Labels[labelSharedServer] = "true"
+	if svrJob.Spec.Template.Labels == nil {
+		svrJob.Spec.Template.Labels = map[string]string{}
+	}
+	svrJob.Spec.Template.Labels[labelSharedServer] = "true"
+	// A fixed name lets the RBAC of the clients be limited to this Secret.
+	setServerEnv(&svrJob.Spec.Template.Spec, tokenSecretEnv(sharedServerJobName))
+
+	jobCli := cs.BatchV1().Jobs(svrJob.Namespace)
+	var job *batchv1.Job
+	err := wait.PollUntilContextTimeout(ctx, time.Second, time.Minute, true, func(ctx context.Context) (bool, error) {
+		created, err := jobCli.Create(ctx, svrJob, metav1.CreateOptions{})
+		if err == nil {
+			err = createTokenSecret(ctx, cs, created, token)
+			if err != nil {
+				removeServerJob(cs, created.Namespace, created.Name, time.Minute)
+				return false, err
+			}
+			job = created
+			return true, nil
+		}
+		if !k8serr.IsAlreadyExists(err) {
+			return false, fmt.Errorf("create krelay-server job: %w", err)
+		}
+
+		existing, err := jobCli.Get(ctx, svrJob.Name, metav1.GetOptions{})
+		if err != nil {
+			if k8serr.IsNotFound(err) {
+				return false, nil
+			}
+			return false, fmt.Errorf("get krelay-server job: %w", err)
+		}
+		if existing.DeletionTimestamp == nil && !isJobFinished(existing) {
+			job = existing
+			return true, nil
+		}
+		if existing.DeletionTimestamp == nil {
+			slog.Debug("Removing finished shared krelay-server job", slog.String("job", existing.Name))
+			removeServerJob(cs, existing.Namespace, existing.Name, time.Minute)
+		}
+		return false, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+func isJobFinished(job *batchv1.Job) bool {
+	for _, cond := range job.Status.Conditions {
+		if (cond.Type == batchv1.JobComplete || cond.Type == batchv1.JobFailed) && cond.Status == corev1.ConditionTrue {
+			return true
+		}
+	}
+	return false
+}
+
+// serverLease is the reference a client holds on a shared krelay-server. It is
+// renewed in the background until released; leases of crashed clients expire
+// after leaseDurationSeconds.
+type serverLease struct {
+	cs        kubernetes.Interface
+	namespace string
+	name      string
+	jobName   string
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func acquireServerLease(ctx context.Context, cs kubernetes.Interface, job *batchv1.Job) (*serverLease, error) {
+	holder, _ := os.Hostname()
+	holder = fmt.Sprintf("%s-%d", holder, os.Getpid())
+	now := metav1.NewMicroTime(time.Now())
+	lease := &coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      job.Name + "-" + utilrand.String(5),
+			Namespace: job.Namespace,
+			Labels: map[string]string{
+				labelLeaseServer: job.Name,
+			},
+			OwnerReferences: []metav1.OwnerReference{
+				*metav1.NewControllerRef(job, batchv1.SchemeGroupVersion.WithKind("Job")),
+			},
+		},
+		Spec: coordinationv1.LeaseSpec{
+			HolderIdentity:       &holder,
+			LeaseDurationSeconds: new(leaseDurationSeconds),
+			AcquireTime:          &now,
+			RenewTime:            &now,
+		},
+	}
+	created, err := cs.CoordinationV1().Leases(job.Namespace).Create(ctx, lease, metav1.CreateOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("create krelay-server lease: %w", err)
+	}
+
+	l := &serverLease{
+		cs:        cs,
+		namespace: created.Namespace,
+		name:      created.Name,
+		jobName:   job.Name,
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	go l.renew()
+	return l, nil
+}
+
+func (l *serverLease) renew() {
+	defer close(l.done)
+	tick := time.NewTicker(leaseRenewInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-tick.C:
+		}
+
+		patch, _ := json.Marshal(map[string]any{
+			"spec": map[string]any{
+				"renewTime": metav1.NewMicroTime(time.Now()),
+			},
+		})
+		ctx, cancel := context.WithTimeout(context.Background(), leaseRenewInterval)
+		_, err := l.cs.CoordinationV1().Leases(l.namespace).Patch(ctx, l.name, types.MergePatchType, patch, metav1.PatchOptions{})
+		cancel()
+		if err != nil {
+			slog.Warn("Fail to renew krelay-server lease", slog.String("lease", l.name), slogutil.Error(err))
+		}
+	}
+}
+
+// release deletes the lease and reports whether other clients still hold a
+// valid lease on the same server.
+func (l *serverLease) release() (inUse bool) {
+	close(l.stop)
+	<-l.done
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	leaseCli := l.cs.CoordinationV1().Leases(l.namespace)
+	err := leaseCli.Delete(ctx, l.name, metav1.DeleteOptions{})
+	if err != nil && !k8serr.IsNotFound(err) {
+		slog.Warn("Fail to remove krelay-server lease", slog.String("lease", l.name), slogutil.Error(err))
+	}
+
+	leaseList, err := leaseCli.List(ctx, metav1.ListOptions{
+		LabelSelector: labels.Set{labelLeaseServer: l.jobName}.String(),
+	})
+	if err != nil {
+		// Err on the side of keeping the server; it exits on its own once idle.
+		slog.Warn("Fail to list krelay-server leases", slogutil.Error(err))
+		return true
+	}
+	now := time.Now()
+	for i := range leaseList.Items {
+		if isLeaseValid(&leaseList.Items[i], now) {
+			return true
+		}
+	}
+	return false
+}
+
+func isLeaseValid(lease *coordinationv1.Lease, now time.Time) bool {
+	spec := lease.Spec
+	if lease.DeletionTimestamp != nil || spec.RenewTime == nil || spec.LeaseDurationSeconds == nil {
+		return false
+	}
+	expiry := spec.RenewTime.Add(time.Duration(*spec.LeaseDurationSeconds) * time.Second)
+	return now.Before(expiry)
+}
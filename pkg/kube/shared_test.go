@@ -0,0 +1,123 @@
+package kube
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	batchv1 "k8s.io/api/batch/v1"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	corev1 "k8s.io/api/core/v1"
+	k8serr "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"github.com/knight42/krelay/pkg/constants"
+)
+
+func TestServerLeaseRelease(t *testing.T) {
+	r := require.New(t)
+	ctx := context.Background()
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      sharedServerJobName,
+			Namespace: metav1.NamespaceDefault,
+			UID:       "uid",
+		},
+	}
+	cs := fake.NewClientset(job)
+
+	first, err := acquireServerLease(ctx, cs, job)
+	r.NoError(err)
+	second, err := acquireServerLease(ctx, cs, job)
+	r.NoError(err)
+
+	r.True(first.release(), "the second client still holds a lease")
+	r.False(second.release(), "no client holds a lease any more")
+
+	leaseList, err := cs.CoordinationV1().Leases(job.Namespace).List(ctx, metav1.ListOptions{})
+	r.NoError(err)
+	r.Empty(leaseList.Items)
+}
+
+func TestIsLeaseValid(t *testing.T) {
+	now := time.Now()
+	testCases := map[string]struct {
+		renewTime time.Time
+		expected  bool
+	}{
+		"renewed recently": {
+			renewTime: now.Add(-time.Second),
+			expected:  true,
+		},
+		"expired": {
+			renewTime: now.Add(-time.Minute),
+			expected:  false,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			renewTime := metav1.NewMicroTime(tc.renewTime)
+			lease := &coordinationv1.Lease{
+				Spec: coordinationv1.LeaseSpec{
+					LeaseDurationSeconds: new(leaseDurationSeconds),
+					RenewTime:            &renewTime,
+				},
+			}
+			require.Equal(t, tc.expected, isLeaseValid(lease, now))
+		})
+	}
+}
+
+func TestAttachSharedServerRetry(t *testing.T) {
+	r := require.New(t)
+	ctx := context.Background()
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      sharedServerJobName + "-abcde",
+			Namespace: metav1.NamespaceDefault,
+			Labels: map[string]string{
+				"app.kubernetes.io/name": constants.ServerName,
+				labelSharedServer:        "true",
+				batchv1.JobNameLabel:     sharedServerJobName,
+			},
+		},
+		Status: corev1.PodStatus{
+			ContainerStatuses: []corev1.ContainerStatus{{State: corev1.ContainerState{Running: &corev1.ContainerStateRunning{}}}},
+		},
+	}
+	cs := fake.NewClientset(pod)
+	// The Job found first is removed by its last client before the lease is
+	// taken, and replaced by another client.
+	var gets int
+	cs.PrependReactor("get", "jobs", func(k8stesting.Action) (bool, runtime.Object, error) {
+		gets++
+		uid := types.UID("new")
+		switch gets {
+		case 1:
+			uid = "old"
+		case 2:
+			return true, nil, k8serr.NewNotFound(batchv1.Resource("jobs"), sharedServerJobName)
+		}
+		return true, &batchv1.Job{ObjectMeta: metav1.ObjectMeta{Name: sharedServerJobName, Namespace: metav1.NamespaceDefault, UID: uid}}, nil
+	})
+
+	job, podName, lease, err := attachSharedServer(ctx, cs, &batchv1.Job{ObjectMeta: metav1.ObjectMeta{Namespace: metav1.NamespaceDefault}}, "s3cr3t")
+	r.NoError(err)
+	r.Equal(types.UID("new"), job.UID)
+	r.Equal(pod.Name, podName)
+	r.Equal(4, gets)
+	r.False(lease.release())
+}
+
+func TestValidateSharedServer(t *testing.T) {
+	f := NewFlags()
+	f.sharedServer = true
+	require.NoError(t, f.Validate())
+	f.serverMode = ServerModeExisting
+	require.ErrorContains(t, f.Validate(), "--server.shared cannot be used with --server-mode=existing")
+}
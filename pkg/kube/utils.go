@@ -2,16 +2,20 @@ package kube
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"log/slog"
 	"net/http"
 	"net/url"
 	"os"
+	"slices"
 	"strings"
 	"time"
 
 	jsonpatch "github.com/evanphx/json-patch/v5"
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
 	k8serr "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -25,7 +29,9 @@ import (
 	"k8s.io/client-go/transport/spdy"
 	"k8s.io/streaming/pkg/httpstream"
 
+	"github.com/knight42/krelay/pkg/constants"
 	slogutil "github.com/knight42/krelay/pkg/slog"
+	"github.com/knight42/krelay/pkg/xnet"
 )
 
 func patchPod(patchBytes []byte, origPod corev1.Pod) (*corev1.Pod, error) {
@@ -80,17 +86,140 @@ func waitForServerJobPod(ctx context.Context, cs kubernetes.Interface, namespace
 		}
 
 		podObj := ev.Object.(*corev1.Pod)
-		for _, status := range podObj.Status.ContainerStatuses {
-			// there is only one container in the pod
-			if status.State.Running != nil {
-				return podObj.Name, nil
-			}
+		if isContainerRunning(podObj) {
+			return podObj.Name, nil
 		}
 		slog.Debug("Pod is not running. Will retry.", slog.String("pod", podObj.Name))
 	}
 	return "", fmt.Errorf("timed out waiting for krelay-server pod to be running")
 }
 
+// newToken returns a random token for authenticating requests to krelay-server.
+func newToken() (string, error) {
+	var buf [16]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return "", fmt.Errorf("generate token: %w", err)
+	}
+	return hex.EncodeToString(buf[:]), nil
+}
+
+// setServerEnv sets the environment variable on the krelay-server container.
+func setServerEnv(podSpec *corev1.PodSpec, env corev1.EnvVar) {
+	for i := range podSpec.Containers {
+		ct := &podSpec.Containers[i]
+		if ct.Name != constants.ServerName {
+			continue
+		}
+		ct.Env = slices.DeleteFunc(ct.Env, func(e corev1.EnvVar) bool { return e.Name == env.Name })
+		ct.Env = append(ct.Env, env)
+	}
+}
+
+// tokenSecretName returns the name of the Secret the krelay-server of the Job
+// reads its token from, or an empty string if there is none.
+func tokenSecretName(job *batchv1.Job) string {
+	for _, ct := range job.Spec.Template.Spec.Containers {
+		if ct.Name != constants.ServerName {
+			continue
+		}
+		for _, env := range ct.Env {
+			if env.Name == constants.ServerTokenEnv && env.ValueFrom != nil && env.ValueFrom.SecretKeyRef != nil {
+				return env.ValueFrom.SecretKeyRef.Name
+			}
+		}
+	}
+	return ""
+}
+
+// isServerTraced reports whether the krelay-server container exports spans.
+func isServerTraced(podSpec *corev1.PodSpec) bool {
+	for _, ct := range podSpec.Containers {
+		if ct.Name != constants.ServerName {
+			continue
+		}
+		for _, env := range ct.Env {
+			if env.Name == constants.ServerOTLPEndpointEnv && (len(env.Value) > 0 || env.ValueFrom != nil) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// tokenSecretEnv makes krelay-server read its token from the named Secret.
+func tokenSecretEnv(secretName string) corev1.EnvVar {
+	return corev1.EnvVar{
+		Name: constants.ServerTokenEnv,
+		ValueFrom: &corev1.EnvVarSource{
+			SecretKeyRef: &corev1.SecretKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{Name: secretName},
+				Key:                  tokenSecretKey,
+			},
+		},
+	}
+}
+
+// createTokenSecret stores the token in the Secret the krelay-server of the Job
+// reads it from. The Secret is owned by the Job, so that it is garbage-collected
+// together with it. A Secret left behind by a removed Job of the same name is
+// taken over.
+func createTokenSecret(ctx context.Context, cs kubernetes.Interface, job *batchv1.Job, token string) error {
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      tokenSecretName(job),
+			Namespace: job.Namespace,
+			Labels:    newServerLabels(),
+			OwnerReferences: []metav1.OwnerReference{
+				*metav1.NewControllerRef(job, batchv1.SchemeGroupVersion.WithKind("Job")),
+			},
+		},
+		Data: map[string][]byte{
+			tokenSecretKey: []byte(token),
+		},
+	}
+	secrets := cs.CoreV1().Secrets(job.Namespace)
+	_, err := secrets.Create(ctx, secret, metav1.CreateOptions{})
+	if k8serr.IsAlreadyExists(err) {
+		var existing *corev1.Secret
+		existing, err = secrets.Get(ctx, secret.Name, metav1.GetOptions{})
+		if err == nil {
+			secret.ResourceVersion = existing.ResourceVersion
+			_, err = secrets.Update(ctx, secret, metav1.UpdateOptions{})
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("create krelay-server token: %w", err)
+	}
+	return nil
+}
+
+// tokenFromJob returns the token the krelay-server of the Job was started with.
+func tokenFromJob(ctx context.Context, cs kubernetes.Interface, job *batchv1.Job) (string, error) {
+	name := tokenSecretName(job)
+	if len(name) == 0 {
+		return "", nil
+	}
+	secret, err := cs.CoreV1().Secrets(job.Namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("get krelay-server token: %w", err)
+	}
+	token := string(secret.Data[tokenSecretKey])
+	if err := xnet.ValidateToken(token); err != nil {
+		return "", fmt.Errorf("invalid krelay-server token: %w", err)
+	}
+	return token, nil
+}
+
+func isContainerRunning(pod *corev1.Pod) bool {
+	for _, status := range pod.Status.ContainerStatuses {
+		// there is only one container in the pod
+		if status.State.Running != nil {
+			return true
+		}
+	}
+	return false
+}
+
 func removeServerJob(cs kubernetes.Interface, namespace, jobName string, timeout time.Duration) {
 	l := slog.With(slog.String("job", jobName))
 	l.Info("Removing krelay-server job")
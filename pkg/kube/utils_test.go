@@ -1,11 +1,13 @@
 package kube
 
 import (
+	"context"
 	"testing"
 
 	"github.com/stretchr/testify/require"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
 )
 
 func TestPatchPod(t *testing.T) {
@@ -59,3 +61,39 @@ metadata:
 		})
 	}
 }
+
+func TestTokenFromJob(t *testing.T) {
+	r := require.New(t)
+	ctx := context.Background()
+	f := NewFlags()
+	job, err := f.buildServerJob("krelay-server-abcde")
+	r.NoError(err)
+	job.Name = "krelay-server-job"
+	job.Namespace = metav1.NamespaceDefault
+	for _, env := range job.Spec.Template.Spec.Containers[0].Env {
+		r.Empty(env.Value, "the token must not be stored in the pod spec")
+	}
+
+	cs := fake.NewClientset(job)
+	r.NoError(createTokenSecret(ctx, cs, job, "s3cr3t"))
+	secret, err := cs.CoreV1().Secrets(job.Namespace).Get(ctx, "krelay-server-abcde", metav1.GetOptions{})
+	r.NoError(err)
+	r.Equal(job.Name, secret.OwnerReferences[0].Name)
+
+	token, err := tokenFromJob(ctx, cs, job)
+	r.NoError(err)
+	r.Equal("s3cr3t", token)
+}
+
+func TestIsServerTraced(t *testing.T) {
+	r := require.New(t)
+	f := NewFlags()
+	job, err := f.buildServerJob("krelay-server-abcde")
+	r.NoError(err)
+	r.False(isServerTraced(&job.Spec.Template.Spec))
+
+	f.serverOTLPEndpoint = "http://otel-collector.observability:4318"
+	job, err = f.buildServerJob("krelay-server-abcde")
+	r.NoError(err)
+	r.True(isServerTraced(&job.Spec.Template.Spec))
+}
@@ -0,0 +1,171 @@
+// Package metrics defines the Prometheus metrics of krelay and krelay-server.
+//
+// Bytes are counted per direction: "out" is sent towards the destination,
+// "in" is received from it.
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/knight42/krelay/pkg/xnet"
+)
+
+const (
+	DirectionIn  = "in"
+	DirectionOut = "out"
+
+	ResultSuccess = "success"
+	ResultFailure = "failure"
+)
+
+var (
+	clientRegistry = newRegistry()
+	serverRegistry = newRegistry()
+)
+
+func newRegistry() *prometheus.Registry {
+	r := prometheus.NewRegistry()
+	r.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return r
+}
+
+// ClientHandler serves the metrics of krelay.
+func ClientHandler() http.Handler {
+	return promhttp.HandlerFor(clientRegistry, promhttp.HandlerOpts{})
+}
+
+// ServerHandler serves the metrics of krelay-server.
+func ServerHandler() http.Handler {
+	return promhttp.HandlerFor(serverRegistry, promhttp.HandlerOpts{})
+}
+
+var dialBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Metrics of krelay. Connections are labeled with the target, the local
+// address they were accepted on and the protocol; UDP flows count as
+// connections.
+var (
+	ClientConnsOpened = newCounterVec(clientRegistry, "krelay_client_connections_opened_total",
+		"Connections accepted by the forwarders.", "target", "local_addr", "protocol")
+	ClientConnsClosed = newCounterVec(clientRegistry, "krelay_client_connections_closed_total",
+		"Connections of the forwarders that have been closed.", "target", "local_addr", "protocol")
+	ClientBytes = newCounterVec(clientRegistry, "krelay_client_bytes_total",
+		"Bytes forwarded by the forwarders.", "target", "local_addr", "protocol", "direction")
+	ClientUDPConntrackEntries = newGaugeVec(clientRegistry, "krelay_client_udp_conntrack_entries",
+		"Active entries of the UDP conntrack tables.", "target", "local_addr")
+	ClientAcks = newCounterVec(clientRegistry, "krelay_client_acks_total",
+		"Acknowledgements received from krelay-server by code.", "code")
+	ClientDialDuration = newHistogramVec(clientRegistry, "krelay_client_dial_duration_seconds",
+		"Time from creating a stream until krelay-server acknowledges the connection to the destination.", "protocol")
+	ClientHeartbeatFailures = newCounter(clientRegistry, "krelay_client_heartbeat_failures_total",
+		"Heartbeats that could not be sent to krelay-server.")
+	ClientAddressResolutions = newCounterVec(clientRegistry, "krelay_client_address_resolutions_total",
+		"Re-resolutions of the address of targets following the newest ready pod.", "result")
+)
+
+// Metrics of krelay-server.
+var (
+	ServerConnsOpened = newCounterVec(serverRegistry, "krelay_server_connections_opened_total",
+		"Connections opened to destinations.", "protocol")
+	ServerConnsClosed = newCounterVec(serverRegistry, "krelay_server_connections_closed_total",
+		"Connections to destinations that have been closed.", "protocol")
+	ServerBytes = newCounterVec(serverRegistry, "krelay_server_bytes_total",
+		"Bytes proxied to and from destinations, added when each direction finishes.", "protocol", "direction")
+	ServerAcks = newCounterVec(serverRegistry, "krelay_server_acks_total",
+		"Acknowledgements sent to clients by code.", "code")
+	ServerDialDuration = newHistogramVec(serverRegistry, "krelay_server_dial_duration_seconds",
+		"Time to connect to destinations, including name resolution.", "protocol")
+)
+
+// Forward holds the metrics of a forwarder.
+type Forward struct {
+	Opened, Closed    prometheus.Counter
+	BytesIn, BytesOut prometheus.Counter
+	// ConntrackEntries is only used by UDP forwarders.
+	ConntrackEntries prometheus.Gauge
+}
+
+// NewForward returns the metrics of the forwarder of target listening on
+// localAddr.
+func NewForward(target, localAddr, protocol string) *Forward {
+	return &Forward{
+		Opened:           ClientConnsOpened.WithLabelValues(target, localAddr, protocol),
+		Closed:           ClientConnsClosed.WithLabelValues(target, localAddr, protocol),
+		BytesIn:          ClientBytes.WithLabelValues(target, localAddr, protocol, DirectionIn),
+		BytesOut:         ClientBytes.WithLabelValues(target, localAddr, protocol, DirectionOut),
+		ConntrackEntries: ClientUDPConntrackEntries.WithLabelValues(target, localAddr),
+	}
+}
+
+// DeleteForward removes the metrics of the forwarder of target listening on
+// localAddr, once it stops.
+func DeleteForward(target, localAddr, protocol string) {
+	ClientConnsOpened.DeleteLabelValues(target, localAddr, protocol)
+	ClientConnsClosed.DeleteLabelValues(target, localAddr, protocol)
+	ClientBytes.DeleteLabelValues(target, localAddr, protocol, DirectionIn)
+	ClientBytes.DeleteLabelValues(target, localAddr, protocol, DirectionOut)
+	ClientUDPConntrackEntries.DeleteLabelValues(target, localAddr)
+}
+
+// AckCodeName returns the label value of an acknowledgement code.
+func AckCodeName(code xnet.AckCode) string {
+	switch code {
+	case xnet.AckCodeOK:
+		return "ok"
+	case xnet.AckCodeUnknownError:
+		return "unknown_error"
+	case xnet.AckCodeNoSuchHost:
+		return "no_such_host"
+	case xnet.AckCodeResolveTimeout:
+		return "resolve_timeout"
+	case xnet.AckCodeConnectTimeout:
+		return "connect_timeout"
+	case xnet.AckCodeUnknownProtocol:
+		return "unknown_protocol"
+	case xnet.AckCodeUnauthorized:
+		return "unauthorized"
+	case xnet.AckCodeForbidden:
+		return "forbidden"
+	default:
+		return "unknown_code"
+	}
+}
+
+// ObserveClientDial records the acknowledgement of a new connection to a
+// destination, requested at start.
+func ObserveClientDial(protocol string, code xnet.AckCode, start time.Time) {
+	ClientAcks.WithLabelValues(AckCodeName(code)).Inc()
+	ClientDialDuration.WithLabelValues(protocol).Observe(time.Since(start).Seconds())
+}
+
+func newCounter(r *prometheus.Registry, name, help string) prometheus.Counter {
+	c := prometheus.NewCounter(prometheus.CounterOpts{Name: name, Help: help})
+	r.MustRegister(c)
+	return c
+}
+
+func newCounterVec(r *prometheus.Registry, name, help string, labels ...string) *prometheus.CounterVec {
+	c := prometheus.NewCounterVec(prometheus.CounterOpts{Name: name, Help: help}, labels)
+	r.MustRegister(c)
+	return c
+}
+
+func newGaugeVec(r *prometheus.Registry, name, help string, labels ...string) *prometheus.GaugeVec {
+	g := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: name, Help: help}, labels)
+	r.MustRegister(g)
+	return g
+}
+
+func newHistogramVec(r *prometheus.Registry, name, help string, labels ...string) *prometheus.HistogramVec {
+	h := prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: name, Help: help, Buckets: dialBuckets}, labels)
+	r.MustRegister(h)
+	return h
+}
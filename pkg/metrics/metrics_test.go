@@ -0,0 +1,20 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/knight42/krelay/pkg/xnet"
+)
+
+func TestAckCodeName(t *testing.T) {
+	names := map[string]bool{}
+	for code := xnet.AckCode(xnet.AckCodeOK); code <= xnet.AckCodeForbidden; code++ {
+		name := AckCodeName(code)
+		require.NotEqual(t, "unknown_code", name, "code %d", code)
+		require.False(t, names[name], "duplicate name %q", name)
+		names[name] = true
+	}
+	require.Equal(t, "unknown_code", AckCodeName(0))
+}
@@ -0,0 +1,259 @@
+package policy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"sigs.k8s.io/yaml"
+
+	"github.com/knight42/krelay/pkg/constants"
+)
+
+// ErrForbidden is wrapped by every error returned for a blocked destination.
+var ErrForbidden = errors.New("forbidden by policy")
+
+// Policy decides which destinations krelay-server may connect to. Deny rules
+// always win. If there is any allow rule for CIDRs or hosts, a destination has
+// to match one of them. Empty port and protocol lists allow everything.
+type Policy struct {
+	AllowCIDRs []netip.Prefix
+	DenyCIDRs  []netip.Prefix
+	// AllowHosts and DenyHosts are globs as understood by path.Match, and are
+	// matched against hostname destinations only.
+	AllowHosts []string
+	DenyHosts  []string
+	Ports      []PortRange
+	Protocols  []string
+}
+
+// PortRange is an inclusive range of ports.
+type PortRange struct {
+	From uint16
+	To   uint16
+}
+
+func (r PortRange) contains(port uint16) bool {
+	return r.From <= port && port <= r.To
+}
+
+// ParsePortRange parses a single port like "80" or a range like "8000-9000".
+func ParsePortRange(s string) (PortRange, error) {
+	fromStr, toStr, isRange := strings.Cut(s, "-")
+	from, err := strconv.ParseUint(fromStr, 10, 16)
+	if err != nil {
+		return PortRange{}, fmt.Errorf("invalid port: %q", s)
+	}
+	if !isRange {
+		return PortRange{From: uint16(from), To: uint16(from)}, nil
+	}
+	to, err := strconv.ParseUint(toStr, 10, 16)
+	if err != nil || to < from {
+		return PortRange{}, fmt.Errorf("invalid port range: %q", s)
+	}
+	return PortRange{From: uint16(from), To: uint16(to)}, nil
+}
+
+// IsEmpty reports whether the policy allows every destination.
+func (p *Policy) IsEmpty() bool {
+	return len(p.AllowCIDRs) == 0 && len(p.DenyCIDRs) == 0 &&
+		len(p.AllowHosts) == 0 && len(p.DenyHosts) == 0 &&
+		len(p.Ports) == 0 && len(p.Protocols) == 0
+}
+
+func (p *Policy) hasAllowRules() bool {
+	return len(p.AllowCIDRs) > 0 || len(p.AllowHosts) > 0
+}
+
+type nameAllowedKey struct{}
+
+// Check validates the protocol, port and, for hostnames, the name of a
+// destination before dialing it. The returned context has to be used for the
+// dial, so that Control knows whether the name was explicitly allowed.
+func (p *Policy) Check(ctx context.Context, protocol, host string, port uint16) (context.Context, error) {
+	if len(p.Protocols) > 0 && !slices.Contains(p.Protocols, protocol) {
+		return ctx, fmt.Errorf("%w: protocol %s is not allowed", ErrForbidden, protocol)
+	}
+	if len(p.Ports) > 0 && !slices.ContainsFunc(p.Ports, func(r PortRange) bool { return r.contains(port) }) {
+		return ctx, fmt.Errorf("%w: port %d is not allowed", ErrForbidden, port)
+	}
+	return p.CheckHost(ctx, protocol, host)
+}
+
+// CheckHost is Check without the port rules, for peers that connect to
+// krelay-server instead of being dialed, whose port is not known in advance.
+func (p *Policy) CheckHost(ctx context.Context, protocol, host string) (context.Context, error) {
+	if len(p.Protocols) > 0 && !slices.Contains(p.Protocols, protocol) {
+		return ctx, fmt.Errorf("%w: protocol %s is not allowed", ErrForbidden, protocol)
+	}
+	if _, err := netip.ParseAddr(host); err == nil {
+		return ctx, nil
+	}
+	name := strings.ToLower(strings.TrimSuffix(host, "."))
+	if matchAny(p.DenyHosts, name) {
+		return ctx, fmt.Errorf("%w: host %s is denied", ErrForbidden, host)
+	}
+	if matchAny(p.AllowHosts, name) {
+		return context.WithValue(ctx, nameAllowedKey{}, true), nil
+	}
+	return ctx, nil
+}
+
+// Control can be used as net.Dialer.ControlContext. It checks the IP address
+// actually being connected to, after any name resolution.
+func (p *Policy) Control(ctx context.Context, _, address string, _ syscall.RawConn) error {
+	ap, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return fmt.Errorf("%w: unknown address %s", ErrForbidden, address)
+	}
+	ip := ap.Addr().Unmap()
+	if slices.ContainsFunc(p.DenyCIDRs, func(prefix netip.Prefix) bool { return prefix.Contains(ip) }) {
+		return fmt.Errorf("%w: ip %s is denied", ErrForbidden, ip)
+	}
+	if nameAllowed, _ := ctx.Value(nameAllowedKey{}).(bool); nameAllowed || !p.hasAllowRules() {
+		return nil
+	}
+	if slices.ContainsFunc(p.AllowCIDRs, func(prefix netip.Prefix) bool { return prefix.Contains(ip) }) {
+		return nil
+	}
+	return fmt.Errorf("%w: ip %s is not allowed", ErrForbidden, ip)
+}
+
+func matchAny(globs []string, name string) bool {
+	for _, g := range globs {
+		if ok, _ := path.Match(g, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Rules is the user-facing form of a Policy, used by both the flags and the
+// policy file.
+type Rules struct {
+	CIDRs     []string `json:"cidrs,omitempty"`
+	Hosts     []string `json:"hosts,omitempty"`
+	Ports     []string `json:"ports,omitempty"`
+	Protocols []string `json:"protocols,omitempty"`
+}
+
+// Config is the content of a policy file, e.g.
+//
+//	allow:
+//	  cidrs: ["10.0.0.0/8"]
+//	  hosts: ["*.svc.cluster.local"]
+//	  ports: ["80", "8000-9000"]
+//	  protocols: ["tcp"]
+//	deny:
+//	  cidrs: ["10.0.0.1/32"]
+//	  hosts: ["kubernetes.default.*"]
+type Config struct {
+	Allow Rules `json:"allow"`
+	// Deny only supports cidrs and hosts.
+	Deny Rules `json:"deny"`
+}
+
+// LoadConfig reads a policy file in YAML or JSON. Unknown fields are rejected.
+func LoadConfig(fileName string) (Config, error) {
+	var cfg Config
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return cfg, err
+	}
+	err = yaml.UnmarshalStrict(data, &cfg)
+	if err != nil {
+		return cfg, fmt.Errorf("parse policy file %s: %w", fileName, err)
+	}
+	return cfg, nil
+}
+
+// Merge appends the rules of other to c.
+func (c *Config) Merge(other Config) {
+	c.Allow.CIDRs = append(c.Allow.CIDRs, other.Allow.CIDRs...)
+	c.Allow.Hosts = append(c.Allow.Hosts, other.Allow.Hosts...)
+	c.Allow.Ports = append(c.Allow.Ports, other.Allow.Ports...)
+	c.Allow.Protocols = append(c.Allow.Protocols, other.Allow.Protocols...)
+	c.Deny.CIDRs = append(c.Deny.CIDRs, other.Deny.CIDRs...)
+	c.Deny.Hosts = append(c.Deny.Hosts, other.Deny.Hosts...)
+	c.Deny.Ports = append(c.Deny.Ports, other.Deny.Ports...)
+	c.Deny.Protocols = append(c.Deny.Protocols, other.Deny.Protocols...)
+}
+
+// Build validates the config and turns it into a Policy.
+func (c *Config) Build() (*Policy, error) {
+	if len(c.Deny.Ports) > 0 || len(c.Deny.Protocols) > 0 {
+		return nil, errors.New("deny rules only support cidrs and hosts")
+	}
+
+	p := &Policy{}
+	var err error
+	p.AllowCIDRs, err = parsePrefixes(c.Allow.CIDRs)
+	if err != nil {
+		return nil, err
+	}
+	p.DenyCIDRs, err = parsePrefixes(c.Deny.CIDRs)
+	if err != nil {
+		return nil, err
+	}
+	p.AllowHosts, err = parseGlobs(c.Allow.Hosts)
+	if err != nil {
+		return nil, err
+	}
+	p.DenyHosts, err = parseGlobs(c.Deny.Hosts)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range c.Allow.Ports {
+		r, err := ParsePortRange(s)
+		if err != nil {
+			return nil, err
+		}
+		p.Ports = append(p.Ports, r)
+	}
+	for _, proto := range c.Allow.Protocols {
+		proto = strings.ToLower(proto)
+		switch proto {
+		case constants.ProtocolTCP, constants.ProtocolUDP:
+		default:
+			return nil, fmt.Errorf("unknown protocol: %q", proto)
+		}
+		p.Protocols = append(p.Protocols, proto)
+	}
+	return p, nil
+}
+
+func parsePrefixes(ss []string) ([]netip.Prefix, error) {
+	ret := make([]netip.Prefix, 0, len(ss))
+	for _, s := range ss {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			// accept a single IP as well
+			ip, ipErr := netip.ParseAddr(s)
+			if ipErr != nil {
+				return nil, fmt.Errorf("invalid CIDR: %q", s)
+			}
+			prefix = netip.PrefixFrom(ip, ip.BitLen())
+		}
+		ret = append(ret, prefix.Masked())
+	}
+	return ret, nil
+}
+
+func parseGlobs(ss []string) ([]string, error) {
+	ret := make([]string, 0, len(ss))
+	for _, s := range ss {
+		s = strings.ToLower(strings.TrimSuffix(s, "."))
+		if _, err := path.Match(s, ""); err != nil {
+			return nil, fmt.Errorf("invalid host pattern: %q", s)
+		}
+		ret = append(ret, s)
+	}
+	return ret, nil
+}
@@ -0,0 +1,177 @@
+package policy
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePortRange(t *testing.T) {
+	testCases := map[string]struct {
+		input     string
+		expect    PortRange
+		expectErr string
+	}{
+		"single port": {
+			input:  "80",
+			expect: PortRange{From: 80, To: 80},
+		},
+		"range": {
+			input:  "8000-9000",
+			expect: PortRange{From: 8000, To: 9000},
+		},
+		"reversed range": {
+			input:     "9000-8000",
+			expectErr: "invalid port range",
+		},
+		"not a number": {
+			input:     "http",
+			expectErr: "invalid port",
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			got, err := ParsePortRange(tc.input)
+			if len(tc.expectErr) > 0 {
+				require.ErrorContains(t, err, tc.expectErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expect, got)
+		})
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	cfg := Config{
+		Allow: Rules{
+			CIDRs:     []string{"10.0.0.0/8"},
+			Hosts:     []string{"*.svc.cluster.local"},
+			Ports:     []string{"53", "8000-9000"},
+			Protocols: []string{"tcp", "UDP"},
+		},
+		Deny: Rules{
+			CIDRs: []string{"10.0.0.1"},
+			Hosts: []string{"secret.*"},
+		},
+	}
+	p, err := cfg.Build()
+	require.NoError(t, err)
+
+	testCases := map[string]struct {
+		protocol string
+		host     string
+		port     uint16
+		// dialIP is the address the host resolves to.
+		dialIP string
+
+		forbidden bool
+	}{
+		"allowed ip": {
+			protocol: "tcp",
+			host:     "10.1.2.3",
+			port:     8080,
+			dialIP:   "10.1.2.3",
+		},
+		"denied ip": {
+			protocol:  "tcp",
+			host:      "10.0.0.1",
+			port:      8080,
+			dialIP:    "10.0.0.1",
+			forbidden: true,
+		},
+		"ip outside of allowed cidrs": {
+			protocol:  "udp",
+			host:      "192.168.1.1",
+			port:      53,
+			dialIP:    "192.168.1.1",
+			forbidden: true,
+		},
+		"port not allowed": {
+			protocol:  "tcp",
+			host:      "10.1.2.3",
+			port:      22,
+			forbidden: true,
+		},
+		"allowed host resolving outside of allowed cidrs": {
+			protocol: "tcp",
+			host:     "web.default.svc.cluster.local.",
+			port:     8000,
+			dialIP:   "172.16.0.1",
+		},
+		"allowed host resolving to denied ip": {
+			protocol:  "tcp",
+			host:      "web.default.svc.cluster.local",
+			port:      8000,
+			dialIP:    "10.0.0.1",
+			forbidden: true,
+		},
+		"denied host": {
+			protocol:  "tcp",
+			host:      "Secret.svc.cluster.local",
+			port:      8000,
+			forbidden: true,
+		},
+		"unknown host resolving to allowed ip": {
+			protocol: "tcp",
+			host:     "example.com",
+			port:     8000,
+			dialIP:   "10.2.3.4",
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			ctx, err := p.Check(context.Background(), tc.protocol, tc.host, tc.port)
+			if err == nil && len(tc.dialIP) > 0 {
+				err = p.Control(ctx, "tcp", net.JoinHostPort(tc.dialIP, "8000"), nil)
+			}
+			if tc.forbidden {
+				require.ErrorIs(t, err, ErrForbidden)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestCheckHost(t *testing.T) {
+	p := &Policy{
+		Ports:     []PortRange{{From: 443, To: 443}},
+		Protocols: []string{"tcp"},
+		DenyHosts: []string{"secret.*"},
+	}
+	_, err := p.CheckHost(context.Background(), "tcp", "10.0.0.1")
+	require.NoError(t, err)
+	_, err = p.CheckHost(context.Background(), "udp", "10.0.0.1")
+	require.ErrorIs(t, err, ErrForbidden)
+	_, err = p.CheckHost(context.Background(), "tcp", "secret.example.com")
+	require.ErrorIs(t, err, ErrForbidden)
+}
+
+func TestConfigBuild(t *testing.T) {
+	testCases := map[string]struct {
+		cfg       Config
+		expectErr string
+	}{
+		"invalid cidr": {
+			cfg:       Config{Allow: Rules{CIDRs: []string{"10.0.0.0/33"}}},
+			expectErr: "invalid CIDR",
+		},
+		"unknown protocol": {
+			cfg:       Config{Allow: Rules{Protocols: []string{"sctp"}}},
+			expectErr: "unknown protocol",
+		},
+		"deny ports": {
+			cfg:       Config{Deny: Rules{Ports: []string{"22"}}},
+			expectErr: "deny rules only support",
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			_, err := tc.cfg.Build()
+			require.ErrorContains(t, err, tc.expectErr)
+		})
+	}
+}
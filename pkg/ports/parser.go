@@ -6,7 +6,9 @@ import (
 	"strings"
 
 	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 
 	"github.com/knight42/krelay/pkg/constants"
@@ -169,6 +171,29 @@ func getPortsFromObject(obj runtime.Object) (portsInObject, error) {
 		return getPortsFromPodSpec(&actual.Spec.Template.Spec), nil
 	case *appsv1.DaemonSet:
 		return getPortsFromPodSpec(&actual.Spec.Template.Spec), nil
+	case *batchv1.Job:
+		return getPortsFromPodSpec(&actual.Spec.Template.Spec), nil
+	case *batchv1.CronJob:
+		return getPortsFromPodSpec(&actual.Spec.JobTemplate.Spec.Template.Spec), nil
+	case *corev1.ReplicationController:
+		if actual.Spec.Template == nil {
+			return getPortsFromPodSpec(&corev1.PodSpec{}), nil
+		}
+		return getPortsFromPodSpec(&actual.Spec.Template.Spec), nil
+	case *unstructured.Unstructured:
+		// custom workloads like Argo Rollouts keep the pod template in spec.template
+		var podSpec corev1.PodSpec
+		tpl, found, err := unstructured.NestedMap(actual.Object, "spec", "template", "spec")
+		if err != nil {
+			return portsInObject{}, fmt.Errorf("read spec.template.spec of %s %s: %w", actual.GetKind(), actual.GetName(), err)
+		}
+		if found {
+			err = runtime.DefaultUnstructuredConverter.FromUnstructured(tpl, &podSpec)
+			if err != nil {
+				return portsInObject{}, fmt.Errorf("parse spec.template.spec of %s %s: %w", actual.GetKind(), actual.GetName(), err)
+			}
+		}
+		return getPortsFromPodSpec(&podSpec), nil
 	default:
 		return portsInObject{}, fmt.Errorf("unknown object: %T", obj)
 	}
@@ -7,6 +7,7 @@ import (
 	"github.com/stretchr/testify/require"
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 
 	"github.com/knight42/krelay/pkg/constants"
@@ -187,6 +188,41 @@ func TestGetPortsFromObject(t *testing.T) {
 				},
 			},
 		},
+		"custom workload": {
+			obj: &unstructured.Unstructured{Object: map[string]any{
+				"apiVersion": "argoproj.io/v1alpha1",
+				"kind":       "Rollout",
+				"spec": map[string]any{
+					"template": map[string]any{
+						"spec": map[string]any{
+							"containers": []any{
+								map[string]any{
+									"name": "web",
+									"ports": []any{
+										map[string]any{
+											"name":          "http",
+											"containerPort": int64(8080),
+											"protocol":      "TCP",
+										},
+									},
+								},
+							},
+						},
+					},
+				},
+			}},
+			expected: portsInObject{
+				Names: map[string]portWithProtocol{
+					"http": {
+						Port:     8080,
+						Protocol: constants.ProtocolTCP,
+					},
+				},
+				Protocols: map[uint16][]string{
+					8080: {constants.ProtocolTCP},
+				},
+			},
+		},
 	}
 	for name, tc := range testCases {
 		t.Run(name, func(t *testing.T) {
@@ -0,0 +1,248 @@
+package remoteaddr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/knight42/krelay/pkg/xnet"
+)
+
+// LBPolicy decides which pod receives a new connection when a target is
+// backed by several pods.
+type LBPolicy string
+
+const (
+	// LBNewest sends every connection to the newest ready pod.
+	LBNewest LBPolicy = "newest"
+	// LBRoundRobin cycles through the ready pods.
+	LBRoundRobin LBPolicy = "round-robin"
+	// LBRandom picks a ready pod at random.
+	LBRandom LBPolicy = "random"
+	// LBLeastConn picks the ready pod with the fewest open connections.
+	LBLeastConn LBPolicy = "least-conn"
+)
+
+// ParseLBPolicy validates s as one of the supported policies.
+func ParseLBPolicy(s string) (LBPolicy, error) {
+	return parseEnum("load balancing policy", s, []LBPolicy{LBNewest, LBRoundRobin, LBRandom, LBLeastConn})
+}
+
+// connTracker is implemented by getters that need to know when a connection
+// to an address returned by Get is closed.
+type connTracker interface {
+	done(addr xnet.Addr)
+}
+
+// stopper is implemented by getters that watch the cluster.
+type stopper interface {
+	stop()
+}
+
+// Stop releases the watches of g once it is no longer used. It is a no-op for
+// getters that do not watch anything.
+func Stop(g Getter) {
+	if s, ok := g.(stopper); ok {
+		s.stop()
+	}
+}
+
+// Done reports that the connection to addr, which was returned by g.Get, is
+// closed. It is a no-op unless g balances by the number of connections.
+func Done(g Getter, addr xnet.Addr) {
+	if t, ok := g.(connTracker); ok {
+		t.done(addr)
+	}
+}
+
+type podNamer interface {
+	podOf(addr xnet.Addr) string
+}
+
+// PodName returns the name of the pod whose address addr was returned by g,
+// or "" if g does not pick pods or no longer knows the pod.
+func PodName(g Getter, addr xnet.Addr) string {
+	if n, ok := g.(podNamer); ok {
+		return n.podOf(addr)
+	}
+	return ""
+}
+
+// balancer picks one of several candidate addresses according to an LBPolicy.
+type balancer struct {
+	policy LBPolicy
+
+	mu    sync.Mutex
+	next  int
+	conns map[string]int
+}
+
+func newBalancer(policy LBPolicy) *balancer {
+	return &balancer{policy: policy, conns: map[string]int{}}
+}
+
+// pick returns the index of the address to use, addrs must not be empty.
+// LBNewest always picks the first one.
+func (b *balancer) pick(addrs []xnet.Addr) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.policy {
+	case LBRandom:
+		return rand.IntN(len(addrs))
+
+	case LBLeastConn:
+		picked := 0
+		for i := range addrs[1:] {
+			if b.conns[addrs[i+1].String()] < b.conns[addrs[picked].String()] {
+				picked = i + 1
+			}
+		}
+		b.conns[addrs[picked].String()]++
+		return picked
+
+	case LBRoundRobin:
+		i := b.next % len(addrs)
+		b.next++
+		return i
+
+	default:
+		return 0
+	}
+}
+
+func (b *balancer) done(addr xnet.Addr) {
+	if b.policy != LBLeastConn {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	key := addr.String()
+	if b.conns[key] <= 1 {
+		delete(b.conns, key)
+	} else {
+		b.conns[key]--
+	}
+}
+
+type balancedAddr struct {
+	*balancer
+	store     cache.Store
+	stopFn    func()
+	readiness Readiness
+	pod       string
+}
+
+var (
+	_ Getter      = (*balancedAddr)(nil)
+	_ connTracker = (*balancedAddr)(nil)
+	_ stopper     = (*balancedAddr)(nil)
+	_ podNamer    = (*balancedAddr)(nil)
+)
+
+func (b *balancedAddr) stop() {
+	b.stopFn()
+}
+
+func (b *balancedAddr) podOf(addr xnet.Addr) string {
+	ip := addr.String()
+	for _, obj := range b.store.List() {
+		pod := obj.(*corev1.Pod)
+		if pod.Status.PodIP == ip {
+			return pod.Name
+		}
+	}
+	return ""
+}
+
+// readyAddrs returns the addresses of the ready pods, sorted by pod name so
+// that round-robin visits them in a stable order, or newest first for LBNewest.
+func (b *balancedAddr) readyAddrs() []xnet.Addr {
+	var pods []*corev1.Pod
+	for _, obj := range b.store.List() {
+		pod := obj.(*corev1.Pod)
+		if isPodReady(pod, b.readiness) && (b.pod == "" || pod.Name == b.pod) {
+			pods = append(pods, pod)
+		}
+	}
+	slices.SortFunc(pods, func(x, y *corev1.Pod) int {
+		if b.policy == LBNewest || b.policy == "" {
+			if c := y.CreationTimestamp.Compare(x.CreationTimestamp.Time); c != 0 {
+				return c
+			}
+		}
+		return strings.Compare(x.Name, y.Name)
+	})
+
+	addrs := make([]xnet.Addr, 0, len(pods))
+	for _, pod := range pods {
+		addr, err := xnet.AddrFromIP(pod.Status.PodIP)
+		if err != nil {
+			continue
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
+func (b *balancedAddr) Get() (xnet.Addr, error) {
+	addrs := b.readyAddrs()
+	if len(addrs) == 0 {
+		if b.pod != "" {
+			return xnet.Addr{}, fmt.Errorf("pod %s is not ready", b.pod)
+		}
+		return xnet.Addr{}, errors.New("no ready pods found")
+	}
+	return addrs[b.pick(addrs)], nil
+}
+
+func (b *balancedAddr) init(cs kubernetes.Interface, ns, selector string) error {
+	store, stop, err := watchPods(cs, ns, selector)
+	if err != nil {
+		return err
+	}
+	b.store, b.stopFn = store, stop
+	return nil
+}
+
+// watchPods runs an informer of the pods matching selector in ns.
+func watchPods(cs kubernetes.Interface, ns, selector string) (cache.Store, func(), error) {
+	podCli := cs.CoreV1().Pods(ns)
+	lw := &cache.ListWatch{
+		ListWithContextFunc: func(ctx context.Context, options metav1.ListOptions) (runtime.Object, error) {
+			options.LabelSelector = selector
+			return podCli.List(ctx, options)
+		},
+		WatchFuncWithContext: func(ctx context.Context, options metav1.ListOptions) (watch.Interface, error) {
+			options.LabelSelector = selector
+			return podCli.Watch(ctx, options)
+		},
+	}
+	return runInformer(cs, lw, &corev1.Pod{})
+}
+
+// runInformer starts an informer and waits for its initial list. The informer
+// runs until the returned function is called.
+func runInformer(cs kubernetes.Interface, lw *cache.ListWatch, obj runtime.Object) (cache.Store, func(), error) {
+	informer := cache.NewSharedIndexInformer(cache.ToListWatcherWithWatchListSemantics(lw, cs), obj, 0, cache.Indexers{})
+	stopCh := make(chan struct{})
+	go informer.Run(stopCh)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if !cache.WaitForCacheSync(ctx.Done(), informer.HasSynced) {
+		close(stopCh)
+		return nil, nil, errors.New("timed out waiting for the initial list")
+	}
+	return informer.GetStore(), sync.OnceFunc(func() { close(stopCh) }), nil
+}
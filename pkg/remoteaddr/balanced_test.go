@@ -0,0 +1,178 @@
+package remoteaddr
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/knight42/krelay/pkg/xnet"
+)
+
+func newPod(name, ip string, ready bool) *corev1.Pod {
+	status := corev1.ConditionFalse
+	if ready {
+		status = corev1.ConditionTrue
+	}
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: metav1.NamespaceDefault,
+			Labels:    map[string]string{"app": "api"},
+		},
+		Status: corev1.PodStatus{
+			Phase: corev1.PodRunning,
+			PodIP: ip,
+			Conditions: []corev1.PodCondition{
+				{Type: corev1.PodReady, Status: status},
+			},
+		},
+	}
+}
+
+func newTestBalancedAddr(policy LBPolicy, pods ...*corev1.Pod) *balancedAddr {
+	store := cache.NewStore(cache.MetaNamespaceKeyFunc)
+	for _, pod := range pods {
+		_ = store.Add(pod)
+	}
+	return &balancedAddr{balancer: newBalancer(policy), store: store, readiness: ReadinessReady}
+}
+
+func getN(t *testing.T, g Getter, n int) []string {
+	var ret []string
+	for range n {
+		addr, err := g.Get()
+		require.NoError(t, err)
+		ret = append(ret, addr.String())
+	}
+	return ret
+}
+
+func TestBalancedAddrRoundRobin(t *testing.T) {
+	b := newTestBalancedAddr(LBRoundRobin,
+		newPod("b", "10.0.0.2", true),
+		newPod("a", "10.0.0.1", true),
+		newPod("c", "10.0.0.3", false),
+	)
+	require.Equal(t, []string{"10.0.0.1", "10.0.0.2", "10.0.0.1"}, getN(t, b, 3))
+}
+
+func TestBalancedAddrRandom(t *testing.T) {
+	b := newTestBalancedAddr(LBRandom,
+		newPod("a", "10.0.0.1", true),
+		newPod("b", "10.0.0.2", false),
+	)
+	require.Equal(t, []string{"10.0.0.1", "10.0.0.1"}, getN(t, b, 2))
+}
+
+func TestBalancedAddrLeastConn(t *testing.T) {
+	r := require.New(t)
+	b := newTestBalancedAddr(LBLeastConn,
+		newPod("a", "10.0.0.1", true),
+		newPod("b", "10.0.0.2", true),
+	)
+	r.Equal([]string{"10.0.0.1", "10.0.0.2", "10.0.0.1"}, getN(t, b, 3))
+
+	addr, err := xnet.AddrFromIP("10.0.0.2")
+	r.NoError(err)
+	Done(b, addr)
+	r.Equal([]string{"10.0.0.2", "10.0.0.2"}, getN(t, b, 2))
+}
+
+func TestBalancedAddrNoReadyPods(t *testing.T) {
+	terminating := newPod("a", "10.0.0.1", true)
+	terminating.DeletionTimestamp = new(metav1.Now())
+	b := newTestBalancedAddr(LBRoundRobin, terminating, newPod("b", "10.0.0.2", false))
+	_, err := b.Get()
+	require.Error(t, err)
+}
+
+func TestNewBalancedAddr(t *testing.T) {
+	r := require.New(t)
+	ctx := context.Background()
+	cs := fake.NewClientset(
+		newPod("a", "10.0.0.1", true),
+		newPod("b", "10.0.0.2", true),
+	)
+	g, err := NewBalancedAddr(cs, metav1.NamespaceDefault, "app=api", Options{LB: LBRoundRobin, Readiness: ReadinessReady})
+	r.NoError(err)
+	r.ElementsMatch([]string{"10.0.0.1", "10.0.0.2"}, getN(t, g, 2))
+
+	// the pod leaves the ready set
+	_, err = cs.CoreV1().Pods(metav1.NamespaceDefault).UpdateStatus(ctx, newPod("a", "10.0.0.1", false), metav1.UpdateOptions{})
+	r.NoError(err)
+	r.Eventually(func() bool {
+		addrs := getN(t, g, 2)
+		return addrs[0] == "10.0.0.2" && addrs[1] == "10.0.0.2"
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+func TestNewBalancedAddrAllowEmpty(t *testing.T) {
+	r := require.New(t)
+	ctx := context.Background()
+	cs := fake.NewClientset()
+	_, err := NewBalancedAddr(cs, metav1.NamespaceDefault, "app=api", Options{Readiness: ReadinessReady})
+	r.ErrorContains(err, "no ready pods found")
+
+	g, err := NewBalancedAddr(cs, metav1.NamespaceDefault, "app=api", Options{Readiness: ReadinessReady, AllowEmpty: true})
+	r.NoError(err)
+	defer Stop(g)
+	_, err = g.Get()
+	r.ErrorContains(err, "no ready pods found")
+
+	// the newest ready pod is picked once the pods are created
+	older := newPod("b", "10.0.0.2", true)
+	older.CreationTimestamp = metav1.NewTime(time.Now().Add(-time.Minute))
+	newer := newPod("a", "10.0.0.1", true)
+	newer.CreationTimestamp = metav1.Now()
+	for _, pod := range []*corev1.Pod{older, newer} {
+		_, err = cs.CoreV1().Pods(metav1.NamespaceDefault).Create(ctx, pod, metav1.CreateOptions{})
+		r.NoError(err)
+	}
+	r.Eventually(func() bool {
+		addr, err := g.Get()
+		return err == nil && addr.String() == "10.0.0.1"
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+func TestParseLBPolicy(t *testing.T) {
+	p, err := ParseLBPolicy("least-conn")
+	require.NoError(t, err)
+	require.Equal(t, LBLeastConn, p)
+
+	_, err = ParseLBPolicy("weighted")
+	require.Error(t, err)
+}
+
+func TestBalancedAddrPod(t *testing.T) {
+	b := newTestBalancedAddr(LBNewest,
+		newPod("redis-0", "10.0.0.1", true),
+		newPod("redis-1", "10.0.0.2", true),
+	)
+	b.pod = "redis-1"
+	require.Equal(t, []string{"10.0.0.2", "10.0.0.2"}, getN(t, b, 2))
+
+	b.pod = "redis-2"
+	_, err := b.Get()
+	require.ErrorContains(t, err, "redis-2 is not ready")
+}
+
+func TestPodName(t *testing.T) {
+	b := newTestBalancedAddr(LBNewest,
+		newPod("redis-0", "10.0.0.1", true),
+		newPod("redis-1", "10.0.0.2", true),
+	)
+	addr, err := xnet.AddrFromIP("10.0.0.2")
+	require.NoError(t, err)
+	require.Equal(t, "redis-1", PodName(b, addr))
+	require.Empty(t, PodName(NewStaticAddr(addr), addr))
+
+	addr, err = xnet.AddrFromIP("10.0.0.3")
+	require.NoError(t, err)
+	require.Empty(t, PodName(b, addr))
+}
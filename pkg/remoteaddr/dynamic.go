@@ -17,20 +17,40 @@ import (
 	"k8s.io/client-go/tools/cache"
 	watchtools "k8s.io/client-go/tools/watch"
 
+	"github.com/knight42/krelay/pkg/metrics"
 	slogutil "github.com/knight42/krelay/pkg/slog"
 	"github.com/knight42/krelay/pkg/xnet"
 )
 
 type dynamicAddr struct {
-	podCli   typedcorev1.PodInterface
-	selector string
+	podCli    typedcorev1.PodInterface
+	selector  string
+	readiness Readiness
+	cancel    context.CancelFunc
 
 	mu      sync.RWMutex
 	podName string
 	addr    xnet.Addr
 }
 
-var _ Getter = (*dynamicAddr)(nil)
+var (
+	_ Getter   = (*dynamicAddr)(nil)
+	_ stopper  = (*dynamicAddr)(nil)
+	_ podNamer = (*dynamicAddr)(nil)
+)
+
+func (d *dynamicAddr) stop() {
+	d.cancel()
+}
+
+func (d *dynamicAddr) podOf(addr xnet.Addr) string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.addr.String() != addr.String() {
+		return ""
+	}
+	return d.podName
+}
 
 func (d *dynamicAddr) Get() (xnet.Addr, error) {
 	d.mu.RLock()
@@ -59,8 +79,8 @@ func (d *dynamicAddr) watchForUpdates(w watch.Interface) {
 			continue
 		}
 
-		if ev.Type == watch.Modified && pod.DeletionTimestamp == nil && pod.Status.Phase == corev1.PodRunning {
-			slog.Debug("Ignore event since the pod is still running", slog.String("pod", pod.Name))
+		if ev.Type == watch.Modified && isPodReady(pod, d.readiness) {
+			slog.Debug("Ignore event since the pod is still ready", slog.String("pod", pod.Name))
 			continue
 		}
 
@@ -74,8 +94,10 @@ func (d *dynamicAddr) watchForUpdates(w watch.Interface) {
 			return false, nil
 		})
 		if err != nil {
+			metrics.ClientAddressResolutions.WithLabelValues(metrics.ResultFailure).Inc()
 			slog.Error("Fail to update remote address within timeout")
 		} else {
+			metrics.ClientAddressResolutions.WithLabelValues(metrics.ResultSuccess).Inc()
 			slog.Debug("Successfully update remote address", slog.String("current", d.podName))
 		}
 	}
@@ -94,7 +116,7 @@ func (d *dynamicAddr) updatePodIP(ctx context.Context) (rv string, err error) {
 		return !pods[i].CreationTimestamp.Before(&pods[j].CreationTimestamp)
 	})
 	for _, pod := range pods {
-		if pod.Status.Phase == corev1.PodRunning {
+		if isPodReady(&pod, d.readiness) {
 			d.mu.Lock()
 			d.podName = pod.Name
 			d.addr, _ = xnet.AddrFromIP(pod.Status.PodIP)
@@ -103,7 +125,7 @@ func (d *dynamicAddr) updatePodIP(ctx context.Context) (rv string, err error) {
 		}
 	}
 
-	return "", errors.New("no running pods found")
+	return "", errors.New("no ready pods found")
 }
 
 func (d *dynamicAddr) init() error {
@@ -112,14 +134,17 @@ func (d *dynamicAddr) init() error {
 		return err
 	}
 
-	w, err := watchtools.NewRetryWatcherWithContext(context.Background(), rv, &cache.ListWatch{
+	ctx, cancel := context.WithCancel(context.Background())
+	w, err := watchtools.NewRetryWatcherWithContext(ctx, rv, &cache.ListWatch{
 		WatchFuncWithContext: func(ctx context.Context, options metav1.ListOptions) (watch.Interface, error) {
 			return d.podCli.Watch(ctx, options)
 		},
 	})
 	if err != nil {
+		cancel()
 		return fmt.Errorf("watch pods: %w", err)
 	}
+	d.cancel = cancel
 
 	go d.watchForUpdates(w)
 
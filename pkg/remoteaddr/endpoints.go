@@ -0,0 +1,285 @@
+package remoteaddr
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/knight42/krelay/pkg/xnet"
+)
+
+// endpointsAddr picks among the ready endpoints of a Service, as recorded in
+// its EndpointSlices, and maps the service port to the endpoint port.
+type endpointsAddr struct {
+	*balancer
+	store     cache.Store
+	stopFn    func()
+	svcPorts  []corev1.ServicePort
+	readiness Readiness
+	pod       string
+	// slots, if set, restricts the candidates to the pod of slot instead.
+	slots *podSlots
+	slot  int
+	// pods, if set, holds the pods of the Service, to put the endpoints of
+	// the newest ones first for LBNewest.
+	pods cache.Store
+}
+
+var (
+	_ Getter      = (*endpointsAddr)(nil)
+	_ portGetter  = (*endpointsAddr)(nil)
+	_ connTracker = (*endpointsAddr)(nil)
+	_ stopper     = (*endpointsAddr)(nil)
+	_ podNamer    = (*endpointsAddr)(nil)
+)
+
+func (e *endpointsAddr) stop() {
+	e.stopFn()
+}
+
+func (e *endpointsAddr) podOf(addr xnet.Addr) string {
+	host := addr.String()
+	for _, obj := range e.store.List() {
+		slice := obj.(*discoveryv1.EndpointSlice)
+		for _, ep := range slice.Endpoints {
+			if ep.TargetRef != nil && ep.TargetRef.Kind == "Pod" && slices.Contains(ep.Addresses, host) {
+				return ep.TargetRef.Name
+			}
+		}
+	}
+	return ""
+}
+
+// isCandidate reports whether the endpoint is ready and, if a pod is
+// requested, belongs to it.
+func (e *endpointsAddr) isCandidate(ep *discoveryv1.Endpoint, pod string) bool {
+	if len(ep.Addresses) == 0 {
+		return false
+	}
+	if pod != "" && (ep.TargetRef == nil || ep.TargetRef.Name != pod) {
+		return false
+	}
+	cond := ep.Conditions
+	if e.readiness == ReadinessRunning {
+		return cond.Terminating == nil || !*cond.Terminating
+	}
+	// nil should be interpreted as ready, according to the API docs.
+	return cond.Ready == nil || *cond.Ready
+}
+
+// endpointPortName returns the name of the service port, which is also the
+// name of the port in the EndpointSlices. ok is false if the Service does
+// not declare the port, e.g. a headless Service without ports.
+func (e *endpointsAddr) endpointPortName(port uint16, protocol string) (name string, ok bool) {
+	for _, sp := range e.svcPorts {
+		if sp.Port == int32(port) && strings.EqualFold(string(sp.Protocol), protocol) {
+			return sp.Name, true
+		}
+	}
+	return "", false
+}
+
+// candidates returns the ready endpoints that serve the port, sorted by
+// address, or by the creation time of their pods, newest first, if pods is
+// set. If the Service does not declare the port, every ready endpoint is
+// returned with the port unchanged.
+func (e *endpointsAddr) candidates(port uint16, protocol string) []xnet.AddrPort {
+	pod := e.pod
+	if e.slots != nil {
+		pod = e.slots.podOf(e.slot, e.readyPods())
+		if pod == "" {
+			return nil
+		}
+	}
+	portName, mapped := e.endpointPortName(port, protocol)
+
+	seen := map[string]bool{}
+	var ret []xnet.AddrPort
+	created := map[string]time.Time{}
+	for _, obj := range e.store.List() {
+		slice := obj.(*discoveryv1.EndpointSlice)
+
+		dstPort := port
+		if mapped {
+			idx := slices.IndexFunc(slice.Ports, func(p discoveryv1.EndpointPort) bool {
+				return ptrValue(p.Name) == portName &&
+					strings.EqualFold(string(ptrValue(p.Protocol)), protocol) &&
+					p.Port != nil
+			})
+			if idx < 0 {
+				continue
+			}
+			dstPort = uint16(*slice.Ports[idx].Port)
+		}
+
+		for i := range slice.Endpoints {
+			ep := &slice.Endpoints[i]
+			if !e.isCandidate(ep, pod) {
+				continue
+			}
+			var addr xnet.Addr
+			if slice.AddressType == discoveryv1.AddressTypeFQDN {
+				addr = xnet.AddrFromHost(ep.Addresses[0])
+			} else {
+				var err error
+				addr, err = xnet.AddrFromIP(ep.Addresses[0])
+				if err != nil {
+					continue
+				}
+			}
+			ap := xnet.AddrPortFrom(addr, dstPort)
+			// The same endpoint may show up in several slices while they are being updated.
+			if seen[ap.String()] {
+				continue
+			}
+			seen[ap.String()] = true
+			ret = append(ret, ap)
+			if e.pods != nil && ep.TargetRef != nil {
+				created[ap.String()] = e.podCreated(ep.TargetRef)
+			}
+		}
+	}
+	slices.SortFunc(ret, func(a, b xnet.AddrPort) int {
+		if c := created[b.String()].Compare(created[a.String()]); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.String(), b.String())
+	})
+	return ret
+}
+
+// podCreated returns the creation time of the pod ref refers to, or the zero
+// time if it is unknown.
+func (e *endpointsAddr) podCreated(ref *corev1.ObjectReference) time.Time {
+	obj, ok, _ := e.pods.GetByKey(ref.Namespace + "/" + ref.Name)
+	if !ok {
+		return time.Time{}
+	}
+	return obj.(*corev1.Pod).CreationTimestamp.Time
+}
+
+// readyPods returns the names of the pods with a ready endpoint, sorted.
+func (e *endpointsAddr) readyPods() []string {
+	var ret []string
+	for _, obj := range e.store.List() {
+		slice := obj.(*discoveryv1.EndpointSlice)
+		for i := range slice.Endpoints {
+			ep := &slice.Endpoints[i]
+			if ep.TargetRef != nil && ep.TargetRef.Kind == "Pod" && e.isCandidate(ep, "") {
+				ret = append(ret, ep.TargetRef.Name)
+			}
+		}
+	}
+	slices.Sort(ret)
+	return slices.Compact(ret)
+}
+
+func (e *endpointsAddr) getAddrPort(port uint16, protocol string) (xnet.AddrPort, error) {
+	aps := e.candidates(port, protocol)
+	if len(aps) == 0 {
+		return xnet.AddrPort{}, fmt.Errorf("no ready endpoints found for port %d/%s", port, protocol)
+	}
+	addrs := make([]xnet.Addr, 0, len(aps))
+	for _, ap := range aps {
+		addrs = append(addrs, ap.Addr())
+	}
+	return aps[e.pick(addrs)], nil
+}
+
+func (e *endpointsAddr) Get() (xnet.Addr, error) {
+	aps := e.candidates(0, "")
+	if len(aps) == 0 {
+		return xnet.Addr{}, errors.New("no ready endpoints found")
+	}
+	addrs := make([]xnet.Addr, 0, len(aps))
+	for _, ap := range aps {
+		addrs = append(addrs, ap.Addr())
+	}
+	return addrs[e.pick(addrs)], nil
+}
+
+func (e *endpointsAddr) init(cs kubernetes.Interface, ns, svcName string) error {
+	sliceCli := cs.DiscoveryV1().EndpointSlices(ns)
+	selector := discoveryv1.LabelServiceName + "=" + svcName
+	lw := &cache.ListWatch{
+		ListWithContextFunc: func(ctx context.Context, options metav1.ListOptions) (runtime.Object, error) {
+			options.LabelSelector = selector
+			return sliceCli.List(ctx, options)
+		},
+		WatchFuncWithContext: func(ctx context.Context, options metav1.ListOptions) (watch.Interface, error) {
+			options.LabelSelector = selector
+			return sliceCli.Watch(ctx, options)
+		},
+	}
+	store, stop, err := runInformer(cs, lw, &discoveryv1.EndpointSlice{})
+	if err != nil {
+		return err
+	}
+	e.store, e.stopFn = store, stop
+	return nil
+}
+
+// podSlots assigns the pods behind a Service to a fixed number of slots. A pod
+// keeps its slot as long as it has a ready endpoint, the slots of pods that are
+// gone are handed to new pods in the order of their names.
+type podSlots struct {
+	mu   sync.Mutex
+	pods []string
+	// refs counts the getters sharing the watch, which is stopped with the last one.
+	refs   int
+	stopFn func()
+}
+
+// podOf rebalances the slots over the ready pods and returns the pod of slot,
+// or "" if there are fewer pods than slots.
+func (s *podSlots) podOf(slot int, ready []string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, pod := range s.pods {
+		if pod != "" && !slices.Contains(ready, pod) {
+			s.pods[i] = ""
+		}
+	}
+	for _, pod := range ready {
+		if slices.Contains(s.pods, pod) {
+			continue
+		}
+		free := slices.Index(s.pods, "")
+		if free < 0 {
+			break
+		}
+		s.pods[free] = pod
+	}
+	return s.pods[slot]
+}
+
+func (s *podSlots) release() {
+	s.mu.Lock()
+	s.refs--
+	last := s.refs == 0
+	s.mu.Unlock()
+	if last {
+		s.stopFn()
+	}
+}
+
+func ptrValue[T any](p *T) T {
+	var zero T
+	if p == nil {
+		return zero
+	}
+	return *p
+}
@@ -0,0 +1,173 @@
+package remoteaddr
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+)
+
+func newEndpoint(ip string, ready bool) discoveryv1.Endpoint {
+	return discoveryv1.Endpoint{
+		Addresses:  []string{ip},
+		Conditions: discoveryv1.EndpointConditions{Ready: new(ready)},
+	}
+}
+
+func newEndpointSlice(name string, port int32, endpoints ...discoveryv1.Endpoint) *discoveryv1.EndpointSlice {
+	return &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: metav1.NamespaceDefault,
+			Labels:    map[string]string{discoveryv1.LabelServiceName: "web"},
+		},
+		AddressType: discoveryv1.AddressTypeIPv4,
+		Ports: []discoveryv1.EndpointPort{
+			{Name: new("http"), Port: new(port), Protocol: new(corev1.ProtocolTCP)},
+		},
+		Endpoints: endpoints,
+	}
+}
+
+func TestEndpointsAddr(t *testing.T) {
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: metav1.NamespaceDefault},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP}},
+		},
+	}
+	cs := fake.NewClientset(
+		// the named targetPort resolves differently for the pods of the two slices
+		newEndpointSlice("web-1", 8080, newEndpoint("10.0.0.1", true), newEndpoint("10.0.0.2", false)),
+		newEndpointSlice("web-2", 9090, newEndpoint("10.0.0.3", true)),
+	)
+
+	g, err := NewEndpointsAddr(cs, svc, Options{LB: LBRoundRobin, Readiness: ReadinessReady})
+	require.NoError(t, err)
+
+	var got []string
+	for range 3 {
+		ap, err := GetAddrPort(g, 80, "tcp")
+		require.NoError(t, err)
+		got = append(got, ap.String())
+	}
+	require.Equal(t, []string{"10.0.0.1:8080", "10.0.0.3:9090", "10.0.0.1:8080"}, got)
+
+	// the port is not declared by the Service, so it is not translated
+	ap, err := GetAddrPort(g, 80, "udp")
+	require.NoError(t, err)
+	require.Equal(t, "10.0.0.3:80", ap.String())
+}
+
+func TestEndpointsAddrNewest(t *testing.T) {
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: metav1.NamespaceDefault},
+		Spec: corev1.ServiceSpec{
+			Selector: map[string]string{"app": "web"},
+			Ports:    []corev1.ServicePort{{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP}},
+		},
+	}
+	newPod := func(name string, created time.Time) *corev1.Pod {
+		return &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+			Name:              name,
+			Namespace:         metav1.NamespaceDefault,
+			Labels:            map[string]string{"app": "web"},
+			CreationTimestamp: metav1.NewTime(created),
+		}}
+	}
+	podEndpoint := func(ip, pod string) discoveryv1.Endpoint {
+		ep := newEndpoint(ip, true)
+		ep.TargetRef = &corev1.ObjectReference{Kind: "Pod", Namespace: metav1.NamespaceDefault, Name: pod}
+		return ep
+	}
+	now := time.Now()
+	cs := fake.NewClientset(
+		newPod("web-old", now.Add(-time.Hour)),
+		newPod("web-new", now),
+		newEndpointSlice("web-1", 8080, podEndpoint("10.0.0.1", "web-old"), podEndpoint("10.0.0.2", "web-new")),
+	)
+
+	g, err := NewEndpointsAddr(cs, svc, Options{LB: LBNewest, Readiness: ReadinessReady})
+	require.NoError(t, err)
+	defer Stop(g)
+
+	ap, err := GetAddrPort(g, 80, "tcp")
+	require.NoError(t, err)
+	require.Equal(t, "10.0.0.2:8080", ap.String())
+}
+
+func TestEndpointsAddrReadiness(t *testing.T) {
+	terminating := newEndpoint("10.0.0.2", false)
+	terminating.Conditions.Terminating = new(true)
+	store := cache.NewStore(cache.MetaNamespaceKeyFunc)
+	_ = store.Add(newEndpointSlice("web-1", 8080, newEndpoint("10.0.0.1", false), terminating))
+
+	testCases := map[string]struct {
+		readiness Readiness
+		expected  string
+	}{
+		"ready": {
+			readiness: ReadinessReady,
+		},
+		"running": {
+			readiness: ReadinessRunning,
+			expected:  "10.0.0.1:53",
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			e := &endpointsAddr{balancer: newBalancer(LBNewest), store: store, readiness: tc.readiness}
+			// headless Services without ports keep the requested port
+			ap, err := GetAddrPort(e, 53, "udp")
+			if tc.expected == "" {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, ap.String())
+		})
+	}
+}
+
+func TestEndpointsSlots(t *testing.T) {
+	r := require.New(t)
+	podEndpoint := func(ip, pod string) discoveryv1.Endpoint {
+		ep := newEndpoint(ip, true)
+		ep.TargetRef = &corev1.ObjectReference{Kind: "Pod", Name: pod}
+		return ep
+	}
+	store := cache.NewStore(cache.MetaNamespaceKeyFunc)
+	r.NoError(store.Add(newEndpointSlice("web-1", 8080, podEndpoint("10.0.0.2", "web-b"), podEndpoint("10.0.0.1", "web-a"))))
+
+	slots := &podSlots{pods: make([]string, 3)}
+	getters := make([]*endpointsAddr, 0, 3)
+	for i := range 3 {
+		getters = append(getters, &endpointsAddr{balancer: newBalancer(LBNewest), store: store, readiness: ReadinessReady, slots: slots, slot: i})
+	}
+	dsts := func() []string {
+		var ret []string
+		for _, g := range getters {
+			ap, err := GetAddrPort(g, 80, "tcp")
+			if err != nil {
+				ret = append(ret, "")
+				continue
+			}
+			ret = append(ret, ap.String())
+		}
+		return ret
+	}
+	r.Equal([]string{"10.0.0.1:80", "10.0.0.2:80", ""}, dsts())
+
+	// web-a is replaced by web-c, web-b keeps its slot
+	r.NoError(store.Update(newEndpointSlice("web-1", 8080, podEndpoint("10.0.0.2", "web-b"), podEndpoint("10.0.0.3", "web-c"))))
+	r.Equal([]string{"10.0.0.3:80", "10.0.0.2:80", ""}, dsts())
+
+	// a new pod takes the free slot
+	r.NoError(store.Update(newEndpointSlice("web-1", 8080, podEndpoint("10.0.0.2", "web-b"), podEndpoint("10.0.0.3", "web-c"), podEndpoint("10.0.0.4", "web-0"))))
+	r.Equal([]string{"10.0.0.3:80", "10.0.0.2:80", "10.0.0.4:80"}, dsts())
+}
@@ -0,0 +1,92 @@
+package remoteaddr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/knight42/krelay/pkg/xnet"
+)
+
+// nodesAddr follows the ready nodes of the cluster, any of which can be used
+// to reach a NodePort.
+type nodesAddr struct {
+	store    cache.Store
+	stopFn   func()
+	external bool
+}
+
+var (
+	_ Getter  = (*nodesAddr)(nil)
+	_ stopper = (*nodesAddr)(nil)
+)
+
+func (n *nodesAddr) stop() {
+	n.stopFn()
+}
+
+// Get returns the address of the first ready node by name, so that the same
+// node is used as long as it stays ready.
+func (n *nodesAddr) Get() (xnet.Addr, error) {
+	var nodes []*corev1.Node
+	for _, obj := range n.store.List() {
+		nodes = append(nodes, obj.(*corev1.Node))
+	}
+	slices.SortFunc(nodes, func(a, b *corev1.Node) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	for _, node := range nodes {
+		ready := slices.ContainsFunc(node.Status.Conditions, func(c corev1.NodeCondition) bool {
+			return c.Type == corev1.NodeReady && c.Status == corev1.ConditionTrue
+		})
+		if !ready {
+			continue
+		}
+		if addr, err := NodeAddr(node, n.external); err == nil {
+			return addr, nil
+		}
+	}
+	return xnet.Addr{}, errors.New("no ready node with an address found")
+}
+
+func (n *nodesAddr) init(cs kubernetes.Interface) error {
+	nodeCli := cs.CoreV1().Nodes()
+	lw := &cache.ListWatch{
+		ListWithContextFunc: func(ctx context.Context, options metav1.ListOptions) (runtime.Object, error) {
+			return nodeCli.List(ctx, options)
+		},
+		WatchFuncWithContext: func(ctx context.Context, options metav1.ListOptions) (watch.Interface, error) {
+			return nodeCli.Watch(ctx, options)
+		},
+	}
+	store, stop, err := runInformer(cs, lw, &corev1.Node{})
+	if err != nil {
+		return err
+	}
+	n.store, n.stopFn = store, stop
+	return nil
+}
+
+// NodeAddr returns the InternalIP of the node, or its ExternalIP if external
+// is true.
+func NodeAddr(node *corev1.Node, external bool) (xnet.Addr, error) {
+	typ := corev1.NodeInternalIP
+	if external {
+		typ = corev1.NodeExternalIP
+	}
+	for _, addr := range node.Status.Addresses {
+		if addr.Type == typ {
+			return xnet.AddrFromIP(addr.Address)
+		}
+	}
+	return xnet.Addr{}, fmt.Errorf("node %s has no %s", node.Name, typ)
+}
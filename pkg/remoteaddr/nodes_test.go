@@ -0,0 +1,60 @@
+package remoteaddr
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newNode(name string, ready bool, addrs ...corev1.NodeAddress) *corev1.Node {
+	status := corev1.ConditionFalse
+	if ready {
+		status = corev1.ConditionTrue
+	}
+	return &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Status: corev1.NodeStatus{
+			Addresses:  addrs,
+			Conditions: []corev1.NodeCondition{{Type: corev1.NodeReady, Status: status}},
+		},
+	}
+}
+
+func TestNodesAddr(t *testing.T) {
+	r := require.New(t)
+	ctx := context.Background()
+	cs := fake.NewClientset(
+		newNode("a", false, corev1.NodeAddress{Type: corev1.NodeInternalIP, Address: "10.0.0.1"}),
+		newNode("c", true,
+			corev1.NodeAddress{Type: corev1.NodeInternalIP, Address: "10.0.0.3"},
+			corev1.NodeAddress{Type: corev1.NodeExternalIP, Address: "1.1.1.3"},
+		),
+		newNode("b", true, corev1.NodeAddress{Type: corev1.NodeInternalIP, Address: "10.0.0.2"}),
+	)
+
+	g, err := NewNodesAddr(cs, false)
+	r.NoError(err)
+	defer Stop(g)
+	addr, err := g.Get()
+	r.NoError(err)
+	r.Equal("10.0.0.2", addr.String())
+
+	external, err := NewNodesAddr(cs, true)
+	r.NoError(err)
+	defer Stop(external)
+	addr, err = external.Get()
+	r.NoError(err)
+	r.Equal("1.1.1.3", addr.String())
+
+	// the node goes away
+	r.NoError(cs.CoreV1().Nodes().Delete(ctx, "b", metav1.DeleteOptions{}))
+	r.Eventually(func() bool {
+		addr, err := g.Get()
+		return err == nil && addr.String() == "10.0.0.3"
+	}, 5*time.Second, 50*time.Millisecond)
+}
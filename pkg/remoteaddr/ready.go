@@ -0,0 +1,70 @@
+package remoteaddr
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Readiness decides which pods may receive connections.
+type Readiness string
+
+const (
+	// ReadinessReady requires the Ready condition of the pod.
+	ReadinessReady Readiness = "ready"
+	// ReadinessGates additionally requires every readiness gate in the pod
+	// spec to be true, even before the kubelet has reflected them in the
+	// Ready condition.
+	ReadinessGates Readiness = "gates"
+	// ReadinessRunning only requires the pod to be running, for targets
+	// without meaningful readiness probes.
+	ReadinessRunning Readiness = "running"
+)
+
+// ParseReadiness validates s as one of the supported readiness modes.
+func ParseReadiness(s string) (Readiness, error) {
+	return parseEnum("readiness", s, []Readiness{ReadinessReady, ReadinessGates, ReadinessRunning})
+}
+
+func parseEnum[T ~string](kind, s string, values []T) (T, error) {
+	v := T(s)
+	if !slices.Contains(values, v) {
+		names := make([]string, 0, len(values))
+		for _, v := range values {
+			names = append(names, string(v))
+		}
+		return "", fmt.Errorf("unknown %s %q, must be one of %s", kind, s, strings.Join(names, ", "))
+	}
+	return v, nil
+}
+
+func podConditionTrue(pod *corev1.Pod, typ corev1.PodConditionType) bool {
+	for _, cond := range pod.Status.Conditions {
+		if cond.Type == typ {
+			return cond.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// isPodReady reports whether the pod may receive connections. Terminating
+// pods never do.
+func isPodReady(pod *corev1.Pod, r Readiness) bool {
+	if pod.DeletionTimestamp != nil || pod.Status.Phase != corev1.PodRunning || pod.Status.PodIP == "" {
+		return false
+	}
+	switch r {
+	case ReadinessRunning:
+		return true
+	case ReadinessGates:
+		for _, gate := range pod.Spec.ReadinessGates {
+			if !podConditionTrue(pod, gate.ConditionType) {
+				return false
+			}
+		}
+	default:
+	}
+	return podConditionTrue(pod, corev1.PodReady)
+}
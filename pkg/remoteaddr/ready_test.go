@@ -0,0 +1,93 @@
+package remoteaddr
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestIsPodReady(t *testing.T) {
+	const gate = "example.com/lb-registered"
+	withGate := func(status corev1.ConditionStatus) *corev1.Pod {
+		pod := newPod("a", "10.0.0.1", true)
+		pod.Spec.ReadinessGates = []corev1.PodReadinessGate{{ConditionType: gate}}
+		pod.Status.Conditions = append(pod.Status.Conditions, corev1.PodCondition{Type: gate, Status: status})
+		return pod
+	}
+	terminating := newPod("a", "10.0.0.1", true)
+	terminating.DeletionTimestamp = new(metav1.Now())
+	pending := newPod("a", "", false)
+	pending.Status.Phase = corev1.PodPending
+
+	testCases := map[string]struct {
+		pod       *corev1.Pod
+		readiness Readiness
+		expected  bool
+	}{
+		"ready": {
+			pod:       newPod("a", "10.0.0.1", true),
+			readiness: ReadinessReady,
+			expected:  true,
+		},
+		"not ready": {
+			pod:       newPod("a", "10.0.0.1", false),
+			readiness: ReadinessReady,
+		},
+		"not ready but running": {
+			pod:       newPod("a", "10.0.0.1", false),
+			readiness: ReadinessRunning,
+			expected:  true,
+		},
+		"terminating": {
+			pod:       terminating,
+			readiness: ReadinessRunning,
+		},
+		"pending": {
+			pod:       pending,
+			readiness: ReadinessRunning,
+		},
+		"gate not passed": {
+			pod:       withGate(corev1.ConditionFalse),
+			readiness: ReadinessGates,
+		},
+		"gate not passed but ignored": {
+			pod:       withGate(corev1.ConditionFalse),
+			readiness: ReadinessReady,
+			expected:  true,
+		},
+		"gate passed": {
+			pod:       withGate(corev1.ConditionTrue),
+			readiness: ReadinessGates,
+			expected:  true,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			require.Equal(t, tc.expected, isPodReady(tc.pod, tc.readiness))
+		})
+	}
+}
+
+func TestDynamicAddrSkipsUnreadyPods(t *testing.T) {
+	r := require.New(t)
+	older := newPod("older", "10.0.0.1", true)
+	older.CreationTimestamp = metav1.Unix(100, 0)
+	newer := newPod("newer", "10.0.0.2", false)
+	newer.CreationTimestamp = metav1.Unix(200, 0)
+	cs := fake.NewClientset(older, newer)
+
+	g, err := NewDynamicAddr(cs, metav1.NamespaceDefault, "app=api", ReadinessReady)
+	r.NoError(err)
+	addr, err := g.Get()
+	r.NoError(err)
+	r.Equal("10.0.0.1", addr.String())
+
+	g, err = NewDynamicAddr(cs, metav1.NamespaceDefault, "app=api", ReadinessRunning)
+	r.NoError(err)
+	addr, err = g.Get()
+	r.NoError(err)
+	r.Equal("10.0.0.2", addr.String())
+}
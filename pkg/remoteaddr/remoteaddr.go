@@ -2,7 +2,10 @@ package remoteaddr
 
 import (
 	"fmt"
+	"sync"
 
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/client-go/kubernetes"
 
 	"github.com/knight42/krelay/pkg/xnet"
@@ -12,14 +15,48 @@ type Getter interface {
 	Get() (xnet.Addr, error)
 }
 
+// portGetter is implemented by getters that also decide the destination port,
+// e.g. by mapping a service port to the port of the chosen endpoint.
+type portGetter interface {
+	getAddrPort(port uint16, protocol string) (xnet.AddrPort, error)
+}
+
+// GetAddrPort returns the destination of a new connection to the remote port
+// with the given protocol.
+func GetAddrPort(g Getter, port uint16, protocol string) (xnet.AddrPort, error) {
+	if pg, ok := g.(portGetter); ok {
+		return pg.getAddrPort(port, protocol)
+	}
+	addr, err := g.Get()
+	if err != nil {
+		return xnet.AddrPort{}, err
+	}
+	return xnet.AddrPortFrom(addr, port), nil
+}
+
 func NewStaticAddr(addr xnet.Addr) Getter {
 	return &staticAddr{addr: addr}
 }
 
-func NewDynamicAddr(cs kubernetes.Interface, ns, selector string) (Getter, error) {
+// Options tune how the pods matching a selector are picked.
+type Options struct {
+	LB        LBPolicy
+	Readiness Readiness
+	// Pod restricts the candidates to the pod with this name, which keeps
+	// the address stable when the pod is recreated, e.g. by a StatefulSet.
+	Pod string
+	// AllowEmpty lets a Getter start before any pod matches the selector, its
+	// Get fails until one is ready.
+	AllowEmpty bool
+}
+
+// NewDynamicAddr returns a Getter that follows the newest pod matching the
+// selector which is ready according to readiness.
+func NewDynamicAddr(cs kubernetes.Interface, ns, selector string, readiness Readiness) (Getter, error) {
 	ret := &dynamicAddr{
-		podCli:   cs.CoreV1().Pods(ns),
-		selector: selector,
+		podCli:    cs.CoreV1().Pods(ns),
+		selector:  selector,
+		readiness: readiness,
 	}
 	err := ret.init()
 	if err != nil {
@@ -27,3 +64,91 @@ func NewDynamicAddr(cs kubernetes.Interface, ns, selector string) (Getter, error
 	}
 	return ret, nil
 }
+
+// NewBalancedAddr returns a Getter that spreads connections over all ready
+// pods matching the selector according to opts.LB. LBNewest falls back to
+// NewDynamicAddr unless opts.Pod or opts.AllowEmpty is set.
+func NewBalancedAddr(cs kubernetes.Interface, ns, selector string, opts Options) (Getter, error) {
+	if (opts.LB == LBNewest || opts.LB == "") && opts.Pod == "" && !opts.AllowEmpty {
+		return NewDynamicAddr(cs, ns, selector, opts.Readiness)
+	}
+	ret := &balancedAddr{
+		balancer:  newBalancer(opts.LB),
+		readiness: opts.Readiness,
+		pod:       opts.Pod,
+	}
+	err := ret.init(cs, ns, selector)
+	if err != nil {
+		return nil, fmt.Errorf("watch pods: %w", err)
+	}
+	return ret, nil
+}
+
+// NewEndpointsAddr returns a Getter that spreads connections over the ready
+// endpoints of the Service according to its EndpointSlices, translating the
+// service port into the endpoint port. For LBNewest it also watches the pods
+// selected by the Service to find the newest one; without a selector it picks
+// the first endpoint by address.
+func NewEndpointsAddr(cs kubernetes.Interface, svc *corev1.Service, opts Options) (Getter, error) {
+	ret := &endpointsAddr{
+		balancer:  newBalancer(opts.LB),
+		svcPorts:  svc.Spec.Ports,
+		readiness: opts.Readiness,
+		pod:       opts.Pod,
+	}
+	err := ret.init(cs, svc.Namespace, svc.Name)
+	if err != nil {
+		return nil, fmt.Errorf("watch endpointslices: %w", err)
+	}
+	if (opts.LB == LBNewest || opts.LB == "") && opts.Pod == "" && len(svc.Spec.Selector) > 0 {
+		pods, stopPods, err := watchPods(cs, svc.Namespace, labels.SelectorFromSet(svc.Spec.Selector).String())
+		if err != nil {
+			ret.stopFn()
+			return nil, fmt.Errorf("watch pods: %w", err)
+		}
+		stopSlices := ret.stopFn
+		ret.pods = pods
+		ret.stopFn = func() {
+			stopSlices()
+			stopPods()
+		}
+	}
+	return ret, nil
+}
+
+// NewEndpointsSlots returns n Getters for the pods behind the Service, sharing
+// a watch of its EndpointSlices. Every Getter sticks to one pod while it has a
+// ready endpoint, and takes over a new pod once it is gone, so that each can
+// be bound to its own local port.
+func NewEndpointsSlots(cs kubernetes.Interface, svc *corev1.Service, opts Options, n int) ([]Getter, error) {
+	base := &endpointsAddr{}
+	err := base.init(cs, svc.Namespace, svc.Name)
+	if err != nil {
+		return nil, fmt.Errorf("watch endpointslices: %w", err)
+	}
+	slots := &podSlots{pods: make([]string, n), refs: n, stopFn: base.stopFn}
+	ret := make([]Getter, 0, n)
+	for i := range n {
+		ret = append(ret, &endpointsAddr{
+			balancer:  newBalancer(opts.LB),
+			store:     base.store,
+			stopFn:    sync.OnceFunc(slots.release),
+			svcPorts:  svc.Spec.Ports,
+			readiness: opts.Readiness,
+			slots:     slots,
+			slot:      i,
+		})
+	}
+	return ret, nil
+}
+
+// NewNodesAddr returns a Getter that follows the ready nodes, to reach a
+// NodePort. It uses the ExternalIP of the nodes if external is true.
+func NewNodesAddr(cs kubernetes.Interface, external bool) (Getter, error) {
+	ret := &nodesAddr{external: external}
+	err := ret.init(cs)
+	if err != nil {
+		return nil, fmt.Errorf("watch nodes: %w", err)
+	}
+	return ret, nil
+}
@@ -0,0 +1,117 @@
+// Package tracing exports the spans of krelay and krelay-server via OTLP.
+//
+// Both sides tag their spans with the request ID of the relayed connection.
+// When tracing is enabled on the client, it also sends its trace context in
+// the header, so the spans of krelay-server join the trace of the client.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.41.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/knight42/krelay/pkg/xnet"
+)
+
+const tracerName = "github.com/knight42/krelay"
+
+// Attributes of the spans.
+const (
+	AttrRequestID = attribute.Key("krelay.request_id")
+	AttrDestAddr  = attribute.Key("krelay.dst_addr")
+	AttrLocalAddr = attribute.Key("krelay.local_addr")
+	AttrProtocol  = attribute.Key("krelay.protocol")
+	AttrAckCode   = attribute.Key("krelay.ack_code")
+	AttrBytesSent = attribute.Key("krelay.bytes_sent")
+	AttrBytesRecv = attribute.Key("krelay.bytes_received")
+)
+
+var enabled atomic.Bool
+
+// Setup exports the spans to the OTLP/HTTP collector at endpoint, e.g.
+// http://localhost:4318. The returned function flushes the pending spans and
+// has to be called before exiting.
+func Setup(ctx context.Context, serviceName, endpoint string) (shutdown func(context.Context) error, err error) {
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(endpoint))
+	if err != nil {
+		return nil, fmt.Errorf("create otlp exporter: %w", err)
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(semconv.ServiceName(serviceName)))
+	if err != nil {
+		return nil, fmt.Errorf("create resource: %w", err)
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		// follow the decision of the client
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.AlwaysSample())),
+	)
+	otel.SetTracerProvider(tp)
+	enabled.Store(true)
+	return tp.Shutdown, nil
+}
+
+// Enabled reports whether Setup has been called.
+func Enabled() bool {
+	return enabled.Load()
+}
+
+// Start starts a span with the tracer of krelay. Spans are dropped unless
+// Setup has been called.
+func Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, opts...)
+}
+
+// StartConn starts the span of a relayed connection, which lasts as long as
+// the connection.
+func StartConn(ctx context.Context, kind trace.SpanKind, reqID, protocol, dstAddr string) (context.Context, trace.Span) {
+	return Start(ctx, "relay "+protocol,
+		trace.WithSpanKind(kind),
+		trace.WithAttributes(
+			AttrRequestID.String(reqID),
+			AttrProtocol.String(protocol),
+			AttrDestAddr.String(dstAddr),
+		),
+	)
+}
+
+// Fail marks the span as failed.
+func Fail(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// ToHeader returns the trace context of the span in ctx to be sent in a
+// header.
+func ToHeader(ctx context.Context) xnet.TraceContext {
+	sc := trace.SpanContextFromContext(ctx)
+	return xnet.TraceContext{
+		TraceID: sc.TraceID(),
+		SpanID:  sc.SpanID(),
+		Flags:   byte(sc.TraceFlags()),
+	}
+}
+
+// FromHeader returns ctx with the trace context of the client as its remote
+// parent, if the header carries a valid one.
+func FromHeader(ctx context.Context, tc xnet.TraceContext) context.Context {
+	sc := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    tc.TraceID,
+		SpanID:     tc.SpanID,
+		TraceFlags: trace.TraceFlags(tc.Flags),
+		Remote:     true,
+	})
+	if !sc.IsValid() {
+		return ctx
+	}
+	return trace.ContextWithRemoteSpanContext(ctx, sc)
+}
@@ -0,0 +1,44 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/knight42/krelay/pkg/xnet"
+)
+
+func TestHeaderRoundTrip(t *testing.T) {
+	r := require.New(t)
+	sc := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{0x01, 0x02, 0x03},
+		SpanID:     trace.SpanID{0x04, 0x05},
+		TraceFlags: trace.FlagsSampled,
+	})
+	tc := ToHeader(trace.ContextWithSpanContext(context.Background(), sc))
+
+	hdr := xnet.Header{
+		Version:   xnet.HeaderVersionWithTrace,
+		RequestID: "00000",
+		Protocol:  xnet.ProtocolTCP,
+		Port:      80,
+		Trace:     tc,
+		Addr:      xnet.AddrFromHost("a.com"),
+	}
+	var got xnet.Header
+	r.NoError(got.FromReader(bytes.NewReader(hdr.Marshal())))
+
+	remote := trace.SpanContextFromContext(FromHeader(context.Background(), got.Trace))
+	r.True(remote.IsRemote())
+	r.Equal(sc.TraceID(), remote.TraceID())
+	r.Equal(sc.SpanID(), remote.SpanID())
+	r.True(remote.IsSampled())
+}
+
+func TestFromHeaderWithoutTrace(t *testing.T) {
+	ctx := context.Background()
+	require.Equal(t, ctx, FromHeader(ctx, xnet.TraceContext{}))
+}
@@ -14,6 +14,8 @@ const (
 	AckCodeResolveTimeout
 	AckCodeConnectTimeout
 	AckCodeUnknownProtocol
+	AckCodeUnauthorized
+	AckCodeForbidden
 )
 
 func (c AckCode) Error() string {
@@ -28,6 +30,10 @@ func (c AckCode) Error() string {
 		return "Connect timeout"
 	case AckCodeUnknownProtocol:
 		return "Unknown protocol"
+	case AckCodeUnauthorized:
+		return "Unauthorized"
+	case AckCodeForbidden:
+		return "Forbidden by policy"
 	default:
 		return "Unknown code"
 	}
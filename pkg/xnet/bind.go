@@ -0,0 +1,43 @@
+package xnet
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/netip"
+)
+
+// For ProtocolTCPBind, the server writes two acknowledgements. An ack with
+// AckCodeOK is followed by an address: the first one is the address the server
+// is listening on, the second one is the address of the accepted peer.
+
+// WriteBindAddr writes port(2) | ip length(1) | ip(variable).
+func WriteBindAddr(w io.Writer, ap netip.AddrPort) error {
+	ip := ap.Addr().Unmap().AsSlice()
+	buf := make([]byte, 0, 3+len(ip))
+	buf = binary.BigEndian.AppendUint16(buf, ap.Port())
+	buf = append(buf, byte(len(ip)))
+	buf = append(buf, ip...)
+	_, err := w.Write(buf)
+	return err
+}
+
+// ReadBindAddr reads an address written by WriteBindAddr.
+func ReadBindAddr(r io.Reader) (netip.AddrPort, error) {
+	var buf [3 + 16]byte
+	_, err := io.ReadFull(r, buf[:3])
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("read bind addr: %w", err)
+	}
+	port := binary.BigEndian.Uint16(buf[:2])
+	ipLen := int(buf[2])
+	if ipLen != 4 && ipLen != 16 {
+		return netip.AddrPort{}, fmt.Errorf("invalid ip length: %d", ipLen)
+	}
+	_, err = io.ReadFull(r, buf[3:3+ipLen])
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("read bind addr: %w", err)
+	}
+	ip, _ := netip.AddrFromSlice(buf[3 : 3+ipLen])
+	return netip.AddrPortFrom(ip, port), nil
+}
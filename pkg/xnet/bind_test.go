@@ -0,0 +1,40 @@
+package xnet
+
+import (
+	"bytes"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBindAddr(t *testing.T) {
+	testCases := map[string]struct {
+		ap    netip.AddrPort
+		bytes []byte
+	}{
+		"ipv4": {
+			ap:    netip.MustParseAddrPort("10.0.0.1:8080"),
+			bytes: []byte{0x1f, 0x90, 4, 10, 0, 0, 1},
+		},
+		"ipv6": {
+			ap:    netip.MustParseAddrPort("[fe80::1]:21"),
+			bytes: []byte{0, 21, 16, 0xfe, 0x80, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1},
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			r := require.New(t)
+			var buf bytes.Buffer
+			r.NoError(WriteBindAddr(&buf, tc.ap))
+			r.Equal(tc.bytes, buf.Bytes())
+
+			got, err := ReadBindAddr(&buf)
+			r.NoError(err)
+			r.Equal(tc.ap, got)
+		})
+	}
+
+	_, err := ReadBindAddr(bytes.NewReader([]byte{0, 21, 5}))
+	require.ErrorContains(t, err, "invalid ip length")
+}
@@ -10,8 +10,29 @@ import (
 const (
 	lengthAllMandatoryFields = 12 // 1(version) + 2(total length) + 5(request id) + 1(protocol) + 2(port) + 1(addr type)
 	lengthRequestID          = 5
+	maxLengthToken           = 255
 )
 
+// HeaderVersionWithToken is the first header version that carries an
+// authentication token, as a length-prefixed field between the port and the
+// address type. Earlier versions share the original layout.
+const HeaderVersionWithToken byte = 2
+
+// HeaderVersionWithTrace is the first header version that carries the trace
+// context of the client, as a fixed-size field right after the token. Clients
+// only send it when tracing is enabled, since older servers reject it.
+const HeaderVersionWithTrace byte = 3
+
+// lengthTraceContext is 16(trace id) + 8(span id) + 1(flags).
+const lengthTraceContext = 25
+
+// TraceContext is the binary form of a W3C trace context.
+type TraceContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Flags   byte
+}
+
 var letterRunes = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789")
 
 func NewRequestID() string {
@@ -27,12 +48,43 @@ type Header struct {
 	RequestID string
 	Protocol  byte
 	Port      uint16
-	Addr      Addr
+	// Token is only sent if Version is at least HeaderVersionWithToken.
+	Token string
+	// Trace is only sent if Version is at least HeaderVersionWithTrace.
+	Trace TraceContext
+	Addr  Addr
+}
+
+// ValidateToken returns an error if the token does not fit in a header. Tokens
+// have to be validated where they are configured, Marshal panics otherwise.
+func ValidateToken(token string) error {
+	if len(token) > maxLengthToken {
+		return fmt.Errorf("token is longer than %d bytes", maxLengthToken)
+	}
+	return nil
+}
+
+func (h *Header) hasToken() bool {
+	return h.Version >= HeaderVersionWithToken
+}
+
+func (h *Header) hasTrace() bool {
+	return h.Version >= HeaderVersionWithTrace
 }
 
 func (h *Header) Marshal() []byte {
 	addrBytes := h.Addr.Marshal()
 	totalLen := lengthAllMandatoryFields + len(addrBytes)
+	token := h.Token
+	if h.hasToken() {
+		if len(token) > maxLengthToken {
+			panic("xnet: token is too long, see ValidateToken")
+		}
+		totalLen += 1 + len(token)
+	}
+	if h.hasTrace() {
+		totalLen += lengthTraceContext
+	}
 	buf := make([]byte, totalLen)
 
 	cursor := 0
@@ -51,6 +103,20 @@ func (h *Header) Marshal() []byte {
 	binary.BigEndian.PutUint16(buf[cursor:cursor+2], h.Port)
 	cursor += 2
 
+	if h.hasToken() {
+		buf[cursor] = byte(len(token))
+		cursor++
+		copy(buf[cursor:cursor+len(token)], token)
+		cursor += len(token)
+	}
+
+	if h.hasTrace() {
+		cursor += copy(buf[cursor:], h.Trace.TraceID[:])
+		cursor += copy(buf[cursor:], h.Trace.SpanID[:])
+		buf[cursor] = h.Trace.Flags
+		cursor++
+	}
+
 	buf[cursor] = h.Addr.typ
 	cursor++
 
@@ -87,6 +153,30 @@ func (h *Header) FromReader(r io.Reader) error {
 	port := binary.BigEndian.Uint16(bodyBuf[cursor : cursor+2])
 	cursor += 2
 
+	h.Token = ""
+	if h.hasToken() {
+		tokenLen := int(bodyBuf[cursor])
+		cursor++
+		// the address type must follow the token
+		if cursor+tokenLen >= len(bodyBuf) {
+			return fmt.Errorf("token too long: %d", tokenLen)
+		}
+		h.Token = string(bodyBuf[cursor : cursor+tokenLen])
+		cursor += tokenLen
+	}
+
+	h.Trace = TraceContext{}
+	if h.hasTrace() {
+		// the address type must follow the trace context
+		if cursor+lengthTraceContext >= len(bodyBuf) {
+			return fmt.Errorf("body too short for trace context: %d", totalLen)
+		}
+		cursor += copy(h.Trace.TraceID[:], bodyBuf[cursor:])
+		cursor += copy(h.Trace.SpanID[:], bodyBuf[cursor:])
+		h.Trace.Flags = bodyBuf[cursor]
+		cursor++
+	}
+
 	h.RequestID = string(reqIDBytes)
 	h.Protocol = proto
 	h.Port = port
@@ -3,6 +3,7 @@ package xnet
 import (
 	"bytes"
 	"net"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -50,6 +51,56 @@ var headerCases = map[string]struct {
 			192, 168, 1, 1,
 		},
 	},
+	"token": {
+		hdr: Header{
+			Version:   HeaderVersionWithToken,
+			RequestID: fakeRequestID,
+			Protocol:  ProtocolTCP,
+			Port:      80,
+			Token:     "s3cr3t",
+			Addr:      AddrFromHost("a.com"),
+		},
+		bytes: []byte{
+			2,
+			0, 0x18,
+			0x30, 0x30, 0x30, 0x30, 0x30,
+			0,
+			0, 80,
+			6,
+			0x73, 0x33, 0x63, 0x72, 0x33, 0x74,
+			1,
+			97, 46, 99, 111, 109,
+		},
+	},
+	"trace": {
+		hdr: Header{
+			Version:   HeaderVersionWithTrace,
+			RequestID: fakeRequestID,
+			Protocol:  ProtocolTCP,
+			Port:      80,
+			Token:     "t",
+			Trace: TraceContext{
+				TraceID: [16]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15},
+				SpanID:  [8]byte{1, 2, 3, 4, 5, 6, 7, 8},
+				Flags:   1,
+			},
+			Addr: AddrFromHost("a.com"),
+		},
+		bytes: []byte{
+			3,
+			0, 0x2c,
+			0x30, 0x30, 0x30, 0x30, 0x30,
+			0,
+			0, 80,
+			1,
+			0x74,
+			0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15,
+			1, 2, 3, 4, 5, 6, 7, 8,
+			1,
+			1,
+			97, 46, 99, 111, 109,
+		},
+	},
 	"ipv6": {
 		hdr: Header{
 			Version:   0,
@@ -88,3 +139,40 @@ func TestHeaderUnmarshal(t *testing.T) {
 		})
 	}
 }
+
+func TestHeaderUnmarshalInvalidToken(t *testing.T) {
+	data := []byte{
+		2,
+		0, 0x0f,
+		0x30, 0x30, 0x30, 0x30, 0x30,
+		0,
+		0, 80,
+		5,
+		0x73, 0x33, 0x63,
+	}
+	got := Header{}
+	require.ErrorContains(t, got.FromReader(bytes.NewBuffer(data)), "token too long")
+}
+
+func TestValidateToken(t *testing.T) {
+	r := require.New(t)
+	r.NoError(ValidateToken(strings.Repeat("t", maxLengthToken)))
+	r.ErrorContains(ValidateToken(strings.Repeat("t", maxLengthToken+1)), "longer than 255 bytes")
+
+	hdr := Header{Version: HeaderVersionWithToken, RequestID: "00000", Token: strings.Repeat("t", maxLengthToken+1)}
+	r.Panics(func() { hdr.Marshal() })
+}
+
+func TestHeaderUnmarshalMissingTrace(t *testing.T) {
+	data := []byte{
+		3,
+		0, 0x12,
+		0x30, 0x30, 0x30, 0x30, 0x30,
+		0,
+		0, 80,
+		0,
+		1, 2, 3, 4, 1, 2,
+	}
+	got := Header{}
+	require.ErrorContains(t, got.FromReader(bytes.NewBuffer(data)), "body too short for trace context")
+}
@@ -4,4 +4,13 @@ const (
 	ProtocolTCP byte = iota
 	ProtocolUDP
 	ProtocolKeepalive
+	// ProtocolTCPBind asks the server to listen on a random port and relay the
+	// first connection it accepts. See WriteBindAddr for the replies.
+	ProtocolTCPBind
+	// ProtocolReverseListen asks the server to listen on the header port and
+	// announce every inbound connection. See WriteRequestID.
+	ProtocolReverseListen
+	// ProtocolReverseAccept claims the inbound connection announced with the
+	// request ID of the header, and relays it.
+	ProtocolReverseAccept
 )
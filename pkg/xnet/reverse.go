@@ -0,0 +1,58 @@
+package xnet
+
+import (
+	"fmt"
+	"io"
+)
+
+// For ProtocolReverseListen, the server writes an acknowledgement followed by
+// the address it listens on (see WriteBindAddr) and the key of the listener
+// (see WriteListenerKey). Then it writes a request ID for every inbound
+// connection, which the client claims by opening a new stream with
+// ProtocolReverseAccept, that request ID and the key as the host of the
+// address, since only the client can open streams over a port-forward
+// connection. The key keeps the clients sharing a server from claiming the
+// connections of each other.
+
+// WriteRequestID announces an inbound connection on a reverse listen stream.
+func WriteRequestID(w io.Writer, reqID string) error {
+	if len(reqID) != lengthRequestID {
+		return fmt.Errorf("invalid request id: %q", reqID)
+	}
+	_, err := io.WriteString(w, reqID)
+	return err
+}
+
+// ReadRequestID reads a request ID written by WriteRequestID.
+func ReadRequestID(r io.Reader) (string, error) {
+	var buf [lengthRequestID]byte
+	_, err := io.ReadFull(r, buf[:])
+	if err != nil {
+		return "", err
+	}
+	return string(buf[:]), nil
+}
+
+// WriteListenerKey writes length(1) | key(variable).
+func WriteListenerKey(w io.Writer, key string) error {
+	if len(key) == 0 || len(key) > 255 {
+		return fmt.Errorf("invalid listener key length: %d", len(key))
+	}
+	_, err := w.Write(append([]byte{byte(len(key))}, key...))
+	return err
+}
+
+// ReadListenerKey reads a key written by WriteListenerKey.
+func ReadListenerKey(r io.Reader) (string, error) {
+	var length [1]byte
+	_, err := io.ReadFull(r, length[:])
+	if err != nil {
+		return "", fmt.Errorf("read listener key: %w", err)
+	}
+	buf := make([]byte, length[0])
+	_, err = io.ReadFull(r, buf)
+	if err != nil {
+		return "", fmt.Errorf("read listener key: %w", err)
+	}
+	return string(buf), nil
+}
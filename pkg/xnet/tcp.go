@@ -11,8 +11,9 @@ import (
 var tcpPool = newBufferPool(constants.TCPBufferSize)
 
 // This does the actual data transfer.
-// The broker only closes the Read side.
-func tcpBroker(dst, src net.Conn, srcClosed chan struct{}) {
+// The broker only closes the Read side. The number of bytes copied is stored
+// in written before srcClosed is closed.
+func tcpBroker(dst, src net.Conn, written *int64, srcClosed chan struct{}) {
 	defer src.Close()
 	bufPtr := tcpPool.Get().(*[]byte)
 	defer tcpPool.Put(bufPtr)
@@ -22,13 +23,14 @@ func tcpBroker(dst, src net.Conn, srcClosed chan struct{}) {
 	// simple, and we drop the ReaderFrom or WriterTo checks for
 	// net.Conn->net.Conn transfers, which aren't needed). This would also let
 	// us adjust buffer size.
-	_, _ = io.CopyBuffer(dst, src, buf)
+	*written, _ = io.CopyBuffer(dst, src, buf)
 
 	close(srcClosed)
 }
 
 // ProxyTCP is excerpt from https://stackoverflow.com/a/27445109/4725840
-func ProxyTCP(reqID string, downConn, upConn *net.TCPConn) {
+// It returns the number of bytes sent to upConn and received from it.
+func ProxyTCP(reqID string, downConn, upConn *net.TCPConn) (sent, received int64) {
 	l := slog.With(slog.String(constants.LogFieldRequestID, reqID))
 	defer l.Debug("ProxyTCP exit")
 
@@ -36,8 +38,8 @@ func ProxyTCP(reqID string, downConn, upConn *net.TCPConn) {
 	upClosed := make(chan struct{})
 	downClosed := make(chan struct{})
 
-	go tcpBroker(upConn, downConn, downClosed)
-	go tcpBroker(downConn, upConn, upClosed)
+	go tcpBroker(upConn, downConn, &sent, downClosed)
+	go tcpBroker(downConn, upConn, &received, upClosed)
 
 	// wait for one half of the proxy to exit, then trigger a shutdown of the
 	// other half by calling CloseRead(). This will break the read loop in the
@@ -64,4 +66,5 @@ func ProxyTCP(reqID string, downConn, upConn *net.TCPConn) {
 	// connection and ensure all copies terminate correctly; we can trigger
 	// stats on entry and deferred exit of this function.
 	<-waitFor
+	return sent, received
 }
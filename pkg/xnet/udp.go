@@ -43,7 +43,10 @@ func ReadUDPFromStream(r io.Reader, buf []byte, timeout time.Duration) (n int, e
 
 var udpPool = newBufferPool(constants.UDPBufferSize)
 
-func ProxyUDP(reqID string, downConn *net.TCPConn, upConn net.Conn) {
+// ProxyUDP relays the length-prefixed packets of downConn to upConn, which is
+// expected to prepend the length of the packets it reads, e.g. a UDPConn. It
+// returns the number of payload bytes sent to upConn and received from it.
+func ProxyUDP(reqID string, downConn *net.TCPConn, upConn net.Conn) (sent, received int64) {
 	l := slog.With(slog.String(constants.LogFieldRequestID, reqID))
 	defer l.Debug("ProxyUDP exit")
 
@@ -73,6 +76,7 @@ func ProxyUDP(reqID string, downConn *net.TCPConn, upConn net.Conn) {
 			if err != nil {
 				return
 			}
+			sent += int64(n)
 			a.Reset()
 		}
 	}()
@@ -95,6 +99,7 @@ func ProxyUDP(reqID string, downConn *net.TCPConn, upConn net.Conn) {
 			if err != nil {
 				return
 			}
+			received += int64(n - 2)
 			a.Reset()
 		}
 	}()
@@ -112,4 +117,5 @@ func ProxyUDP(reqID string, downConn *net.TCPConn, upConn net.Conn) {
 	}
 
 	<-waitFor
+	return sent, received
 }